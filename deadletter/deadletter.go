@@ -0,0 +1,36 @@
+// Package deadletter keeps the data points a subscriber couldn't write,
+// so that they can be replayed once the cause of the failure is fixed.
+package deadletter
+
+import (
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+)
+
+// Entry is a data point which couldn't be written.
+type Entry struct {
+	Time      time.Time          `json:"time"`
+	ShapeName string             `json:"shapeName"`
+	Error     string             `json:"error"`
+	DataPoint pipeline.DataPoint `json:"dataPoint"`
+}
+
+// NewEntry returns an entry for a data point which failed with err.
+func NewEntry(shapeName string, dataPoint pipeline.DataPoint, err error) Entry {
+	return Entry{
+		Time:      time.Now().UTC(),
+		ShapeName: shapeName,
+		Error:     err.Error(),
+		DataPoint: dataPoint,
+	}
+}
+
+// Store is where a subscriber writes the data points it couldn't write.
+// It is safe for concurrent use.
+type Store interface {
+	// Write adds the entry to the store.
+	Write(entry Entry) error
+	// Close releases the resources of the store.
+	Close() error
+}
@@ -0,0 +1,187 @@
+package deadletter
+
+import (
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/subscribers/protocol"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+type fakeSubscriber struct {
+	init     protocol.InitRequest
+	received []protocol.ReceiveShapeRequest
+	failOn   int
+	disposed bool
+}
+
+func (f *fakeSubscriber) Init(request protocol.InitRequest) (protocol.InitResponse, error) {
+	f.init = request
+	return protocol.InitResponse{Success: true}, nil
+}
+
+func (f *fakeSubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error) {
+	f.received = append(f.received, request)
+	if len(f.received) == f.failOn {
+		return protocol.ReceiveShapeResponse{Message: "still broken"}, nil
+	}
+	return protocol.ReceiveShapeResponse{Success: true}, nil
+}
+
+func (f *fakeSubscriber) Dispose(request protocol.DisposeRequest) (protocol.DisposeResponse, error) {
+	f.disposed = true
+	return protocol.DisposeResponse{Success: true}, nil
+}
+
+func Test_FileStore(t *testing.T) {
+
+	Convey("Given a file store", t, func() {
+
+		dir, err := ioutil.TempDir("", "deadletter")
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+
+		path := filepath.Join(dir, "failed", "dead.jsonl")
+		sut, err := NewFileStore(path)
+		So(err, ShouldBeNil)
+
+		dataPoints := []pipeline.DataPoint{
+			{Entity: "Products", Data: map[string]interface{}{"id": 1.0}},
+			{Entity: "Products", Data: map[string]interface{}{"id": 2.0}},
+		}
+
+		for _, dp := range dataPoints {
+			So(sut.Write(NewEntry("Products", dp, errors.New("duplicate"))), ShouldBeNil)
+		}
+		So(sut.Close(), ShouldBeNil)
+
+		Convey("When the file is read", func() {
+			var entries []Entry
+			err = ReadFile(path, func(e Entry) error {
+				entries = append(entries, e)
+				return nil
+			})
+
+			Convey("Then the entries should be in the order they were written", func() {
+				So(err, ShouldBeNil)
+				So(entries, ShouldHaveLength, 2)
+				So(entries[0].ShapeName, ShouldEqual, "Products")
+				So(entries[0].Error, ShouldEqual, "duplicate")
+				So(entries[0].Time.IsZero(), ShouldBeFalse)
+				So(entries[0].DataPoint, ShouldResemble, dataPoints[0])
+				So(entries[1].DataPoint, ShouldResemble, dataPoints[1])
+			})
+		})
+
+		Convey("When the store is opened again", func() {
+			sut, err = NewFileStore(path)
+			So(err, ShouldBeNil)
+			So(sut.Write(NewEntry("Products", dataPoints[0], errors.New("again"))), ShouldBeNil)
+			So(sut.Close(), ShouldBeNil)
+
+			Convey("Then the entries should be appended", func() {
+				count := 0
+				So(ReadFile(path, func(e Entry) error { count++; return nil }), ShouldBeNil)
+				So(count, ShouldEqual, 3)
+			})
+		})
+
+		Convey("When the file is replayed", func() {
+			sub := &fakeSubscriber{}
+			init := protocol.InitRequest{Settings: map[string]interface{}{"a": "b"}}
+
+			replayed, err := Replay(path, sub, init)
+
+			Convey("Then every data point should be sent to the subscriber", func() {
+				So(err, ShouldBeNil)
+				So(replayed, ShouldEqual, 2)
+				So(sub.init, ShouldResemble, init)
+				So(sub.received[1].ShapeName, ShouldEqual, "Products")
+				So(sub.received[1].DataPoint, ShouldResemble, dataPoints[1])
+				So(sub.disposed, ShouldBeTrue)
+			})
+		})
+
+		Convey("When the file is replayed with the flags", func() {
+			initPath := filepath.Join(dir, "init.json")
+			So(ioutil.WriteFile(initPath, []byte(`{"settings": {"a": "b"}}`), 0644), ShouldBeNil)
+			So(flag.Set("replay", path), ShouldBeNil)
+			So(flag.Set("init", initPath), ShouldBeNil)
+
+			Reset(func() {
+				flag.Set("replay", "")
+				flag.Set("init", "")
+			})
+
+			sub := &fakeSubscriber{}
+
+			replayed, err := ReplayFromFlags(sub)
+
+			Convey("Then every data point should be sent to the subscriber initialized with the init file", func() {
+				So(Replaying(), ShouldBeTrue)
+				So(err, ShouldBeNil)
+				So(replayed, ShouldEqual, 2)
+				So(sub.init.Settings, ShouldResemble, map[string]interface{}{"a": "b"})
+				So(sub.disposed, ShouldBeTrue)
+			})
+		})
+
+		Convey("When a replayed data point fails again", func() {
+			sub := &fakeSubscriber{failOn: 2}
+
+			replayed, err := Replay(path, sub, protocol.InitRequest{})
+
+			Convey("Then the replay should stop and report it", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "still broken")
+				So(replayed, ShouldEqual, 1)
+				So(sub.disposed, ShouldBeTrue)
+			})
+		})
+	})
+}
+
+func Test_TableStore(t *testing.T) {
+
+	Convey("Given a table store", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS `_naveego_dead_letters`")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		sut, err := NewTableStore(db, MariaDB, "")
+		So(err, ShouldBeNil)
+
+		Convey("When an entry is written", func() {
+			entry := NewEntry("Products", pipeline.DataPoint{Entity: "Products"}, errors.New("duplicate"))
+
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `_naveego_dead_letters` (`time`, `shape_name`, `error`, `data_point`)")).
+				WithArgs(entry.Time, "Products", "duplicate", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			err = sut.Write(entry)
+
+			Convey("Then it should be inserted", func() {
+				So(err, ShouldBeNil)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+	})
+}
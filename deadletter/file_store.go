@@ -0,0 +1,91 @@
+package deadletter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type fileStore struct {
+	mu  sync.Mutex
+	out *os.File
+}
+
+// NewFileStore returns a Store which appends entries to the file at path,
+// one JSON document per line. The file and its directory are created if
+// they don't exist.
+func NewFileStore(path string) (Store, error) {
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open dead letter file: %s", err)
+	}
+
+	return &fileStore{out: out}, nil
+}
+
+func (f *fileStore) Write(entry Entry) error {
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// A single write per entry, so that a crash can only lose the last line.
+	_, err = f.out.Write(append(data, '\n'))
+
+	return err
+}
+
+func (f *fileStore) Close() error {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.out.Close()
+}
+
+// ReadFile calls fn with each entry in a file written by a file store,
+// in the order they were written. It stops at the first error.
+func ReadFile(path string, fn func(Entry) error) error {
+
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	scanner := bufio.NewScanner(in)
+	// Data points can be much larger than the default line limit.
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var entry Entry
+		if err = json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return fmt.Errorf("line %d: %s", line, err)
+		}
+
+		if err = fn(entry); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
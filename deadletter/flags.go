@@ -0,0 +1,29 @@
+package deadletter
+
+import (
+	"flag"
+	"fmt"
+)
+
+var (
+	replayFile = flag.String("replay", "", "replay the data points in a dead letter file instead of serving")
+	initFile   = flag.String("init", "", "JSON file with the settings and mappings to replay with")
+)
+
+// Replaying reports whether the -replay flag was given, in which case
+// the subscriber should replay a dead letter file instead of serving.
+func Replaying() bool {
+	return *replayFile != ""
+}
+
+// ReplayFromFlags replays the dead letter file of the -replay flag to the
+// subscriber, which is initialized with the JSON file of the -init flag.
+func ReplayFromFlags(subscriber Subscriber) (int, error) {
+
+	init, err := ReadInitRequest(*initFile)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't read init file: %s", err)
+	}
+
+	return Replay(*replayFile, subscriber, init)
+}
@@ -0,0 +1,69 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/naveego/navigator-go/subscribers/protocol"
+)
+
+// Subscriber is the part of a subscriber which is used to replay entries.
+type Subscriber interface {
+	Init(protocol.InitRequest) (protocol.InitResponse, error)
+	ReceiveDataPoint(protocol.ReceiveShapeRequest) (protocol.ReceiveShapeResponse, error)
+	Dispose(protocol.DisposeRequest) (protocol.DisposeResponse, error)
+}
+
+// Replay sends the entries in the dead letter file at path to the subscriber,
+// which is initialized with init and disposed afterwards. It stops at the first
+// data point which can't be written and returns the number of data points
+// which were written.
+func Replay(path string, subscriber Subscriber, init protocol.InitRequest) (int, error) {
+
+	_, err := subscriber.Init(init)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't initialize subscriber: %s", err)
+	}
+
+	replayed := 0
+
+	err = ReadFile(path, func(entry Entry) error {
+		resp, err := subscriber.ReceiveDataPoint(protocol.ReceiveShapeRequest{
+			ShapeName: entry.ShapeName,
+			DataPoint: entry.DataPoint,
+		})
+		if err == nil && !resp.Success {
+			err = fmt.Errorf("%s", resp.Message)
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't replay data point %d of shape %s: %s", replayed+1, entry.ShapeName, err)
+		}
+
+		replayed++
+		return nil
+	})
+
+	_, disposeErr := subscriber.Dispose(protocol.DisposeRequest{})
+	if err == nil && disposeErr != nil {
+		err = fmt.Errorf("couldn't dispose subscriber: %s", disposeErr)
+	}
+
+	return replayed, err
+}
+
+// ReadInitRequest reads the settings and mappings to replay
+// entries with from a JSON file.
+func ReadInitRequest(path string) (protocol.InitRequest, error) {
+
+	var init protocol.InitRequest
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return init, err
+	}
+
+	err = json.Unmarshal(data, &init)
+
+	return init, err
+}
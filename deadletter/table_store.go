@@ -0,0 +1,96 @@
+package deadletter
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Dialect is the SQL dialect of the database a table store writes to.
+type Dialect string
+
+// The dialects supported by NewTableStore.
+const (
+	MariaDB Dialect = "mariadb"
+	MSSQL   Dialect = "mssql"
+)
+
+// DefaultTable is the table a table store writes to if no name is given.
+const DefaultTable = "_naveego_dead_letters"
+
+var createTableSQL = map[Dialect]string{
+	MariaDB: "CREATE TABLE IF NOT EXISTS `%s` (\n" +
+		"\t`id` BIGINT NOT NULL AUTO_INCREMENT,\n" +
+		"\t`time` DATETIME NOT NULL,\n" +
+		"\t`shape_name` VARCHAR(255) NOT NULL,\n" +
+		"\t`error` TEXT NOT NULL,\n" +
+		"\t`data_point` LONGTEXT NOT NULL,\n" +
+		"\tPRIMARY KEY (`id`)\n" +
+		")",
+	MSSQL: "IF OBJECT_ID(N'[dbo].[%[1]s]', N'U') IS NULL\n" +
+		"CREATE TABLE [dbo].[%[1]s] (\n" +
+		"\t[id] BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,\n" +
+		"\t[time] DATETIME2 NOT NULL,\n" +
+		"\t[shape_name] NVARCHAR(255) NOT NULL,\n" +
+		"\t[error] NVARCHAR(MAX) NOT NULL,\n" +
+		"\t[data_point] NVARCHAR(MAX) NOT NULL\n" +
+		")",
+}
+
+var insertSQL = map[Dialect]string{
+	MariaDB: "INSERT INTO `%s` (`time`, `shape_name`, `error`, `data_point`) VALUES (?, ?, ?, ?)",
+	MSSQL:   "INSERT INTO [dbo].[%s] ([time], [shape_name], [error], [data_point]) VALUES (?1, ?2, ?3, ?4)",
+}
+
+type tableStore struct {
+	db     *sql.DB
+	insert string
+}
+
+// NewTableStore returns a Store which inserts entries into a table in db,
+// creating the table if it doesn't exist. The data point is stored as JSON.
+func NewTableStore(db *sql.DB, dialect Dialect, table string) (Store, error) {
+
+	create, ok := createTableSQL[dialect]
+	if !ok {
+		return nil, fmt.Errorf("unknown dialect %q", dialect)
+	}
+
+	if table == "" {
+		table = DefaultTable
+	}
+	table = escapeName(table)
+
+	_, err := db.Exec(fmt.Sprintf(create, table))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create dead letter table: %s", err)
+	}
+
+	return &tableStore{
+		db:     db,
+		insert: fmt.Sprintf(insertSQL[dialect], table),
+	}, nil
+}
+
+func (t *tableStore) Write(entry Entry) error {
+
+	data, err := json.Marshal(entry.DataPoint)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.db.Exec(t.insert, entry.Time, entry.ShapeName, entry.Error, string(data))
+
+	return err
+}
+
+// Close does nothing, the connection belongs to the subscriber.
+func (t *tableStore) Close() error {
+	return nil
+}
+
+// escapeName removes the characters which could end a quoted identifier.
+func escapeName(name string) string {
+	return strings.NewReplacer("`", "", "[", "", "]", "", "'", "").Replace(name)
+}
@@ -12,6 +12,8 @@ import (
 	"github.com/naveego/api/types/pipeline"
 	"github.com/naveego/api/utils"
 	"github.com/naveego/navigator-go/subscribers/protocol"
+	"github.com/naveego/pipeline-subscribers/deadletter"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
 )
 
 type csvSubscriber struct {
@@ -20,7 +22,9 @@ type csvSubscriber struct {
 	columnSeparator string
 	quoteCharacter  string
 	headersWritten  bool
+	nestedValues    string
 	mappings        []pipeline.ShapeMapping
+	deadLetters     deadletter.Store
 }
 
 func (s *csvSubscriber) Init(request protocol.InitRequest) (protocol.InitResponse, error) {
@@ -72,6 +76,23 @@ func (s *csvSubscriber) Init(request protocol.InitRequest) (protocol.InitRespons
 
 	columnSeparator, _ := mr.ReadString("column_separator")
 
+	// Nested objects are written as JSON, unless they should be flattened
+	// so that mappings can refer to their properties (address.city).
+	nestedValues, _ := mr.ReadString("nested_values")
+	if nestedValues != "" && nestedValues != shapeutils.NestedJSON && nestedValues != shapeutils.NestedFlatten {
+		return resp, fmt.Errorf("Unknown nested_values %q, expected %q or %q", nestedValues, shapeutils.NestedJSON, shapeutils.NestedFlatten)
+	}
+
+	// Rows which can't be written are kept for replaying if a dead letter file is given.
+	deadLetterFile, ok := mr.ReadString("dead_letter_file")
+	if ok {
+		s.deadLetters, err = deadletter.NewFileStore(deadLetterFile)
+		if err != nil {
+			return resp, err
+		}
+	}
+
+	s.nestedValues = nestedValues
 	s.columnSeparator = columnSeparator
 	s.quoteCharacter = quoteCharacter
 	s.shape = shape
@@ -121,10 +142,17 @@ func (s *csvSubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (
 		s.headersWritten = true
 	}
 
+	dataPoint := request.DataPoint
+	if s.nestedValues == shapeutils.NestedFlatten {
+		dataPoint = shapeutils.FlattenDataPoint(dataPoint)
+	} else {
+		dataPoint = shapeutils.EncodeNestedValues(dataPoint)
+	}
+
 	valStr := ""
 	for _, m := range s.mappings {
 
-		v, ok := request.DataPoint.Data[m.From]
+		v, ok := dataPoint.Data[m.From]
 		if ok && v != nil {
 			valStr = valStr + fmt.Sprintf("%v", v) + s.columnSeparator
 		} else {
@@ -134,13 +162,31 @@ func (s *csvSubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest) (
 
 	valStr = strings.TrimSuffix(valStr, s.columnSeparator)
 
-	fmt.Fprintf(s.out, valStr+"\r\n")
+	_, err := fmt.Fprint(s.out, valStr+"\r\n")
+	if err != nil {
+		if s.deadLetters == nil {
+			return protocol.ReceiveShapeResponse{Message: err.Error()}, err
+		}
+		dlErr := s.deadLetters.Write(deadletter.NewEntry(request.ShapeName, request.DataPoint, err))
+		if dlErr != nil {
+			return protocol.ReceiveShapeResponse{Message: err.Error()}, dlErr
+		}
+		return protocol.ReceiveShapeResponse{Message: err.Error()}, nil
+	}
 
 	return protocol.ReceiveShapeResponse{Success: true}, nil
 }
 
 func (s *csvSubscriber) Dispose(request protocol.DisposeRequest) (protocol.DisposeResponse, error) {
 
+	if s.deadLetters != nil {
+		err := s.deadLetters.Close()
+		s.deadLetters = nil
+		if err != nil {
+			return protocol.DisposeResponse{}, err
+		}
+	}
+
 	if s.out != nil {
 		err := s.out.Close()
 		s.out = nil
@@ -8,6 +8,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	_ "github.com/denisenkom/go-mssqldb"
 	"github.com/naveego/navigator-go/subscribers/server"
+	"github.com/naveego/pipeline-subscribers/deadletter"
 )
 
 var (
@@ -33,6 +34,15 @@ func main() {
 
 	subscriber := &csvSubscriber{}
 
+	if deadletter.Replaying() {
+		replayed, err := deadletter.ReplayFromFlags(subscriber)
+		logrus.Infof("Replayed %d data points", replayed)
+		if err != nil {
+			logrus.Fatal("Error replaying dead letters: ", err)
+		}
+		return
+	}
+
 	srv := server.NewSubscriberServer(addr, subscriber)
 
 	err := srv.ListenAndServe()
@@ -0,0 +1,126 @@
+package shapeutils
+
+import (
+	"encoding/json"
+
+	"github.com/naveego/api/types/pipeline"
+)
+
+// Column describes the column a property of a shape is stored in, as a
+// subscriber discovered it in its storage system. Columns carry what a
+// property's pipeline type can't, like the nullability and length of the column.
+type Column struct {
+	Name string `json:"name"`
+	// Type is the type of the column in the storage system, e.g. varchar(1000).
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+	// Length is the maximum length of a text column, in characters.
+	Length *int64 `json:"length,omitempty"`
+	// Precision and Scale are the digits of a numeric column, and of its fraction.
+	Precision *int64 `json:"precision,omitempty"`
+	Scale     *int64 `json:"scale,omitempty"`
+	// Default is the default value of the column, as the storage system renders it.
+	Default *string `json:"default,omitempty"`
+	Comment string  `json:"comment,omitempty"`
+}
+
+// mergeColumns returns the columns of a, followed by the columns of b which a doesn't have.
+func mergeColumns(a, b []Column) []Column {
+
+	if len(b) == 0 {
+		return a
+	}
+
+	columns := append([]Column{}, a...)
+	seen := map[string]bool{}
+	for _, c := range a {
+		seen[c.Name] = true
+	}
+	for _, c := range b {
+		if !seen[c.Name] {
+			columns = append(columns, c)
+		}
+	}
+
+	return columns
+}
+
+// SetColumns replaces the columns of the shape with the provided name, and returns
+// the updated shape, or nil if the cache doesn't know the shape. The columns are
+// written through to the store like the shapes passed to Remember.
+func (s *ShapeCache) SetColumns(name string, columns []Column) (shape *KnownShape, err error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldShape, ok := s.shapes[name]
+	if !ok {
+		return nil, nil
+	}
+
+	shape = oldShape.clone()
+	shape.Columns = columns
+	s.shapes[name] = shape
+
+	if s.store != nil {
+		err = s.store.Save(shape)
+	}
+
+	return shape, err
+}
+
+// GetAllShapes returns all KnownShapes, which include their columns.
+func (s *ShapeCache) GetAllShapes() (shapes []*KnownShape) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, x := range s.shapes {
+		shapes = append(shapes, x)
+	}
+
+	return
+}
+
+// columnsDescription is the description of a shape definition which has columns.
+type columnsDescription struct {
+	Columns []Column `json:"columns"`
+}
+
+// GetAllShapeDefinitionsWithColumns returns the ShapeDefinitions of all KnownShapes,
+// with the columns of the shapes which have them encoded as JSON in their Description,
+// because the shape definitions have no other place for them. ParseColumns decodes them.
+func (s *ShapeCache) GetAllShapeDefinitionsWithColumns() (shapes []pipeline.ShapeDefinition, err error) {
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, x := range s.shapes {
+		shape := x.ShapeDefinition
+		if len(x.Columns) > 0 {
+			var data []byte
+			data, err = json.Marshal(columnsDescription{Columns: x.Columns})
+			if err != nil {
+				return
+			}
+			shape.Description = string(data)
+		}
+		shapes = append(shapes, shape)
+	}
+
+	return
+}
+
+// ParseColumns returns the columns encoded in the Description of a shape
+// definition by GetAllShapeDefinitionsWithColumns, or nil if it has none.
+func ParseColumns(shape pipeline.ShapeDefinition) ([]Column, error) {
+
+	if shape.Description == "" {
+		return nil, nil
+	}
+
+	var description columnsDescription
+	err := json.Unmarshal([]byte(shape.Description), &description)
+
+	return description.Columns, err
+}
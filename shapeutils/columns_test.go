@@ -0,0 +1,90 @@
+package shapeutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/naveego/api/types/pipeline"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_Columns(t *testing.T) {
+
+	length := int64(1000)
+	columns := []Column{
+		{Name: "id", Type: "int(10)"},
+		{Name: "name", Type: "varchar(1000)", Nullable: true, Length: &length},
+	}
+
+	Convey("Given a ShapeCache with a store which knows a shape", t, func() {
+
+		dir, err := ioutil.TempDir("", "shapeutils")
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+
+		path := filepath.Join(dir, "known.json")
+
+		sut, err := NewShapeCacheWithStore(NewFileShapeStore(path))
+		So(err, ShouldBeNil)
+
+		dp := pipeline.DataPoint{
+			Source: "Test",
+			Entity: "Products",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"id"},
+				Properties: []string{"id:integer", "name:string"},
+			},
+		}
+		shape, _ := sut.Analyze(dp)
+		_, err = sut.Remember(shape)
+		So(err, ShouldBeNil)
+
+		Convey("When its columns are set", func() {
+			actual, err := sut.SetColumns("Test.Products", columns)
+			So(err, ShouldBeNil)
+
+			Convey("Then the shape should have them", func() {
+				So(actual.Columns, ShouldResemble, columns)
+				So(sut.GetAllShapes(), ShouldResemble, []*KnownShape{actual})
+			})
+
+			Convey("Then they should be stored with the shape", func() {
+				restarted, err := NewShapeCacheWithStore(NewFileShapeStore(path))
+				So(err, ShouldBeNil)
+				So(restarted.GetAllShapes()[0].Columns, ShouldResemble, columns)
+			})
+
+			Convey("Then they should be in the description of the shape definition", func() {
+				definitions, err := sut.GetAllShapeDefinitionsWithColumns()
+				So(err, ShouldBeNil)
+				So(definitions, ShouldHaveLength, 1)
+				So(definitions[0].Properties, ShouldResemble, actual.Properties)
+				parsed, err := ParseColumns(definitions[0])
+				So(err, ShouldBeNil)
+				So(parsed, ShouldResemble, columns)
+			})
+
+			Convey("Then they should be kept when another shape is merged in", func() {
+				dp.Shape.Properties = append(dp.Shape.Properties, "price:float")
+				other, _ := sut.Analyze(dp)
+				merged, err := sut.Remember(other)
+				So(err, ShouldBeNil)
+				So(merged.Columns, ShouldResemble, columns)
+			})
+		})
+
+		Convey("When the columns of an unknown shape are set", func() {
+			actual, err := sut.SetColumns("Test.Orders", columns)
+
+			Convey("Then nothing should be set", func() {
+				So(err, ShouldBeNil)
+				So(actual, ShouldBeNil)
+			})
+		})
+	})
+}
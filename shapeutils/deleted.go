@@ -0,0 +1,82 @@
+package shapeutils
+
+import (
+	"strings"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/api/utils"
+)
+
+// DeletedProperty is the reserved property a publisher sets to true to tell
+// the subscribers that the record with the keys of the data point was deleted.
+// Such a data point is a tombstone, and only its keys have to be set.
+const DeletedProperty = "_deleted"
+
+// Policies for tombstones.
+const (
+	// DeletesHard deletes the rows of tombstones.
+	DeletesHard = "hard"
+	// DeletesSoft keeps the rows of tombstones and sets a flag column instead.
+	DeletesSoft = "soft"
+)
+
+// SplitDeleted returns a copy of datapoint without DeletedProperty,
+// and whether the property marked the data point as a tombstone.
+func SplitDeleted(datapoint pipeline.DataPoint) (pipeline.DataPoint, bool) {
+
+	value, ok := datapoint.Data[DeletedProperty]
+	if !ok && !hasProperty(datapoint, DeletedProperty) {
+		return datapoint, false
+	}
+
+	data := map[string]interface{}{}
+	for k, v := range datapoint.Data {
+		if k != DeletedProperty {
+			data[k] = v
+		}
+	}
+
+	properties := []string{}
+	for _, v := range datapoint.Shape.Properties {
+		if name, _ := utils.StringSplit2(v, ":"); name != DeletedProperty {
+			properties = append(properties, v)
+		}
+	}
+
+	datapoint.Data = data
+	datapoint.Shape.Properties = properties
+	datapoint.Shape.PropertyHash = 0
+	pipeline.EnsureHashes(&datapoint.Shape)
+
+	return datapoint, isTrue(value)
+}
+
+func hasProperty(datapoint pipeline.DataPoint, property string) bool {
+	for _, v := range datapoint.Shape.Properties {
+		if name, _ := utils.StringSplit2(v, ":"); name == property {
+			return true
+		}
+	}
+	return false
+}
+
+// isTrue reports whether a value means true, which publishers
+// may send as a bool, a number or a string.
+func isTrue(v interface{}) bool {
+	switch t := v.(type) {
+	case bool:
+		return t
+	case string:
+		switch strings.ToLower(t) {
+		case "true", "1", "yes", "y":
+			return true
+		}
+	case int:
+		return t != 0
+	case int64:
+		return t != 0
+	case float64:
+		return t != 0
+	}
+	return false
+}
@@ -0,0 +1,60 @@
+package shapeutils
+
+import (
+	"testing"
+
+	"github.com/naveego/api/types/pipeline"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_SplitDeleted(t *testing.T) {
+
+	Convey("Given a data point marked as deleted", t, func() {
+
+		dp := pipeline.DataPoint{
+			Source: "Test",
+			Entity: "Customers",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"id"},
+				Properties: []string{"_deleted:bool", "id:integer"},
+			},
+			Data: map[string]interface{}{
+				"id":       1,
+				"_deleted": true,
+			},
+		}
+
+		Convey("When the deleted property is split off", func() {
+			actual, deleted := SplitDeleted(dp)
+
+			Convey("Then the data point should be a tombstone without the property", func() {
+				So(deleted, ShouldBeTrue)
+				So(actual.Shape.Properties, ShouldResemble, []string{"id:integer"})
+				So(actual.Data, ShouldResemble, map[string]interface{}{"id": 1})
+				So(actual.Shape.PropertyHash, ShouldNotEqual, dp.Shape.PropertyHash)
+			})
+
+			Convey("Then the original data point should not be changed", func() {
+				So(dp.Data, ShouldContainKey, DeletedProperty)
+			})
+		})
+
+		Convey("When the property is false", func() {
+			dp.Data["_deleted"] = "false"
+			actual, deleted := SplitDeleted(dp)
+
+			Convey("Then the data point should not be a tombstone, but lose the property", func() {
+				So(deleted, ShouldBeFalse)
+				So(actual.Data, ShouldNotContainKey, DeletedProperty)
+			})
+		})
+	})
+
+	Convey("A data point without the property should be returned unchanged", t, func() {
+		dp := pipeline.DataPoint{Data: map[string]interface{}{"id": 1}}
+		actual, deleted := SplitDeleted(dp)
+		So(deleted, ShouldBeFalse)
+		So(actual, ShouldResemble, dp)
+	})
+}
@@ -0,0 +1,244 @@
+package shapeutils
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/api/utils"
+)
+
+// Strategies for storing nested objects and arrays in data points.
+const (
+	// NestedJSON stores nested objects and arrays as JSON strings.
+	NestedJSON = "json"
+	// NestedFlatten flattens nested objects into properties with dotted
+	// names (address.city) and stores arrays as JSON strings.
+	NestedFlatten = "flatten"
+	// NestedChildTables flattens nested objects and moves the elements
+	// of arrays into child data points (see SplitDataPoint).
+	NestedChildTables = "child"
+)
+
+// ChildIndexProperty is the property of a child data point which holds
+// the position of the element in the parent's array.
+const ChildIndexProperty = "_index"
+
+// ChildDataPoints are the data points made from the elements of an array property.
+type ChildDataPoints struct {
+	// Property is the name of the array property in the parent.
+	Property string
+	// Name is the canonical name of the child shape.
+	Name string
+	// ParentName is the canonical name of the parent shape.
+	ParentName string
+	// ParentKeys are the keys of the parent, which every child data point
+	// has as properties (and keys) to refer back to its parent.
+	ParentKeys []string
+	// ParentKeyValues are the values of the parent keys, in the same order.
+	ParentKeyValues []interface{}
+	// DataPoints has one data point per element of the array.
+	DataPoints []pipeline.DataPoint
+}
+
+// EncodeNestedValues returns a copy of datapoint where nested objects
+// and arrays are replaced with their JSON encoding.
+func EncodeNestedValues(datapoint pipeline.DataPoint) pipeline.DataPoint {
+	if !hasNestedValues(datapoint) {
+		return datapoint
+	}
+
+	data := map[string]interface{}{}
+	for k, v := range datapoint.Data {
+		data[k] = encodeNested(v)
+	}
+	datapoint.Data = data
+
+	return datapoint
+}
+
+// FlattenDataPoint returns a copy of datapoint where nested objects are flattened
+// into properties with dotted names, so {"address": {"city": "Dallas"}} becomes
+// {"address.city": "Dallas"}. The types of the new properties are inferred from
+// their values. Arrays are replaced with their JSON encoding.
+func FlattenDataPoint(datapoint pipeline.DataPoint) pipeline.DataPoint {
+	flat, _ := flattenDataPoint(datapoint, false)
+	return flat
+}
+
+// SplitDataPoint flattens the nested objects in datapoint like FlattenDataPoint,
+// but moves the elements of arrays into child data points. A child data point
+// has the parent's keys, the position of the element (ChildIndexProperty) and
+// the element's flattened properties (or "value" if the element isn't an object).
+// Its entity is the parent's entity and the array property, joined by a dot.
+func SplitDataPoint(datapoint pipeline.DataPoint) (parent pipeline.DataPoint, children []ChildDataPoints) {
+
+	parent, arrays := flattenDataPoint(datapoint, true)
+
+	names := []string{}
+	for name := range arrays {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	keyTypes := PropertiesAndTypes{}
+	for _, v := range datapoint.Shape.Properties {
+		name, t := utils.StringSplit2(v, ":")
+		keyTypes[name] = t
+	}
+
+	for _, name := range names {
+		child := ChildDataPoints{
+			Property:   name,
+			ParentName: CanonicalName(datapoint),
+			ParentKeys: datapoint.Shape.KeyNames,
+		}
+
+		for _, k := range datapoint.Shape.KeyNames {
+			child.ParentKeyValues = append(child.ParentKeyValues, datapoint.Data[k])
+		}
+
+		template := pipeline.DataPoint{
+			Source: datapoint.Source,
+			Entity: datapoint.Entity + "." + name,
+		}
+		if datapoint.Entity == "" {
+			template.Entity = name
+		}
+		child.Name = CanonicalName(template)
+
+		for i, element := range arrays[name] {
+			dp := template
+			dp.Data = map[string]interface{}{}
+
+			if m, ok := element.(map[string]interface{}); ok {
+				flattenInto(dp.Data, "", m)
+			} else {
+				dp.Data["value"] = encodeNested(element)
+			}
+
+			// The keys referring to the parent take precedence
+			// over properties of the element with the same name.
+			for j, k := range child.ParentKeys {
+				dp.Data[k] = child.ParentKeyValues[j]
+			}
+			dp.Data[ChildIndexProperty] = i
+
+			dp.Shape.KeyNames = append(append([]string{}, child.ParentKeys...), ChildIndexProperty)
+			for k, v := range dp.Data {
+				t, ok := keyTypes[k]
+				if !ok || !contains(child.ParentKeys, k) {
+					t = inferredType(v)
+				}
+				if k == ChildIndexProperty {
+					t = "integer"
+				}
+				dp.Shape.Properties = append(dp.Shape.Properties, k+":"+t)
+			}
+			sort.Strings(dp.Shape.Properties)
+			pipeline.EnsureHashes(&dp.Shape)
+
+			child.DataPoints = append(child.DataPoints, dp)
+		}
+
+		children = append(children, child)
+	}
+
+	return parent, children
+}
+
+// flattenDataPoint flattens the nested objects in datapoint. If splitArrays is true
+// the arrays are removed from the data point and returned, otherwise they are encoded.
+func flattenDataPoint(datapoint pipeline.DataPoint, splitArrays bool) (pipeline.DataPoint, map[string][]interface{}) {
+
+	arrays := map[string][]interface{}{}
+
+	if !hasNestedValues(datapoint) {
+		return datapoint, arrays
+	}
+
+	data := map[string]interface{}{}
+	properties := []string{}
+
+	for _, v := range datapoint.Shape.Properties {
+		name, _ := utils.StringSplit2(v, ":")
+		value, ok := datapoint.Data[name]
+
+		switch nested := value.(type) {
+		case map[string]interface{}:
+			flat := map[string]interface{}{}
+			flattenInto(flat, name+".", nested)
+			for k, fv := range flat {
+				data[k] = fv
+				properties = append(properties, k+":"+inferredType(fv))
+			}
+		case []interface{}:
+			if splitArrays {
+				arrays[name] = nested
+				continue
+			}
+			data[name] = encodeNested(nested)
+			properties = append(properties, name+":object")
+		default:
+			if ok {
+				data[name] = value
+			}
+			properties = append(properties, v)
+		}
+	}
+
+	sort.Strings(properties)
+
+	datapoint.Data = data
+	datapoint.Shape.Properties = properties
+	datapoint.Shape.PropertyHash = 0
+	pipeline.EnsureHashes(&datapoint.Shape)
+
+	return datapoint, arrays
+}
+
+// flattenInto copies the values in nested into flat, with their names
+// prefixed by prefix. Nested objects are flattened recursively,
+// arrays are encoded as JSON.
+func flattenInto(flat map[string]interface{}, prefix string, nested map[string]interface{}) {
+	for k, v := range nested {
+		if m, ok := v.(map[string]interface{}); ok {
+			flattenInto(flat, prefix+k+".", m)
+			continue
+		}
+		flat[prefix+k] = encodeNested(v)
+	}
+}
+
+// encodeNested returns the JSON encoding of maps and slices,
+// and any other value unchanged.
+func encodeNested(v interface{}) interface{} {
+	switch v.(type) {
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil
+		}
+		return string(b)
+	}
+	return v
+}
+
+// inferredType returns the type of a value, defaulting to string for nil.
+func inferredType(v interface{}) string {
+	t := InferValueType(v)
+	if t == "" {
+		return "string"
+	}
+	return t
+}
+
+func hasNestedValues(datapoint pipeline.DataPoint) bool {
+	for _, v := range datapoint.Data {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			return true
+		}
+	}
+	return false
+}
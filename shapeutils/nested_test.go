@@ -0,0 +1,93 @@
+package shapeutils
+
+import (
+	"testing"
+
+	"github.com/naveego/api/types/pipeline"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_NestedDataPoints(t *testing.T) {
+
+	Convey("Given a data point with nested values", t, func() {
+
+		dp := pipeline.DataPoint{
+			Source: "Test",
+			Entity: "Customers",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"id"},
+				Properties: []string{"address:object", "id:integer", "name:string", "orders:object"},
+			},
+			Data: map[string]interface{}{
+				"id":   1,
+				"name": "First",
+				"address": map[string]interface{}{
+					"city": "Dallas",
+					"geo":  map[string]interface{}{"lat": 32.7},
+				},
+				"orders": []interface{}{
+					map[string]interface{}{"total": 42.5, "id": 99},
+					map[string]interface{}{"total": 10.5},
+				},
+			},
+		}
+
+		Convey("When the nested values are encoded", func() {
+			actual := EncodeNestedValues(dp)
+
+			Convey("Then they should be JSON strings", func() {
+				So(actual.Data["address"], ShouldEqual, `{"city":"Dallas","geo":{"lat":32.7}}`)
+				So(actual.Data["orders"], ShouldEqual, `[{"id":99,"total":42.5},{"total":10.5}]`)
+				So(actual.Shape, ShouldResemble, dp.Shape)
+			})
+		})
+
+		Convey("When the data point is flattened", func() {
+			actual := FlattenDataPoint(dp)
+
+			Convey("Then objects should be flattened into dotted properties", func() {
+				So(actual.Data, ShouldResemble, map[string]interface{}{
+					"id":              1,
+					"name":            "First",
+					"address.city":    "Dallas",
+					"address.geo.lat": 32.7,
+					"orders":          `[{"id":99,"total":42.5},{"total":10.5}]`,
+				})
+				So(actual.Shape.Properties, ShouldResemble, []string{
+					"address.city:string", "address.geo.lat:float", "id:integer", "name:string", "orders:object",
+				})
+				So(actual.Shape.KeyNames, ShouldResemble, []string{"id"})
+			})
+		})
+
+		Convey("When the data point is split", func() {
+			parent, children := SplitDataPoint(dp)
+
+			Convey("Then the parent should not have the array", func() {
+				So(parent.Data, ShouldNotContainKey, "orders")
+				So(parent.Shape.Properties, ShouldResemble, []string{
+					"address.city:string", "address.geo.lat:float", "id:integer", "name:string",
+				})
+			})
+
+			Convey("Then the array elements should be child data points", func() {
+				So(children, ShouldHaveLength, 1)
+
+				child := children[0]
+				So(child.Property, ShouldEqual, "orders")
+				So(child.Name, ShouldEqual, "Test.Customers.orders")
+				So(child.ParentName, ShouldEqual, "Test.Customers")
+				So(child.ParentKeys, ShouldResemble, []string{"id"})
+				So(child.ParentKeyValues, ShouldResemble, []interface{}{1})
+				So(child.DataPoints, ShouldHaveLength, 2)
+
+				first := child.DataPoints[0]
+				So(first.Data, ShouldResemble, map[string]interface{}{"id": 1, "_index": 0, "total": 42.5})
+				So(first.Shape.KeyNames, ShouldResemble, []string{"id", ChildIndexProperty})
+				So(first.Shape.Properties, ShouldResemble, []string{"_index:integer", "id:integer", "total:float"})
+				So(CanonicalName(first), ShouldEqual, child.Name)
+			})
+		})
+	})
+}
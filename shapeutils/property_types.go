@@ -0,0 +1,48 @@
+package shapeutils
+
+// PropertyTypeChange describes a property whose type in a new shape
+// cannot be stored using its type in the known shape.
+type PropertyTypeChange struct {
+	// OldType is the type of the property in the known shape.
+	OldType string
+	// NewType is the type the property must be widened to
+	// so that it can hold values of both shapes.
+	NewType string
+}
+
+// PropertyTypeChanges is a map from property name to the change of its type.
+type PropertyTypeChanges map[string]PropertyTypeChange
+
+// typeRanks orders the types which can be widened into each other.
+// A type can hold all the values of the types ranked below it.
+// Every type can be widened to a string.
+var typeRanks = map[string]int{
+	"integer": 1,
+	"float":   2,
+	"string":  3,
+}
+
+// WidenType returns the narrowest type which can hold values of both
+// types, following the policy integer → float → string and
+// anything else (date, bool, ...) → string. A property without a type
+// ("") has no type information, so it doesn't widen the other type.
+func WidenType(a, b string) string {
+	if a == b || b == "" {
+		return a
+	}
+	if a == "" {
+		return b
+	}
+
+	rankA, okA := typeRanks[a]
+	rankB, okB := typeRanks[b]
+
+	if okA && okB {
+		if rankA > rankB {
+			return a
+		}
+		return b
+	}
+
+	return "string"
+}
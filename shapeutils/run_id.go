@@ -0,0 +1,16 @@
+package shapeutils
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+)
+
+// NewRunID returns an id for a run which didn't get one in the settings of a
+// subscriber. It starts with the time, so that the ids of runs sort in the
+// order they started.
+func NewRunID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405") + "-" + hex.EncodeToString(b)
+}
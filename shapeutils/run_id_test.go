@@ -0,0 +1,17 @@
+package shapeutils
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_NewRunID(t *testing.T) {
+
+	Convey("Run ids should start with the time and be unique", t, func() {
+		first, second := NewRunID(), NewRunID()
+		So(first, ShouldHaveLength, len("20060102T150405-01234567"))
+		So(first[8], ShouldEqual, 'T')
+		So(second, ShouldNotEqual, first)
+	})
+}
@@ -2,6 +2,7 @@ package shapeutils
 
 import (
 	"sort"
+	"sync"
 
 	"github.com/naveego/api/types/pipeline"
 	"github.com/naveego/api/utils"
@@ -15,17 +16,24 @@ type PropertiesAndTypes map[string]string
 // ShapeDelta will contain information about the current data points
 // shape, with respect to the pipeline shape for the same entity.
 // This information can be used by the subcriber to alter its
-// storage if necessary.
+// storage if necessary. MissingProperties and RemovedKeys describe
+// what the known shape has that the data point's shape doesn't; they
+// never require a change to the storage, but let a subscriber detect
+// upstream schema drift.
 type ShapeDelta struct {
-	IsNew            bool
-	HasKeyChanges    bool
-	HasNewProperties bool
+	IsNew                bool
+	HasKeyChanges        bool
+	HasNewProperties     bool
+	HasChangedProperties bool
 	//PreviousShapeDef pipeline.ShapeDefinition
 	//ShapeDef         pipeline.ShapeDefinition
-	Name          string
-	NewKeys       []string
-	ExistingKeys  []string
-	NewProperties PropertiesAndTypes
+	Name              string
+	NewKeys           []string
+	ExistingKeys      []string
+	NewProperties     PropertiesAndTypes
+	ChangedProperties PropertyTypeChanges
+	MissingProperties PropertiesAndTypes
+	RemovedKeys       []string
 }
 
 type knownHashes map[uint32]bool
@@ -36,9 +44,17 @@ func (k knownHashes) merge(other knownHashes) {
 	}
 }
 
+// KnownShape is a ShapeDefinition along with the hashes of all the data point
+// shapes it was built from. Once a KnownShape is in a ShapeCache it is not
+// modified any more (other than its cache), so it is safe to share between goroutines.
 type KnownShape struct {
 	pipeline.ShapeDefinition
 
+	// Columns are the columns of the shape's storage, as the subscriber discovered them.
+	// They are not updated when the storage is changed for a new shape.
+	Columns []Column
+
+	mu    sync.RWMutex
 	cache map[string]interface{}
 
 	keyHashes  knownHashes
@@ -46,14 +62,39 @@ type KnownShape struct {
 }
 
 // Set caches the value under key. The cache will be wiped if another shape is merged in.
-func (k *KnownShape) Set(key string, value interface{}) { k.cache[key] = value }
+func (k *KnownShape) Set(key string, value interface{}) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.cache[key] = value
+}
 
 // Get returns the value cached under key.
 func (k *KnownShape) Get(key string) (interface{}, bool) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
 	v, ok := k.cache[key]
 	return v, ok
 }
 
+// clone returns a copy of the shape with an empty cache,
+// which can be changed without affecting the original.
+func (k *KnownShape) clone() *KnownShape {
+	c := &KnownShape{
+		ShapeDefinition: k.ShapeDefinition,
+		cache:           map[string]interface{}{},
+		keyHashes:       knownHashes{},
+		propHashes:      knownHashes{},
+	}
+
+	c.Keys = append([]string{}, k.Keys...)
+	c.Properties = append([]pipeline.PropertyDefinition{}, k.Properties...)
+	c.Columns = append([]Column(nil), k.Columns...)
+	c.keyHashes.merge(k.keyHashes)
+	c.propHashes.merge(k.propHashes)
+
+	return c
+}
+
 func (k *KnownShape) MatchesShape(shape pipeline.Shape) bool {
 	pipeline.EnsureHashes(&shape)
 	return k.keyHashes[shape.KeyNamesHash] && k.propHashes[shape.PropertyHash]
@@ -64,15 +105,19 @@ func (k *KnownShape) Merge(other *KnownShape) {
 	k.keyHashes.merge(other.keyHashes)
 	k.propHashes.merge(other.propHashes)
 
-	seenProps := map[string]bool{}
+	seenProps := map[string]int{}
 	allProps := []pipeline.PropertyDefinition{}
 
 	for _, p := range append(other.Properties, k.Properties...) {
-		if _, ok := seenProps[p.Name]; !ok {
+		if i, ok := seenProps[p.Name]; ok {
+			allProps[i].Type = WidenType(allProps[i].Type, p.Type)
+		} else {
+			seenProps[p.Name] = len(allProps)
 			allProps = append(allProps, p)
-			seenProps[p.Name] = true
 		}
 	}
+	// Subscribers rely on the properties being in the same order as their columns.
+	sort.Sort(pipeline.SortPropertyDefinitionsByName(allProps))
 	k.Properties = allProps
 
 	seenKeys := map[string]bool{}
@@ -86,7 +131,40 @@ func (k *KnownShape) Merge(other *KnownShape) {
 	}
 	k.Keys = allKeys
 
+	k.Columns = mergeColumns(k.Columns, other.Columns)
+
+	k.mu.Lock()
+	k.cache = map[string]interface{}{}
+	k.mu.Unlock()
+}
+
+// DropProperties removes the named properties from the shape. Keys are not affected.
+// The known property hashes and the cache are wiped, because they may describe
+// shapes with the dropped properties.
+func (k *KnownShape) DropProperties(names []string) {
+
+	props := []pipeline.PropertyDefinition{}
+
+	for _, p := range k.Properties {
+		if !contains(names, p.Name) || contains(k.Keys, p.Name) {
+			props = append(props, p)
+		}
+	}
+	k.Properties = props
+
+	var columns []Column
+	for _, c := range k.Columns {
+		if !contains(names, c.Name) || contains(k.Keys, c.Name) {
+			columns = append(columns, c)
+		}
+	}
+	k.Columns = columns
+
+	k.propHashes = knownHashes{}
+
+	k.mu.Lock()
 	k.cache = map[string]interface{}{}
+	k.mu.Unlock()
 }
 
 // NewKnownShape creates a new KnownShape from a datapoint.
@@ -100,7 +178,7 @@ func NewKnownShape(datapoint pipeline.DataPoint) *KnownShape {
 		keyHashes:  knownHashes{shape.KeyNamesHash: true},
 		propHashes: knownHashes{shape.PropertyHash: true},
 		ShapeDefinition: pipeline.ShapeDefinition{
-			Name: canonicalName(datapoint),
+			Name: CanonicalName(datapoint),
 			Keys: datapoint.Shape.KeyNames,
 		},
 	}
@@ -119,22 +197,53 @@ func NewKnownShape(datapoint pipeline.DataPoint) *KnownShape {
 
 }
 
+// ShapeCache keeps track of the KnownShapes a subscriber has seen.
+// It is safe for concurrent use.
 type ShapeCache struct {
+	mu     sync.RWMutex
 	shapes map[string]*KnownShape
+	store  ShapeStore
+
+	// changing holds a lock per shape name, used by Ensure
+	// to apply the changes for a shape only once.
+	changing map[string]*sync.Mutex
 }
 
-func NewShapeCache() ShapeCache {
-	return ShapeCache{
-		shapes: map[string]*KnownShape{},
+func NewShapeCache() *ShapeCache {
+	return &ShapeCache{
+		shapes:   map[string]*KnownShape{},
+		changing: map[string]*sync.Mutex{},
 	}
 }
 
+// NewShapeCacheWithStore creates a ShapeCache seeded with the shapes in store.
+// Every shape passed to Remember will be written through to the store.
+func NewShapeCacheWithStore(store ShapeStore) (*ShapeCache, error) {
+
+	cache := NewShapeCache()
+	cache.store = store
+
+	shapes, err := store.Load()
+	if err != nil {
+		return cache, err
+	}
+
+	for _, shape := range shapes {
+		cache.shapes[shape.Name] = shape
+	}
+
+	return cache, nil
+}
+
 // Recognize returns the KnownShape for a datapoint if it's recognized.
 // Otherwise it returns an empty KnownShape and recognized == false.
 func (s *ShapeCache) Recognize(datapoint pipeline.DataPoint) (shape *KnownShape, recognized bool) {
 
-	name := canonicalName(datapoint)
+	name := CanonicalName(datapoint)
+
+	s.mu.RLock()
 	shape, ok := s.shapes[name]
+	s.mu.RUnlock()
 
 	if !ok || !shape.MatchesShape(datapoint.Shape) {
 		return nil, false
@@ -147,7 +256,9 @@ func (s *ShapeCache) Analyze(datapoint pipeline.DataPoint) (shape *KnownShape, d
 
 	shape = NewKnownShape(datapoint)
 
+	s.mu.RLock()
 	oldShape, ok := s.shapes[shape.Name]
+	s.mu.RUnlock()
 
 	knownShapes := map[string]pipeline.ShapeDefinition{}
 
@@ -160,25 +271,120 @@ func (s *ShapeCache) Analyze(datapoint pipeline.DataPoint) (shape *KnownShape, d
 	return
 }
 
+// ShapeChangeFunc applies the changes described by delta (for example by altering
+// a table), before the shape is remembered by a ShapeCache.
+type ShapeChangeFunc func(shape *KnownShape, delta ShapeDelta) error
+
+// Ensure returns the KnownShape for the datapoint. If the datapoint is not recognized
+// its shape is analyzed, apply is called with the delta and the shape is remembered.
+// Concurrent calls for the same shape name wait for the one which is applying
+// a change, so that a change is only applied once. If apply returns an error
+// the shape is not remembered.
+func (s *ShapeCache) Ensure(datapoint pipeline.DataPoint, apply ShapeChangeFunc) (*KnownShape, error) {
+
+	shape, ok := s.Recognize(datapoint)
+	if ok {
+		return shape, nil
+	}
+
+	lock := s.changeLock(CanonicalName(datapoint))
+	lock.Lock()
+	defer lock.Unlock()
+
+	// Another goroutine may have remembered the shape while we were waiting.
+	shape, ok = s.Recognize(datapoint)
+	if ok {
+		return shape, nil
+	}
+
+	shape, delta := s.Analyze(datapoint)
+
+	err := apply(shape, delta)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.Remember(shape)
+}
+
+func (s *ShapeCache) changeLock(name string) *sync.Mutex {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lock, ok := s.changing[name]
+	if !ok {
+		lock = &sync.Mutex{}
+		s.changing[name] = lock
+	}
+
+	return lock
+}
+
+// Forget removes the named properties from the KnownShape with the provided name,
+// and returns the updated shape. If the cache has a store the shape is saved to it.
+func (s *ShapeCache) Forget(name string, properties []string) (shape *KnownShape, err error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	oldShape, ok := s.shapes[name]
+	if !ok {
+		return nil, nil
+	}
+
+	shape = oldShape.clone()
+	shape.DropProperties(properties)
+	s.shapes[name] = shape
+
+	if s.store != nil {
+		err = s.store.Save(shape)
+	}
+
+	return shape, err
+}
+
+// Knows returns true if the cache has a shape with the provided name.
+func (s *ShapeCache) Knows(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.shapes[name]
+	return ok
+}
+
 // Remember merges the provided newShape into the cache, and returns
 // the remembered shape (which may not be the shape that was merged in).
-func (s *ShapeCache) Remember(newShape *KnownShape) (shape *KnownShape) {
+// If the cache has a store the remembered shape is saved to it.
+func (s *ShapeCache) Remember(newShape *KnownShape) (shape *KnownShape, err error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	oldShape, ok := s.shapes[newShape.Name]
 
 	if ok {
-		oldShape.Merge(newShape)
-		return oldShape
+		// Merge into a copy, because other goroutines may be using the old shape.
+		shape = oldShape.clone()
+		shape.Merge(newShape)
+	} else {
+		shape = newShape
 	}
 
-	s.shapes[newShape.Name] = newShape
+	s.shapes[shape.Name] = shape
+
+	if s.store != nil {
+		err = s.store.Save(shape)
+	}
 
-	return newShape
+	return shape, err
 }
 
 // GetAllShapeDefinitions returns the ShapeDefinitions of all KnownShapes
 func (s *ShapeCache) GetAllShapeDefinitions() (shapes []pipeline.ShapeDefinition) {
 
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	for _, x := range s.shapes {
 		shapes = append(shapes, x.ShapeDefinition)
 	}
@@ -187,12 +393,20 @@ func (s *ShapeCache) GetAllShapeDefinitions() (shapes []pipeline.ShapeDefinition
 }
 
 func (si ShapeDelta) HasChanges() bool {
-	return si.IsNew || si.HasKeyChanges || si.HasNewProperties
+	return si.IsNew || si.HasKeyChanges || si.HasNewProperties || si.HasChangedProperties
+}
+
+// HasRemovals returns true if the known shape has properties or keys
+// which are not in the data point's shape.
+func (si ShapeDelta) HasRemovals() bool {
+	return len(si.MissingProperties) > 0 || len(si.RemovedKeys) > 0
 }
 
 // GenerateShapeDelta will determine the diffferences between an existing shape and the shape of a new
 // data point.  If the new shape is a subset of the current shape it is not considered a change.  This
 // is due to the fact that it does not represent a change that needs to be made in the storage system.
+// A property whose type can no longer be stored using the known type (see WidenType) is reported
+// in ChangedProperties, with the type it must be widened to.
 
 func GenerateShapeDelta(knownShapes map[string]pipeline.ShapeDefinition, shapeDef pipeline.ShapeDefinition) ShapeDelta {
 
@@ -223,7 +437,40 @@ func GenerateShapeDelta(knownShapes map[string]pipeline.ShapeDefinition, shapeDe
 		}
 	}
 
-	// Properties already known, no need to change.
+	for _, key := range prevShape.Keys {
+		if !contains(shapeDef.Keys, key) {
+			info.RemovedKeys = append(info.RemovedKeys, key)
+		}
+	}
+
+	for _, prop := range prevShape.Properties {
+		if !containsProp(prop, shapeDef.Properties) {
+			if info.MissingProperties == nil {
+				info.MissingProperties = PropertiesAndTypes{}
+			}
+			info.MissingProperties[prop.Name] = prop.Type
+		}
+	}
+
+	for _, prop := range shapeDef.Properties {
+		prevProp, ok := findProp(prop.Name, prevShape.Properties)
+		if !ok {
+			continue
+		}
+		widened := WidenType(prevProp.Type, prop.Type)
+		if widened != prevProp.Type {
+			if info.ChangedProperties == nil {
+				info.ChangedProperties = PropertyTypeChanges{}
+			}
+			info.ChangedProperties[prop.Name] = PropertyTypeChange{
+				OldType: prevProp.Type,
+				NewType: widened,
+			}
+			info.HasChangedProperties = true
+		}
+	}
+
+	// Properties already known, no need to add any.
 	if isSubsetOf(shapeDef.Properties, prevShape.Properties) {
 		if !info.HasKeyChanges {
 			// No key changes and no property changes means we can just re-use the existing shape.
@@ -284,15 +531,22 @@ func isSubsetOf(list []pipeline.PropertyDefinition, all []pipeline.PropertyDefin
 }
 
 func containsProp(v pipeline.PropertyDefinition, a []pipeline.PropertyDefinition) bool {
+	_, ok := findProp(v.Name, a)
+	return ok
+}
+
+// findProp is a helper function that returns the property with the given name.
+func findProp(name string, a []pipeline.PropertyDefinition) (pipeline.PropertyDefinition, bool) {
 	for _, i := range a {
-		if i.Name == v.Name {
-			return true
+		if i.Name == name {
+			return i, true
 		}
 	}
-	return false
+	return pipeline.PropertyDefinition{}, false
 }
 
-func canonicalName(dp pipeline.DataPoint) string {
+// CanonicalName returns the name of the KnownShape for a data point.
+func CanonicalName(dp pipeline.DataPoint) string {
 	if dp.Source == "" {
 		return dp.Entity
 	}
@@ -2,6 +2,7 @@ package shapeutils
 
 import (
 	"math/rand"
+	"sync"
 	"testing"
 
 	"bitbucket.org/naveego/core/crypto"
@@ -269,6 +270,17 @@ func TestGenerateShapeDelta(t *testing.T) {
 			Convey("with NewProperties set to empty array", func() {
 				So(ShapeDelta.NewProperties, ShouldBeEmpty)
 			})
+			Convey("where HasRemovals() returns true", func() {
+				So(ShapeDelta.HasRemovals(), ShouldBeTrue)
+			})
+			Convey("with MissingProperties = ['age':'number']", func() {
+				So(ShapeDelta.MissingProperties, ShouldResemble, PropertiesAndTypes{
+					"age": "number",
+				})
+			})
+			Convey("with RemovedKeys set to empty array", func() {
+				So(ShapeDelta.RemovedKeys, ShouldBeEmpty)
+			})
 		})
 	})
 
@@ -304,12 +316,114 @@ func TestGenerateShapeDelta(t *testing.T) {
 			Convey("with NewKeys = 'name'", func() {
 				So(ShapeDelta.NewKeys, ShouldResemble, []string{"name"})
 			})
+			Convey("with RemovedKeys = 'id'", func() {
+				So(ShapeDelta.RemovedKeys, ShouldResemble, []string{"id"})
+			})
 			Convey("with NewProperties set to empty array", func() {
 				So(ShapeDelta.NewProperties, ShouldBeEmpty)
 			})
 		})
 	})
 
+	Convey("Given a data point with a shape that has a property with a wider type", t, func() {
+		knownShapes[testShape.Name] = testShape
+		testShapeWider := testShape
+		testShapeWider.Properties = []pipeline.PropertyDefinition{
+			{Name: "age", Type: "string"},
+			{Name: "id", Type: "number"},
+			{Name: "name", Type: "string"},
+		}
+		ShapeDelta := GenerateShapeDelta(knownShapes, testShapeWider)
+
+		Reset(func() {
+			knownShapes = map[string]pipeline.ShapeDefinition{}
+		})
+
+		Convey("Should return a shape info", func() {
+			Convey("where HasChanges() returns true", func() {
+				So(ShapeDelta.HasChanges(), ShouldBeTrue)
+			})
+			Convey("with HasChangedProperties = true", func() {
+				So(ShapeDelta.HasChangedProperties, ShouldBeTrue)
+			})
+			Convey("with HasNewProperties = false", func() {
+				So(ShapeDelta.HasNewProperties, ShouldBeFalse)
+			})
+			Convey("with ChangedProperties = ['age':'number'->'string']", func() {
+				So(ShapeDelta.ChangedProperties, ShouldResemble, PropertyTypeChanges{
+					"age": {OldType: "number", NewType: "string"},
+				})
+			})
+		})
+	})
+
+	Convey("Given a data point with a shape that has a property with a narrower type", t, func() {
+		knownShapes[testShapeNoAge.Name] = testShapeNoAge
+		testShapeNarrower := testShapeNoAge
+		testShapeNarrower.Properties = []pipeline.PropertyDefinition{
+			{Name: "id", Type: "number"},
+			{Name: "name", Type: "integer"},
+		}
+		ShapeDelta := GenerateShapeDelta(knownShapes, testShapeNarrower)
+
+		Reset(func() {
+			knownShapes = map[string]pipeline.ShapeDefinition{}
+		})
+
+		Convey("Should return a shape info", func() {
+			Convey("where HasChanges() returns false", func() {
+				So(ShapeDelta.HasChanges(), ShouldBeFalse)
+			})
+			Convey("with ChangedProperties set to empty map", func() {
+				So(ShapeDelta.ChangedProperties, ShouldBeEmpty)
+			})
+		})
+	})
+
+	Convey("Given a data point with a shape that has a property without a type", t, func() {
+		knownShapes[testShape.Name] = testShape
+		testShapeUntyped := testShape
+		testShapeUntyped.Properties = []pipeline.PropertyDefinition{
+			{Name: "age", Type: ""},
+			{Name: "id", Type: "number"},
+			{Name: "name", Type: "string"},
+		}
+		ShapeDelta := GenerateShapeDelta(knownShapes, testShapeUntyped)
+
+		Reset(func() {
+			knownShapes = map[string]pipeline.ShapeDefinition{}
+		})
+
+		Convey("Should return a shape info", func() {
+			Convey("where HasChanges() returns false", func() {
+				So(ShapeDelta.HasChanges(), ShouldBeFalse)
+			})
+			Convey("with ChangedProperties set to empty map", func() {
+				So(ShapeDelta.ChangedProperties, ShouldBeEmpty)
+			})
+		})
+	})
+
+}
+
+func Test_WidenType(t *testing.T) {
+
+	Convey("Should widen types", t, func() {
+		So(WidenType("integer", "integer"), ShouldEqual, "integer")
+		So(WidenType("integer", "float"), ShouldEqual, "float")
+		So(WidenType("float", "integer"), ShouldEqual, "float")
+		So(WidenType("float", "string"), ShouldEqual, "string")
+		So(WidenType("date", "string"), ShouldEqual, "string")
+		So(WidenType("date", "integer"), ShouldEqual, "string")
+		So(WidenType("bool", "date"), ShouldEqual, "string")
+	})
+
+	Convey("Should not widen types with a property without a type", t, func() {
+		So(WidenType("integer", ""), ShouldEqual, "integer")
+		So(WidenType("", "date"), ShouldEqual, "date")
+		So(WidenType("", ""), ShouldEqual, "")
+	})
+
 }
 
 func Test_KnownShape_MatchesShape(t *testing.T) {
@@ -340,6 +454,43 @@ func Test_KnownShape_MatchesShape(t *testing.T) {
 	})
 }
 
+func Test_KnownShape_DropProperties(t *testing.T) {
+	Convey("Given a known shape", t, func() {
+		sut := KnownShape{
+			cache:      map[string]interface{}{"x": "y"},
+			keyHashes:  knownHashes{123: true},
+			propHashes: knownHashes{456: true},
+			ShapeDefinition: pipeline.ShapeDefinition{
+				Name: "Test.Products",
+				Keys: []string{"ID"},
+				Properties: []pipeline.PropertyDefinition{
+					{Name: "ID", Type: "integer"},
+					{Name: "Name", Type: "string"},
+					{Name: "Price", Type: "float"},
+				},
+			},
+		}
+
+		Convey("When properties are dropped", func() {
+			sut.DropProperties([]string{"ID", "Price"})
+
+			Convey("Should have removed the properties which are not keys", func() {
+				So(sut.Properties, ShouldResemble, []pipeline.PropertyDefinition{
+					{Name: "ID", Type: "integer"},
+					{Name: "Name", Type: "string"},
+				})
+			})
+
+			Convey("Should have cleared the property hashes and the cache", func() {
+				So(sut.propHashes, ShouldBeEmpty)
+				So(sut.keyHashes, ShouldContainKey, uint32(123))
+				_, ok := sut.Get("x")
+				So(ok, ShouldBeFalse)
+			})
+		})
+	})
+}
+
 func Test_NewKnownShape(t *testing.T) {
 
 	Convey("Given a datapoint", t, func() {
@@ -392,7 +543,7 @@ func Test_KnownShape_Merge(t *testing.T) {
 
 	Convey("Given a known shape", t, func() {
 
-		self := KnownShape{
+		self := &KnownShape{
 			cache:      map[string]interface{}{},
 			keyHashes:  knownHashes{123: true},
 			propHashes: knownHashes{456: true},
@@ -425,7 +576,7 @@ func Test_KnownShape_Merge(t *testing.T) {
 			},
 		}
 
-		sut := self
+		sut := self.clone()
 
 		Convey("When another known shape is merged in", func() {
 
@@ -465,6 +616,27 @@ func Test_KnownShape_Merge(t *testing.T) {
 				So(sut.Properties, ShouldHaveLength, 6)
 			})
 		})
+
+		Convey("When a known shape with a different property type is merged in", func() {
+
+			sut.Merge(&KnownShape{
+				cache: map[string]interface{}{},
+				ShapeDefinition: pipeline.ShapeDefinition{
+					Name: "Test.Products",
+					Keys: []string{"ID"},
+					Properties: []pipeline.PropertyDefinition{
+						{Name: "ID", Type: "string"},
+						{Name: "Price", Type: "integer"},
+					},
+				},
+			})
+
+			Convey("Should have widened the property types", func() {
+				So(sut.Properties, ShouldContain, pipeline.PropertyDefinition{Name: "ID", Type: "string"})
+				So(sut.Properties, ShouldContain, pipeline.PropertyDefinition{Name: "Price", Type: "float"})
+				So(sut.Properties, ShouldHaveLength, 4)
+			})
+		})
 	})
 }
 
@@ -536,7 +708,8 @@ func Test_ShapeCache(t *testing.T) {
 					},
 				}
 
-				actual := sut.Remember(expected)
+				actual, err := sut.Remember(expected)
+				So(err, ShouldBeNil)
 				So(actual, ShouldResemble, expected)
 			})
 
@@ -582,3 +755,115 @@ func Test_ShapeCache(t *testing.T) {
 	})
 
 }
+
+func Test_ShapeCache_Concurrent(t *testing.T) {
+
+	Convey("Given a ShapeCache used from many goroutines", t, func() {
+		sut := NewShapeCache()
+
+		narrow := pipeline.DataPoint{
+			Source: "Test",
+			Entity: "Products",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"id"},
+				Properties: []string{"id:integer", "name:string"},
+			},
+			Data: map[string]interface{}{"id": 1, "name": "First"},
+		}
+		wide := narrow
+		wide.Shape = pipeline.Shape{
+			KeyNames:   []string{"id"},
+			Properties: []string{"id:integer", "name:string", "price:float"},
+		}
+		other := narrow
+		other.Entity = "Orders"
+
+		const goroutines = 50
+		const iterations = 200
+
+		var (
+			wg      sync.WaitGroup
+			mu      sync.Mutex
+			applied = map[string]int{}
+			errs    []error
+		)
+
+		apply := func(shape *KnownShape, delta ShapeDelta) error {
+			mu.Lock()
+			defer mu.Unlock()
+			if delta.HasChanges() {
+				applied[delta.Name]++
+			}
+			return nil
+		}
+
+		Convey("When the same shape is ensured concurrently", func() {
+			for i := 0; i < goroutines; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < iterations; j++ {
+						shape, err := sut.Ensure(narrow, apply)
+						if err != nil {
+							mu.Lock()
+							errs = append(errs, err)
+							mu.Unlock()
+							continue
+						}
+						shape.Set("x", j)
+						shape.Get("x")
+					}
+				}()
+			}
+			wg.Wait()
+
+			Convey("Then the change should only have been applied once", func() {
+				So(errs, ShouldBeEmpty)
+				So(applied, ShouldResemble, map[string]int{"Test.Products": 1})
+			})
+		})
+
+		Convey("When different shapes are ensured, remembered and read concurrently", func() {
+			dps := []pipeline.DataPoint{narrow, wide, other}
+
+			for i := 0; i < goroutines; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < iterations; j++ {
+						dp := dps[(i+j)%len(dps)]
+						_, err := sut.Ensure(dp, apply)
+						if err != nil {
+							mu.Lock()
+							errs = append(errs, err)
+							mu.Unlock()
+						}
+						sut.Recognize(dp)
+						sut.Knows(CanonicalName(dp))
+						sut.GetAllShapeDefinitions()
+						if j%50 == 0 {
+							sut.Remember(NewKnownShape(dp))
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			Convey("Then every shape should be recognized with all its properties", func() {
+				So(errs, ShouldBeEmpty)
+
+				products, ok := sut.Recognize(narrow)
+				So(ok, ShouldBeTrue)
+				So(products.Properties, ShouldHaveLength, 3)
+
+				_, ok = sut.Recognize(wide)
+				So(ok, ShouldBeTrue)
+				_, ok = sut.Recognize(other)
+				So(ok, ShouldBeTrue)
+
+				So(applied["Test.Products"], ShouldBeBetweenOrEqual, 1, 2)
+				So(applied["Test.Orders"], ShouldEqual, 1)
+			})
+		})
+	})
+}
@@ -0,0 +1,165 @@
+package shapeutils
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/naveego/api/types/pipeline"
+)
+
+// ShapeStore persists KnownShapes so that a ShapeCache can be restored
+// when a subscriber restarts, including the information which cannot be
+// derived from the storage system (original property types, known hashes).
+type ShapeStore interface {
+	// Load returns all the shapes in the store.
+	Load() ([]*KnownShape, error)
+	// Save writes the shape to the store, replacing any stored shape with the same name.
+	Save(shape *KnownShape) error
+}
+
+// knownShapeJSON is the serialized form of a KnownShape.
+type knownShapeJSON struct {
+	pipeline.ShapeDefinition
+	KeyHashes      []uint32 `json:"keyHashes"`
+	PropertyHashes []uint32 `json:"propertyHashes"`
+	Columns        []Column `json:"columns,omitempty"`
+}
+
+// MarshalJSON includes the known hashes, which are otherwise unexported.
+func (k *KnownShape) MarshalJSON() ([]byte, error) {
+	return json.Marshal(knownShapeJSON{
+		ShapeDefinition: k.ShapeDefinition,
+		KeyHashes:       k.keyHashes.slice(),
+		PropertyHashes:  k.propHashes.slice(),
+		Columns:         k.Columns,
+	})
+}
+
+// UnmarshalJSON restores a KnownShape written by MarshalJSON.
+func (k *KnownShape) UnmarshalJSON(data []byte) error {
+	var j knownShapeJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+
+	k.ShapeDefinition = j.ShapeDefinition
+	k.Columns = j.Columns
+	k.cache = map[string]interface{}{}
+	k.keyHashes = knownHashes{}
+	k.propHashes = knownHashes{}
+
+	for _, h := range j.KeyHashes {
+		k.keyHashes[h] = true
+	}
+	for _, h := range j.PropertyHashes {
+		k.propHashes[h] = true
+	}
+
+	return nil
+}
+
+func (k knownHashes) slice() []uint32 {
+	s := []uint32{}
+	for h, v := range k {
+		if v {
+			s = append(s, h)
+		}
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return s
+}
+
+type fileShapeStore struct {
+	path   string
+	shapes map[string]json.RawMessage
+}
+
+// NewFileShapeStore returns a ShapeStore which keeps all shapes in a
+// single JSON file at path. The file is created on the first Save.
+func NewFileShapeStore(path string) ShapeStore {
+	return &fileShapeStore{path: path}
+}
+
+func (f *fileShapeStore) Load() ([]*KnownShape, error) {
+
+	err := f.read()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range f.shapes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	shapes := []*KnownShape{}
+	for _, name := range names {
+		shape := &KnownShape{}
+		if err = json.Unmarshal(f.shapes[name], shape); err != nil {
+			return nil, err
+		}
+		shapes = append(shapes, shape)
+	}
+
+	return shapes, nil
+}
+
+func (f *fileShapeStore) Save(shape *KnownShape) error {
+
+	err := f.read()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(shape)
+	if err != nil {
+		return err
+	}
+	f.shapes[shape.Name] = data
+
+	data, err = json.MarshalIndent(f.shapes, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it so that a crash
+	// can never leave a partially written store behind.
+	tmp := f.path + ".tmp"
+	if err = ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, f.path)
+}
+
+// read loads the file the first time the store is used.
+func (f *fileShapeStore) read() error {
+	if f.shapes != nil {
+		return nil
+	}
+
+	shapes := map[string]json.RawMessage{}
+
+	data, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		if err = os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+			return err
+		}
+		f.shapes = shapes
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(data, &shapes); err != nil {
+		return err
+	}
+
+	f.shapes = shapes
+	return nil
+}
@@ -0,0 +1,115 @@
+package shapeutils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/naveego/api/types/pipeline"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_FileShapeStore(t *testing.T) {
+
+	Convey("Given a file shape store", t, func() {
+
+		dir, err := ioutil.TempDir("", "shapeutils")
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+
+		path := filepath.Join(dir, "shapes", "known.json")
+		sut := NewFileShapeStore(path)
+
+		shape := &KnownShape{
+			cache:      map[string]interface{}{},
+			keyHashes:  knownHashes{123: true},
+			propHashes: knownHashes{456: true, 789: true},
+			ShapeDefinition: pipeline.ShapeDefinition{
+				Name: "Test.Products",
+				Keys: []string{"id"},
+				Properties: []pipeline.PropertyDefinition{
+					{Name: "id", Type: "integer"},
+					{Name: "name", Type: "string"},
+				},
+			},
+		}
+
+		Convey("When the file does not exist", func() {
+			actual, err := sut.Load()
+
+			Convey("Then there should be no shapes", func() {
+				So(err, ShouldBeNil)
+				So(actual, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a shape is saved", func() {
+			So(sut.Save(shape), ShouldBeNil)
+
+			Convey("Then a new store should load it with its hashes", func() {
+				actual, err := NewFileShapeStore(path).Load()
+				So(err, ShouldBeNil)
+				So(actual, ShouldResemble, []*KnownShape{shape})
+			})
+
+			Convey("Then saving it again should replace it", func() {
+				shape.Properties = append(shape.Properties, pipeline.PropertyDefinition{Name: "price", Type: "float"})
+				So(sut.Save(shape), ShouldBeNil)
+
+				actual, err := NewFileShapeStore(path).Load()
+				So(err, ShouldBeNil)
+				So(actual, ShouldHaveLength, 1)
+				So(actual[0].Properties, ShouldHaveLength, 3)
+			})
+		})
+	})
+}
+
+func Test_ShapeCacheWithStore(t *testing.T) {
+
+	Convey("Given a ShapeCache with a store", t, func() {
+
+		dir, err := ioutil.TempDir("", "shapeutils")
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			os.RemoveAll(dir)
+		})
+
+		path := filepath.Join(dir, "known.json")
+
+		sut, err := NewShapeCacheWithStore(NewFileShapeStore(path))
+		So(err, ShouldBeNil)
+
+		dp := pipeline.DataPoint{
+			Source: "Test",
+			Entity: "Products",
+			Shape: pipeline.Shape{
+				KeyNames:     []string{"id"},
+				KeyNamesHash: 123,
+				PropertyHash: 456,
+				Properties:   []string{"id:integer", "name:string"},
+			},
+		}
+
+		Convey("When a shape is remembered", func() {
+			shape, _ := sut.Analyze(dp)
+			_, err := sut.Remember(shape)
+			So(err, ShouldBeNil)
+
+			Convey("Then a cache seeded from the same store should recognize the datapoint", func() {
+				restarted, err := NewShapeCacheWithStore(NewFileShapeStore(path))
+				So(err, ShouldBeNil)
+
+				actual, ok := restarted.Recognize(dp)
+				So(ok, ShouldBeTrue)
+				So(actual.ShapeDefinition, ShouldResemble, shape.ShapeDefinition)
+			})
+		})
+	})
+}
@@ -0,0 +1,292 @@
+package shapeutils
+
+import (
+	"encoding/json"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/api/utils"
+)
+
+// TypeProposal is the type a TypeInferrer proposes for a property,
+// based on the values it has sampled.
+type TypeProposal struct {
+	// Type is the narrowest type which can hold all the sampled values.
+	Type string
+	// Samples is the number of non-null values sampled.
+	Samples int
+	// Committed is true once enough values have been sampled to use Type.
+	Committed bool
+}
+
+type shapeSample struct {
+	dataPoints int
+	properties map[string]*TypeProposal
+}
+
+// TypeInferrer samples the values in data points to propose tighter types for
+// properties which the publisher sent without a type or typed as string.
+// A proposed type is only committed once minSamples non-null values agree on it.
+// A committed type can still be widened (see WidenType) by later values,
+// which a subscriber will see as a changed property in the ShapeDelta.
+// A TypeInferrer is safe for concurrent use.
+type TypeInferrer struct {
+	minSamples int
+	maxSamples int
+
+	mu     sync.Mutex
+	shapes map[string]*shapeSample
+}
+
+// NewTypeInferrer creates a TypeInferrer which commits a type after minSamples
+// non-null values. Once maxSamples data points of a shape have been observed,
+// the shape is considered ready even if some properties (which are mostly null)
+// have no committed type; those keep the type declared by the publisher.
+func NewTypeInferrer(minSamples, maxSamples int) *TypeInferrer {
+	if minSamples < 1 {
+		minSamples = 1
+	}
+	if maxSamples < minSamples {
+		maxSamples = minSamples
+	}
+
+	return &TypeInferrer{
+		minSamples: minSamples,
+		maxSamples: maxSamples,
+		shapes:     map[string]*shapeSample{},
+	}
+}
+
+// Observe samples the values of the untyped and string properties of datapoint.
+func (t *TypeInferrer) Observe(datapoint pipeline.DataPoint) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	name := CanonicalName(datapoint)
+	shape, ok := t.shapes[name]
+	if !ok {
+		shape = &shapeSample{properties: map[string]*TypeProposal{}}
+		t.shapes[name] = shape
+	}
+	shape.dataPoints++
+
+	for _, p := range inferableProperties(datapoint) {
+		valueType := InferValueType(datapoint.Data[p])
+		if valueType == "" {
+			continue
+		}
+
+		proposal, ok := shape.properties[p]
+		if !ok {
+			proposal = &TypeProposal{Type: valueType}
+			shape.properties[p] = proposal
+		}
+
+		proposal.Type = WidenType(proposal.Type, valueType)
+		proposal.Samples++
+
+		if proposal.Samples >= t.minSamples {
+			proposal.Committed = true
+		}
+	}
+}
+
+// Proposal returns the type proposed for a property of the datapoint's shape,
+// or false if no values of the property have been sampled.
+func (t *TypeInferrer) Proposal(datapoint pipeline.DataPoint, property string) (TypeProposal, bool) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	shape, ok := t.shapes[CanonicalName(datapoint)]
+	if !ok {
+		return TypeProposal{}, false
+	}
+
+	proposal, ok := shape.properties[property]
+	if !ok {
+		return TypeProposal{}, false
+	}
+
+	return *proposal, true
+}
+
+// Ready returns true if the types of all the inferable properties of datapoint
+// are committed, or if enough data points of its shape have been observed
+// to give up on the ones which aren't.
+func (t *TypeInferrer) Ready(datapoint pipeline.DataPoint) bool {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	shape, ok := t.shapes[CanonicalName(datapoint)]
+	if !ok {
+		return len(inferableProperties(datapoint)) == 0
+	}
+
+	if shape.dataPoints >= t.maxSamples {
+		return true
+	}
+
+	for _, p := range inferableProperties(datapoint) {
+		proposal, ok := shape.properties[p]
+		if !ok || !proposal.Committed {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Apply returns a copy of datapoint whose shape uses the committed types
+// in place of the declared types. The shape hashes are recalculated.
+func (t *TypeInferrer) Apply(datapoint pipeline.DataPoint) pipeline.DataPoint {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	shape, ok := t.shapes[CanonicalName(datapoint)]
+	if !ok {
+		return datapoint
+	}
+
+	return applyTypes(datapoint, func(name string) (string, bool) {
+		proposal, ok := shape.properties[name]
+		if !ok || !proposal.Committed {
+			return "", false
+		}
+		return proposal.Type, true
+	})
+}
+
+// ApplyTypes returns a copy of datapoint whose untyped and string properties
+// have the types of the properties of its known shape, like TypeInferrer.Apply
+// does with the committed types. Data points of unknown shapes are returned as
+// they are.
+func (s *ShapeCache) ApplyTypes(datapoint pipeline.DataPoint) pipeline.DataPoint {
+
+	s.mu.RLock()
+	shape, ok := s.shapes[CanonicalName(datapoint)]
+	s.mu.RUnlock()
+
+	if !ok {
+		return datapoint
+	}
+
+	return applyTypes(datapoint, func(name string) (string, bool) {
+		p, ok := findProp(name, shape.Properties)
+		return p.Type, ok && p.Type != ""
+	})
+}
+
+// applyTypes replaces the declared types of the inferable properties of
+// datapoint with the types typeOf returns, and recalculates the shape hashes.
+func applyTypes(datapoint pipeline.DataPoint, typeOf func(name string) (string, bool)) pipeline.DataPoint {
+
+	changed := false
+	properties := make([]string, len(datapoint.Shape.Properties))
+
+	for i, v := range datapoint.Shape.Properties {
+		properties[i] = v
+
+		name, declared := utils.StringSplit2(v, ":")
+		if !isInferableType(declared) {
+			continue
+		}
+
+		t, ok := typeOf(name)
+		if ok && t != declared {
+			properties[i] = name + ":" + t
+			changed = true
+		}
+	}
+
+	if !changed {
+		return datapoint
+	}
+
+	datapoint.Shape.Properties = properties
+	datapoint.Shape.PropertyHash = 0
+	pipeline.EnsureHashes(&datapoint.Shape)
+
+	return datapoint
+}
+
+// InferValueType returns the property type which best describes value:
+// "integer", "float", "bool", "date" (for RFC3339 strings), "object"
+// (for maps, slices and JSON object or array strings) or "string".
+// It returns an empty string for nil.
+func InferValueType(value interface{}) string {
+
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		return "bool"
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return "integer"
+	case float32:
+		return inferFloatType(float64(v))
+	case float64:
+		return inferFloatType(v)
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "float"
+	case time.Time:
+		return "date"
+	case map[string]interface{}, []interface{}:
+		return "object"
+	case string:
+		return inferStringType(v)
+	}
+
+	return "string"
+}
+
+// inferFloatType treats whole numbers as integers, because
+// JSON decoding turns every number into a float64.
+func inferFloatType(f float64) string {
+	if f == math.Trunc(f) && f >= math.MinInt64 && f <= math.MaxInt64 {
+		return "integer"
+	}
+	return "float"
+}
+
+func inferStringType(s string) string {
+	if _, err := time.Parse(time.RFC3339, s); err == nil {
+		return "date"
+	}
+
+	trimmed := strings.TrimSpace(s)
+	if strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[") {
+		var v interface{}
+		if json.Unmarshal([]byte(trimmed), &v) == nil {
+			return "object"
+		}
+	}
+
+	return "string"
+}
+
+// isInferableType returns true for the declared types
+// which a TypeInferrer may replace.
+func isInferableType(t string) bool {
+	return t == "" || t == "string"
+}
+
+func inferableProperties(datapoint pipeline.DataPoint) []string {
+	names := []string{}
+	for _, v := range datapoint.Shape.Properties {
+		name, declared := utils.StringSplit2(v, ":")
+		if isInferableType(declared) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,144 @@
+package shapeutils
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/naveego/api/types/pipeline"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func Test_InferValueType(t *testing.T) {
+
+	Convey("Should infer types from values", t, func() {
+		So(InferValueType(nil), ShouldEqual, "")
+		So(InferValueType(true), ShouldEqual, "bool")
+		So(InferValueType(42), ShouldEqual, "integer")
+		So(InferValueType(42.0), ShouldEqual, "integer")
+		So(InferValueType(42.5), ShouldEqual, "float")
+		So(InferValueType(json.Number("42")), ShouldEqual, "integer")
+		So(InferValueType(json.Number("42.5")), ShouldEqual, "float")
+		So(InferValueType("2017-10-11T12:00:00Z"), ShouldEqual, "date")
+		So(InferValueType(`{"city": "Dallas"}`), ShouldEqual, "object")
+		So(InferValueType(map[string]interface{}{"city": "Dallas"}), ShouldEqual, "object")
+		So(InferValueType([]interface{}{1, 2}), ShouldEqual, "object")
+		So(InferValueType("{not json"), ShouldEqual, "string")
+		So(InferValueType("Dallas"), ShouldEqual, "string")
+	})
+}
+
+func Test_TypeInferrer(t *testing.T) {
+
+	Convey("Given a type inferrer", t, func() {
+
+		sut := NewTypeInferrer(3, 5)
+
+		dp := func(data map[string]interface{}) pipeline.DataPoint {
+			return pipeline.DataPoint{
+				Source: "Test",
+				Entity: "Products",
+				Shape: pipeline.Shape{
+					KeyNames:   []string{"id"},
+					Properties: []string{"id:integer", "name:string", "price", "sold:string"},
+				},
+				Data: data,
+			}
+		}
+
+		Convey("When fewer values than required have been observed", func() {
+			sut.Observe(dp(map[string]interface{}{"id": 1, "name": "a", "price": 1.5, "sold": "2017-10-11T12:00:00Z"}))
+			sut.Observe(dp(map[string]interface{}{"id": 2, "name": "b", "price": 2, "sold": "2017-10-12T12:00:00Z"}))
+
+			Convey("Then the types should be proposed but not committed", func() {
+				proposal, ok := sut.Proposal(dp(nil), "price")
+				So(ok, ShouldBeTrue)
+				So(proposal, ShouldResemble, TypeProposal{Type: "float", Samples: 2})
+				So(sut.Ready(dp(nil)), ShouldBeFalse)
+			})
+
+			Convey("Then declared types should not be replaced", func() {
+				actual := sut.Apply(dp(nil))
+				So(actual.Shape.Properties, ShouldResemble, dp(nil).Shape.Properties)
+			})
+		})
+
+		Convey("When enough values have been observed", func() {
+			sut.Observe(dp(map[string]interface{}{"id": 1, "name": "a", "price": 1.5, "sold": "2017-10-11T12:00:00Z"}))
+			sut.Observe(dp(map[string]interface{}{"id": 2, "name": "b", "price": 2, "sold": nil}))
+			sut.Observe(dp(map[string]interface{}{"id": 3, "name": "c", "price": 3, "sold": "2017-10-12T12:00:00Z"}))
+			sut.Observe(dp(map[string]interface{}{"id": 4, "name": "d", "price": 4, "sold": "2017-10-13T12:00:00Z"}))
+
+			Convey("Then the shape should be ready", func() {
+				So(sut.Ready(dp(nil)), ShouldBeTrue)
+			})
+
+			Convey("Then the committed types should be applied", func() {
+				original := dp(nil)
+				pipeline.EnsureHashes(&original.Shape)
+
+				actual := sut.Apply(original)
+				So(actual.Shape.Properties, ShouldResemble, []string{"id:integer", "name:string", "price:float", "sold:date"})
+				So(actual.Shape.PropertyHash, ShouldNotEqual, original.Shape.PropertyHash)
+			})
+
+			Convey("Then a value which doesn't fit should widen the committed type", func() {
+				sut.Observe(dp(map[string]interface{}{"id": 5, "name": "e", "price": 5, "sold": "yesterday"}))
+
+				proposal, _ := sut.Proposal(dp(nil), "sold")
+				So(proposal.Type, ShouldEqual, "string")
+				So(proposal.Committed, ShouldBeTrue)
+			})
+		})
+
+		Convey("When a property is mostly null", func() {
+			for i := 0; i < 5; i++ {
+				sut.Observe(dp(map[string]interface{}{"id": i, "name": "a", "price": 1.5}))
+			}
+
+			Convey("Then the shape should be ready after the maximum number of samples", func() {
+				So(sut.Ready(dp(nil)), ShouldBeTrue)
+				actual := sut.Apply(dp(nil))
+				So(actual.Shape.Properties, ShouldResemble, []string{"id:integer", "name:string", "price:float", "sold:string"})
+			})
+		})
+	})
+}
+
+func Test_ApplyTypes(t *testing.T) {
+
+	Convey("Given a ShapeCache which knows a shape", t, func() {
+
+		sut := NewShapeCache()
+
+		dp := pipeline.DataPoint{
+			Source: "Test",
+			Entity: "Products",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"id"},
+				Properties: []string{"id:integer", "name:string", "price:float"},
+			},
+		}
+		shape, _ := sut.Analyze(dp)
+		sut.Remember(shape)
+
+		Convey("When the types of a data point with untyped and string properties are applied", func() {
+			dp.Shape.Properties = []string{"id:integer", "name:string", "price:string", "sold"}
+			actual := sut.ApplyTypes(dp)
+
+			Convey("Then they should have the known types", func() {
+				So(actual.Shape.Properties, ShouldResemble, []string{"id:integer", "name:string", "price:float", "sold"})
+			})
+		})
+
+		Convey("When the types of a data point of another shape are applied", func() {
+			dp.Entity = "Orders"
+			dp.Shape.Properties = []string{"id:integer", "price:string"}
+			actual := sut.ApplyTypes(dp)
+
+			Convey("Then it should be returned as it is", func() {
+				So(actual, ShouldResemble, dp)
+			})
+		})
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// The columns a table has when Audit is set, which record when, from where
+// and in which run a row was written. _loaded_at is only written when the
+// row is inserted, the others every time it is written. In history mode the
+// table already has a _row_hash column, which is used for both.
+const (
+	auditLoadedAt  = "_loaded_at"
+	auditUpdatedAt = "_updated_at"
+	auditSource    = "_source"
+	auditEntity    = "_entity"
+	auditRunID     = "_run_id"
+	auditRowHash   = historyRowHash
+	auditDeleted   = shapeutils.DeletedProperty
+)
+
+var auditColumnTypes = []struct{ Name, SQLType string }{
+	{auditLoadedAt, "DATETIME(6)"},
+	{auditUpdatedAt, "DATETIME(6)"},
+	{auditSource, "VARCHAR(255)"},
+	{auditEntity, "VARCHAR(255)"},
+	{auditRunID, "VARCHAR(64)"},
+	{auditDeleted, "BIT"},
+	{auditRowHash, "CHAR(40)"},
+}
+
+// auditColumns returns the columns the subscriber writes with every row of a
+// table created with options. Without Audit, that is only the _row_hash column
+// SkipUnchanged compares, the _deleted column of soft deletes and the _run_id
+// column of snapshots.
+func auditColumns(options tableOptions) sqlColumns {
+
+	var columns sqlColumns
+
+	for _, c := range auditColumnTypes {
+		if hasAuditColumn(c.Name, options) {
+			columns = append(columns, sqlColumnModel{Name: c.Name, SqlType: c.SQLType, Audit: true})
+		}
+	}
+
+	return columns
+}
+
+func hasAuditColumn(name string, options tableOptions) bool {
+	switch name {
+	case auditRowHash:
+		// History tables already have the _row_hash of the versions.
+		return !options.History && (options.Audit || options.SkipUnchanged)
+	case auditDeleted:
+		// History tables close the current version of a deleted row instead.
+		return !options.History && options.Deletes == shapeutils.DeletesSoft
+	case auditRunID:
+		return options.Audit || options.Snapshot
+	}
+	return options.Audit
+}
+
+// auditValue returns the value of an audit column for a data point.
+func auditValue(c sqlColumnModel, dp pipeline.DataPoint, model sqlTableModel) interface{} {
+	switch c.Name {
+	case auditLoadedAt, auditUpdatedAt:
+		return model.Now
+	case auditSource:
+		return dp.Source
+	case auditEntity:
+		return dp.Entity
+	case auditRunID:
+		return model.RunID
+	case auditRowHash:
+		return rowHash(dp, model)
+	case auditDeleted:
+		// Writing a row undoes its soft delete.
+		return false
+	}
+	return nil
+}
+
+// createAuditColumnsSQL renders the statement which adds
+// the audit columns to the existing table of a shape.
+func createAuditColumnsSQL(shapeName string, options tableOptions) (string, error) {
+
+	model := sqlTableModel{
+		Name:    options.table(shapeName),
+		Columns: auditColumns(options),
+	}
+
+	w := &bytes.Buffer{}
+	err := alterTemplate.Execute(w, model)
+
+	return w.String(), err
+}
+
+// addAuditColumns adds the audit columns to the tables discovered in the
+// database which were created before the settings which need them were set.
+func (h *mariaSubscriber) addAuditColumns() error {
+
+	for _, name := range h.unaudited {
+		sqlCommand, err := createAuditColumnsSQL(name, h.tableOptions())
+		if err != nil {
+			return err
+		}
+
+		err = h.execDDL(name, sqlCommand)
+		if err != nil {
+			return fmt.Errorf("couldn't add audit columns to %s: %s", name, err)
+		}
+
+		logrus.Infof("Added audit columns to %s", name)
+	}
+	h.unaudited = nil
+
+	return nil
+}
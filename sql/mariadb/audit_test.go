@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestAuditColumns(t *testing.T) {
+
+	Convey("Given a data point and audit columns", t, func() {
+
+		dp := pipeline.DataPoint{
+			Entity: "Products",
+			Source: "Test",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"ID"},
+				Properties: []string{"ID:integer", "Name:string"},
+			},
+			Data: map[string]interface{}{
+				"ID":   1,
+				"Name": "First",
+			},
+		}
+		shape := shapeutils.NewKnownShape(dp)
+		options := tableOptions{Audit: true, RunID: "run-1"}
+
+		Convey("When we generate the SQL for a new shape", func() {
+			delta := shapeutils.ShapeDelta{
+				IsNew:         true,
+				Name:          "Test.Products",
+				NewKeys:       []string{"ID"},
+				NewProperties: map[string]string{"ID": "integer", "Name": "string"},
+			}
+			actual, err := createShapeChangeSQL(delta, nil, options)
+
+			Convey("Then the table should have the audit columns after the properties", nil)
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`CREATE TABLE IF NOT EXISTS "Test.Products" (
+	"ID" INT(10) NOT NULL,
+	"Name" VARCHAR(1000) NULL,
+	"_loaded_at" DATETIME(6) NULL,
+	"_updated_at" DATETIME(6) NULL,
+	"_source" VARCHAR(255) NULL,
+	"_entity" VARCHAR(255) NULL,
+	"_run_id" VARCHAR(64) NULL,
+	"_row_hash" CHAR(40) NULL,
+	PRIMARY KEY ("ID")
+)`))
+		})
+
+		Convey("When we generate upsert SQL", func() {
+			actual, params, err := createUpsertSQL(dp, shape, options)
+			model := newUpsertModel(shape, 1, nil, options)
+
+			Convey("Then the audit columns should be written, but _loaded_at only on insert", nil)
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`INSERT INTO "Test.Products" ("ID", "Name", "_loaded_at", "_updated_at", "_source", "_entity", "_run_id", "_row_hash")
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE
+		"Name" = VALUES("Name")
+		,"_updated_at" = VALUES("_updated_at")
+		,"_source" = VALUES("_source")
+		,"_entity" = VALUES("_entity")
+		,"_run_id" = VALUES("_run_id")
+		,"_row_hash" = VALUES("_row_hash");`))
+			So(params[:2], ShouldResemble, []interface{}{1, "First"})
+			So(params[2], ShouldHaveSameTypeAs, time.Time{})
+			So(params[4:], ShouldResemble, []interface{}{"Test", "Products", "run-1", rowHash(dp, model)})
+		})
+
+		Convey("Then the row hash should only depend on the properties", func() {
+			So(rowHash(dp, newUpsertModel(shape, 1, nil, options)), ShouldEqual, rowHash(dp, newUpsertModel(shape, 1, nil, tableOptions{})))
+		})
+
+		Convey("When we generate history SQL", func() {
+			options.History = true
+			now := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+			_, _, insertSQL, insertParams, err := createHistorySQL(dp, shape, now, options)
+
+			Convey("Then the row hash of the version should be written once", nil)
+			So(err, ShouldBeNil)
+			So(insertSQL, ShouldStartWith, e(`INSERT INTO "Test.Products" ("ID", "Name", "_loaded_at", "_updated_at", "_source", "_entity", "_run_id", "_valid_from", "_valid_to", "_is_current", "_row_hash")`))
+			So(insertParams[2:5], ShouldResemble, []interface{}{now, now, "Test"})
+		})
+
+		Convey("When we generate the SQL adding the columns to an existing table", func() {
+			actual, err := createAuditColumnsSQL("Test.Products", options)
+
+			Convey("Then only missing columns should be added", nil)
+			So(err, ShouldBeNil)
+			So(actual, ShouldStartWith, e(`ALTER TABLE "Test.Products"
+	ADD COLUMN IF NOT EXISTS "_loaded_at" DATETIME(6) NULL
+	,ADD COLUMN IF NOT EXISTS "_updated_at" DATETIME(6) NULL`))
+		})
+
+		Convey("Then the audit columns should be hidden from discovery", func() {
+			So(isHiddenColumn("_loaded_at"), ShouldBeTrue)
+			So(isHiddenColumn("_run_id"), ShouldBeTrue)
+			So(isHiddenColumn("Name"), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// maxPlaceholders is the maximum number of parameters
+// MariaDB accepts in a single statement.
+const maxPlaceholders = 65535
+
+// batch holds the data points of a shape which have not been written yet.
+type batch struct {
+	shape      *shapeutils.KnownShape
+	dataPoints []pipeline.DataPoint
+}
+
+// startBatching buffers upserts until BatchSize rows of a shape have been
+// received, and starts flushing the buffers every BatchFlushSeconds.
+func (h *mariaSubscriber) startBatching() {
+
+	h.batches = map[string]*batch{}
+	h.staging = map[string]bool{}
+	h.stopFlushing = make(chan struct{})
+	h.flushingDone = make(chan struct{})
+
+	interval := time.Duration(h.settings.BatchFlushSeconds) * time.Second
+
+	go func() {
+		defer close(h.flushingDone)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := h.flushBatches()
+				if err != nil {
+					logrus.Error("Error flushing batches: ", err)
+					h.batchMu.Lock()
+					h.batchErr = err
+					h.batchMu.Unlock()
+				}
+			case <-h.stopFlushing:
+				return
+			}
+		}
+	}()
+}
+
+// stopBatching stops the periodic flush and writes all the buffered rows.
+func (h *mariaSubscriber) stopBatching() error {
+
+	if h.batches == nil {
+		return nil
+	}
+
+	close(h.stopFlushing)
+	<-h.flushingDone
+
+	err := h.flushBatches()
+
+	h.batchMu.Lock()
+	if err == nil {
+		err = h.batchErr
+	}
+	h.batches = nil
+	h.batchErr = nil
+	h.batchMu.Unlock()
+
+	return err
+}
+
+// addToBatch buffers the data point, and writes the buffer
+// of its shape once it has reached the batch size.
+func (h *mariaSubscriber) addToBatch(knownShape *shapeutils.KnownShape, dataPoint pipeline.DataPoint) error {
+
+	h.batchMu.Lock()
+	defer h.batchMu.Unlock()
+
+	// Report an error from a periodic flush to the sender.
+	if h.batchErr != nil {
+		err := h.batchErr
+		h.batchErr = nil
+		return fmt.Errorf("couldn't write batch: %s", err)
+	}
+
+	b, ok := h.batches[knownShape.Name]
+	if !ok {
+		b = &batch{}
+		h.batches[knownShape.Name] = b
+	}
+
+	// The latest shape has all the columns of the rows already in the batch.
+	b.shape = knownShape
+	b.dataPoints = append(b.dataPoints, dataPoint)
+
+	if len(b.dataPoints) >= h.settings.BatchSize {
+		return h.flushBatchLocked(knownShape.Name)
+	}
+
+	return nil
+}
+
+// flushBatch writes the buffered rows of a shape.
+func (h *mariaSubscriber) flushBatch(name string) error {
+
+	h.batchMu.Lock()
+	defer h.batchMu.Unlock()
+
+	return h.flushBatchLocked(name)
+}
+
+// flushBatches writes the buffered rows of all shapes.
+func (h *mariaSubscriber) flushBatches() error {
+
+	h.batchMu.Lock()
+	defer h.batchMu.Unlock()
+
+	for name := range h.batches {
+		err := h.flushBatchLocked(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *mariaSubscriber) flushBatchLocked(name string) error {
+
+	b, ok := h.batches[name]
+	if !ok {
+		return nil
+	}
+	delete(h.batches, name)
+
+	return h.upsertRows(b.shape, b.dataPoints)
+}
+
+// upsertRows writes the data points using as few statements as possible.
+func (h *mariaSubscriber) upsertRows(knownShape *shapeutils.KnownShape, dataPoints []pipeline.DataPoint) error {
+
+	err := h.widenColumns(knownShape, dataPoints)
+	if err != nil {
+		return err
+	}
+
+	// The versions of rows have to be written one at a time.
+	if h.settings.History {
+		return h.upsertEach(knownShape, dataPoints)
+	}
+
+	// Find the rows which collide with other rows in a unique index by writing them one at a time.
+	err = h.checkUniqueIndexes(knownShape, dataPoints)
+	if err != nil {
+		if len(dataPoints) > 1 && !classifyError(err).transient() {
+			return h.upsertEach(knownShape, dataPoints)
+		}
+		return err
+	}
+
+	if h.settings.BulkLoad {
+		err = h.retryWidened(knownShape, func() error {
+			return h.bulkLoadRows(knownShape, dataPoints)
+		})
+		if err != nil && len(dataPoints) > 1 && !classifyError(err).transient() {
+			// Find the rows which caused the failure by writing them one at a time.
+			err = h.upsertEach(knownShape, dataPoints)
+		}
+		return err
+	}
+
+	// Every column of a row has a placeholder, including the audit columns.
+	rowsPerStatement := len(dataPoints)
+	if columns := len(newUpsertModel(knownShape, 0, nil, h.tableOptions()).Columns); columns > 0 && rowsPerStatement*columns > maxPlaceholders {
+		rowsPerStatement = maxPlaceholders / columns
+	}
+
+	for start := 0; start < len(dataPoints); start += rowsPerStatement {
+		end := start + rowsPerStatement
+		if end > len(dataPoints) {
+			end = len(dataPoints)
+		}
+
+		upsertCommand, upsertParameters, err := createBatchUpsertSQL(dataPoints[start:end], knownShape, h.tableOptions())
+		if err != nil {
+			return err
+		}
+
+		existing, err := h.countExisting(knownShape, dataPoints[start:end])
+		if err != nil {
+			return err
+		}
+
+		rows := end - start
+		err = h.retryWidened(knownShape, func() error {
+			return h.execCounted(rows, func(affected int64) writeCounts {
+				return countUpserts(rows, existing, affected)
+			}, upsertCommand, upsertParameters...)
+		})
+		if err == nil {
+			continue
+		}
+
+		// Find the rows which caused the failure by writing them one at a time.
+		if end-start > 1 && !classifyError(err).transient() {
+			err = h.upsertEach(knownShape, dataPoints[start:end])
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// upsertEach writes the data points one at a time, applying
+// the OnError policy to each data point which can't be written.
+func (h *mariaSubscriber) upsertEach(knownShape *shapeutils.KnownShape, dataPoints []pipeline.DataPoint) error {
+
+	for _, dp := range dataPoints {
+
+		err := h.retryWidened(knownShape, func() error {
+			return h.writeRow(knownShape, dp)
+		})
+		if err != nil && h.reject(dp, err) != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// stagingTablePrefix starts the names of the tables bulk loads write to
+// before the rows are merged. They are excluded from the shapes discovered
+// in the database.
+const stagingTablePrefix = "_naveego_stage_"
+
+// readerCount makes the names of the reader handlers unique.
+var readerCount uint64
+
+// stagingTableName returns the name of the staging table of a table, which is in
+// the same database. It is shortened like the table names, so that it isn't too long.
+func stagingTableName(table string, naming tableNamer) string {
+	database, name := splitTableName(table)
+	name = naming.prefixed(stagingTablePrefix, name)
+	if database == "" {
+		return name
+	}
+	return qualifyTableName(database, name)
+}
+
+// bulkLoadRows writes the data points with LOAD DATA LOCAL INFILE into the staging
+// table of the shape, then merges them into the shape's table like an upsert.
+// The rows are encoded as they are read by the driver. It is called with batchMu
+// held, so the statements of two bulk loads are never interleaved.
+func (h *mariaSubscriber) bulkLoadRows(knownShape *shapeutils.KnownShape, dataPoints []pipeline.DataPoint) error {
+
+	reader := fmt.Sprintf("naveego_%d", atomic.AddUint64(&readerCount, 1))
+
+	createStaging, load, count, merge, err := createBulkLoadSQL(knownShape, reader, h.types, h.tableOptions())
+	if err != nil {
+		return err
+	}
+
+	options := h.tableOptions()
+	staging := stagingTableName(options.table(knownShape.Name), options.Naming)
+
+	// The staging table is created on the first load of the shape, and again
+	// after the shape has changed, so that it always has the columns of the table.
+	if !h.staging[knownShape.Name] {
+		err = h.execDDL(knownShape.Name, fmt.Sprintf(dropTableSQL, staging))
+		if err == nil {
+			err = h.execDDL(knownShape.Name, createStaging)
+		}
+		if err != nil {
+			return fmt.Errorf("couldn't create staging table: %s", err)
+		}
+		h.staging[knownShape.Name] = true
+	}
+
+	model := newUpsertModel(knownShape, 0, h.types, h.tableOptions())
+
+	// The driver calls the handler for every attempt, so a retried
+	// statement reads all the rows again.
+	mysql.RegisterReaderHandler(reader, func() io.Reader {
+		return &rowReader{dataPoints: dataPoints, model: model}
+	})
+	defer h.releaseReader(reader)
+
+	// Rows of a failed load may still be in the staging table.
+	err = h.exec(0, fmt.Sprintf("DELETE FROM `%s`;", staging))
+	if err == nil {
+		err = h.exec(0, load)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Rows with the same keys replace each other in the staging table,
+	// so only the last of them is merged.
+	staged, existing := len(dataPoints), 0
+	if count != "" {
+		err = h.queryRow(count, nil, &staged, &existing)
+		if err != nil {
+			return err
+		}
+	}
+
+	return h.execCounted(len(dataPoints), func(affected int64) writeCounts {
+		counts := countUpserts(staged, existing, affected)
+		counts.Updated += len(dataPoints) - staged
+		return counts
+	}, merge)
+}
+
+// dropStagingTable drops the staging table of a shape, so that it is recreated
+// with the new columns the next time rows of the shape are loaded.
+func (h *mariaSubscriber) dropStagingTable(name string) error {
+
+	h.batchMu.Lock()
+	defer h.batchMu.Unlock()
+
+	if !h.staging[name] {
+		return nil
+	}
+	delete(h.staging, name)
+
+	options := h.tableOptions()
+
+	return h.execDDL(name, fmt.Sprintf(dropTableSQL, stagingTableName(options.table(name), options.Naming)))
+}
+
+// dropStagingTables drops the staging tables of all shapes. The names are copied
+// under batchMu, because a periodic flush may still create staging tables.
+func (h *mariaSubscriber) dropStagingTables() error {
+
+	h.batchMu.Lock()
+	names := make([]string, 0, len(h.staging))
+	for name := range h.staging {
+		names = append(names, name)
+	}
+	h.batchMu.Unlock()
+
+	for _, name := range names {
+		err := h.dropStagingTable(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rowReader encodes data points in the format of LOAD DATA
+// (tab separated fields, one line per row) as it is read.
+type rowReader struct {
+	dataPoints []pipeline.DataPoint
+	model      sqlTableModel
+	next       int
+	buf        bytes.Buffer
+}
+
+func (r *rowReader) Read(p []byte) (int, error) {
+
+	for r.buf.Len() == 0 {
+		if r.next >= len(r.dataPoints) {
+			return 0, io.EOF
+		}
+
+		for i, v := range upsertParameters(r.dataPoints[r.next], r.model) {
+			if i > 0 {
+				r.buf.WriteByte('\t')
+			}
+			r.buf.WriteString(loadDataValue(v))
+		}
+		r.buf.WriteByte('\n')
+
+		r.next++
+	}
+
+	return r.buf.Read(p)
+}
+
+var loadDataEscaper = strings.NewReplacer(
+	"\\", "\\\\",
+	"\t", "\\t",
+	"\n", "\\n",
+	"\r", "\\r",
+	"\x00", "\\0",
+)
+
+// loadDataValue encodes a value as a field of LOAD DATA.
+func loadDataValue(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return `\N`
+	case bool:
+		if t {
+			return "1"
+		}
+		return "0"
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(t), 'f', -1, 32)
+	case time.Time:
+		return t.Format("2006-01-02 15:04:05.999999")
+	case string:
+		return loadDataEscaper.Replace(t)
+	case []byte:
+		return loadDataEscaper.Replace(string(t))
+	}
+
+	return loadDataEscaper.Replace(fmt.Sprint(v))
+}
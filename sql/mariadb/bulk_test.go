@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/subscribers/protocol"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRowReader(t *testing.T) {
+
+	Convey("Given data points of a known shape", t, func() {
+
+		dp := func(id float64, name interface{}, inStock bool) pipeline.DataPoint {
+			return pipeline.DataPoint{
+				Entity: "Products",
+				Source: "Test",
+				Shape: pipeline.Shape{
+					KeyNames:   []string{"ID"},
+					Properties: []string{"ID:integer", "InStock:bool", "Name:string"},
+				},
+				Data: map[string]interface{}{
+					"ID":      id,
+					"InStock": inStock,
+					"Name":    name,
+				},
+			}
+		}
+
+		dps := []pipeline.DataPoint{
+			dp(1, "Tab\\tand\ttab", true),
+			dp(2, nil, false),
+			dp(3, "Two\nlines", true),
+		}
+		model := newUpsertModel(shapeutils.NewKnownShape(dps[0]), 0, nil, tableOptions{})
+
+		Convey("When the rows are read", func() {
+			data, err := ioutil.ReadAll(&rowReader{dataPoints: dps, model: model})
+
+			Convey("Then there should be a line of escaped fields per row", func() {
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "1\t1\tTab\\\\tand\\ttab\n"+
+					"2\t0\t\\N\n"+
+					"3\t1\tTwo\\nlines\n")
+			})
+		})
+	})
+
+	Convey("Dates should be written in the format of DATETIME", t, func() {
+		d := time.Date(2017, 6, 1, 13, 30, 5, 250000000, time.UTC)
+		So(loadDataValue(d), ShouldEqual, "2017-06-01 13:30:05.25")
+		So(loadDataValue(1.5), ShouldEqual, "1.5")
+		So(loadDataValue(1e20), ShouldEqual, "100000000000000000000")
+	})
+}
+
+func TestStagingTables(t *testing.T) {
+
+	Convey("Given a subscriber which bulk loaded rows", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		expectBegin := func() {
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("SET @@session.unique_checks = 0;")).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta("SET @@session.foreign_key_checks = 0;")).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+
+		expectBegin()
+
+		sut := &mariaSubscriber{
+			db:       db,
+			settings: &settings{Retries: 3, OnError: onErrorFail, BulkLoad: true},
+			staging:  map[string]bool{"Test.Products": true},
+		}
+		So(sut.beginTx(), ShouldBeNil)
+
+		Convey("When the transaction can't be committed at Dispose", func() {
+			mock.ExpectCommit().WillReturnError(errors.New("connection lost"))
+			expectBegin()
+			mock.ExpectCommit()
+			expectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("DROP TABLE IF EXISTS `_naveego_stage_Test.Products`;")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+			_, err = sut.Dispose(protocol.DisposeRequest{})
+
+			Convey("Then the staging tables should be dropped anyway", func() {
+				So(err, ShouldNotBeNil)
+				So(sut.staging, ShouldBeEmpty)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+	})
+}
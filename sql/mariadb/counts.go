@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// writeCounts are the numbers of rows which were inserted, updated or deleted,
+// or left unchanged because the row already had the values or was already deleted.
+type writeCounts struct {
+	Inserted  int
+	Updated   int
+	Deleted   int
+	Unchanged int
+}
+
+func (c *writeCounts) add(other writeCounts) {
+	c.Inserted += other.Inserted
+	c.Updated += other.Updated
+	c.Deleted += other.Deleted
+	c.Unchanged += other.Unchanged
+}
+
+func (c writeCounts) String() string {
+	return fmt.Sprintf("inserted %d, updated %d, deleted %d, unchanged %d", c.Inserted, c.Updated, c.Deleted, c.Unchanged)
+}
+
+// countUpsert classifies the row of a single-row upsert. MariaDB reports
+// an inserted row as one affected row, an updated row as two, and a row
+// which already had the values as none.
+func countUpsert(affected int64) writeCounts {
+	switch affected {
+	case 0:
+		return writeCounts{Unchanged: 1}
+	case 1:
+		return writeCounts{Inserted: 1}
+	}
+	return writeCounts{Updated: 1}
+}
+
+// countUpserts classifies the rows of an upsert of rows rows, existing of
+// which were in the table before it. Rows with the same keys in one
+// statement are counted as inserted.
+func countUpserts(rows, existing int, affected int64) writeCounts {
+
+	inserted := rows - existing
+	updated := (int(affected) - inserted) / 2
+	if updated < 0 {
+		updated = 0
+	}
+	if updated > existing {
+		updated = existing
+	}
+
+	return writeCounts{
+		Inserted:  inserted,
+		Updated:   updated,
+		Unchanged: existing - updated,
+	}
+}
+
+// countExistingTemplateText counts the rows of an upsert which are already in the table.
+const countExistingTemplateText = `SELECT COUNT(*) FROM {{tick .Name}}
+	WHERE ({{range $i, $e := .KeyColumns}}{{if $i}}, {{end}}{{tick $e.Name}}{{end}}) IN ({{range $r, $_ := .Rows}}{{if $r}}, {{end}}({{range $i, $e := $.KeyColumns}}{{if $i}}, {{end}}?{{end}}){{end}});`
+
+// countStagedTemplateText counts the rows of a bulk load,
+// and how many of them are already in the table.
+const countStagedTemplateText = `SELECT COUNT(*), COUNT({{range $i, $e := .KeyColumns}}{{if not $i}}t.{{tick $e.Name}}{{end}}{{end}}) FROM {{tick .Staging}} AS s
+	LEFT JOIN {{tick .Name}} AS t ON {{range $i, $e := .KeyColumns}}{{if $i}} AND {{end}}s.{{tick $e.Name}} = t.{{tick $e.Name}}{{end}};`
+
+// createCountExistingSQL renders the query counting the data points which have rows
+// in the table of knownShape. It returns an empty string if the shape has no keys,
+// because then every row is inserted.
+func createCountExistingSQL(dataPoints []pipeline.DataPoint, knownShape *shapeutils.KnownShape, options tableOptions) (sql string, params []interface{}, err error) {
+
+	model := newUpsertModel(knownShape, len(dataPoints), nil, tableOptions{Naming: options.Naming})
+	keys := model.KeyColumns()
+	if len(keys) == 0 {
+		return
+	}
+
+	w := &bytes.Buffer{}
+	err = countExistingTemplate.Execute(w, model)
+	if err != nil {
+		return
+	}
+
+	sql = w.String()
+
+	for _, dp := range dataPoints {
+		for _, k := range keys {
+			params = append(params, dp.Data[k.Property])
+		}
+	}
+
+	return
+}
+
+// countExisting returns how many of the data points have rows in the table of knownShape.
+func (h *mariaSubscriber) countExisting(knownShape *shapeutils.KnownShape, dataPoints []pipeline.DataPoint) (int, error) {
+
+	query, params, err := createCountExistingSQL(dataPoints, knownShape, h.tableOptions())
+	if err != nil || query == "" {
+		return 0, err
+	}
+
+	var existing int
+	err = h.queryRow(query, params, &existing)
+
+	return existing, err
+}
+
+// UpdateValue returns the value a column is set to when the row exists. With
+// SkipUnchanged, the columns keep their values if the row hash is the same,
+// so that MariaDB doesn't write the row. _row_hash is the last column, so the
+// other columns are compared with its old value. The old values are qualified
+// with the table, because the staging table a bulk load merges from has the
+// same columns.
+func (m sqlTableModel) UpdateValue(c sqlColumnModel) string {
+
+	// A soft deleted row is restored even if its values haven't changed,
+	// and a snapshot must know that the row was written in the run.
+	value := "VALUES(`" + c.Name + "`)"
+	if !m.SkipUnchanged || c.Name == auditRowHash || c.Name == auditDeleted || (c.Name == auditRunID && m.Snapshot) {
+		return value
+	}
+
+	table := "`" + m.Name + "`."
+
+	return "IF(" + table + "`" + auditRowHash + "` <=> VALUES(`" + auditRowHash + "`), " + table + "`" + c.Name + "`, " + value + ")"
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWriteCounts(t *testing.T) {
+
+	Convey("The row of a single-row upsert should be classified by the affected rows", t, func() {
+		So(countUpsert(0), ShouldResemble, writeCounts{Unchanged: 1})
+		So(countUpsert(1), ShouldResemble, writeCounts{Inserted: 1})
+		So(countUpsert(2), ShouldResemble, writeCounts{Updated: 1})
+	})
+
+	Convey("The rows of an upsert should be classified by the rows which existed", t, func() {
+		// 2 inserted (1 each) and 1 updated (2) of 3 existing.
+		So(countUpserts(5, 3, 4), ShouldResemble, writeCounts{Inserted: 2, Updated: 1, Unchanged: 2})
+		So(countUpserts(3, 0, 3), ShouldResemble, writeCounts{Inserted: 3})
+		So(countUpserts(3, 3, 0), ShouldResemble, writeCounts{Unchanged: 3})
+	})
+
+	Convey("Given data points with the same known shape", t, func() {
+
+		dp := func(id int, name string) pipeline.DataPoint {
+			return pipeline.DataPoint{
+				Entity: "Products",
+				Source: "Test",
+				Shape: pipeline.Shape{
+					KeyNames:   []string{"ID"},
+					Properties: []string{"ID:integer", "Name:string"},
+				},
+				Data: map[string]interface{}{
+					"ID":   id,
+					"Name": name,
+				},
+			}
+		}
+
+		dps := []pipeline.DataPoint{dp(1, "First"), dp(2, "Second")}
+		shape := shapeutils.NewKnownShape(dps[0])
+
+		Convey("When we generate the query counting the existing rows", func() {
+			actual, params, err := createCountExistingSQL(dps, shape, tableOptions{})
+
+			Convey("Then it should look the rows up by their keys", nil)
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`SELECT COUNT(*) FROM "Test.Products"
+	WHERE ("ID") IN ((?), (?));`))
+			So(params, ShouldResemble, []interface{}{1, 2})
+		})
+
+		Convey("When we generate upsert SQL which skips unchanged rows", func() {
+			actual, _, err := createBatchUpsertSQL(dps, shape, tableOptions{SkipUnchanged: true})
+
+			Convey("Then the columns should only be updated if the row hash has changed", nil)
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`INSERT INTO "Test.Products" ("ID", "Name", "_row_hash")
+	VALUES (?, ?, ?),
+		(?, ?, ?)
+	ON DUPLICATE KEY UPDATE
+		"Name" = IF("Test.Products"."_row_hash" <=> VALUES("_row_hash"), "Test.Products"."Name", VALUES("Name"))
+		,"_row_hash" = VALUES("_row_hash");`))
+		})
+
+		Convey("When a batch is written", func() {
+			db, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+
+			Reset(func() {
+				db.Close()
+			})
+
+			sut := &mariaSubscriber{db: db, settings: &settings{Retries: 3, OnError: onErrorFail}}
+
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT COUNT(*) FROM `Test.Products`")).
+				WithArgs(1, 2).
+				WillReturnRows(sqlmock.NewRows([]string{"COUNT(*)"}).AddRow(1))
+			mock.ExpectExec("INSERT INTO `Test.Products`").WillReturnResult(sqlmock.NewResult(2, 3))
+
+			err = sut.upsertRows(shape, dps)
+
+			Convey("Then the rows should be counted when they are committed", func() {
+				So(err, ShouldBeNil)
+				So(sut.pending, ShouldResemble, writeCounts{Inserted: 1, Updated: 1})
+				So(sut.commit(), ShouldBeNil)
+				So(sut.counts, ShouldResemble, writeCounts{Inserted: 1, Updated: 1})
+				So(sut.counts.String(), ShouldEqual, "inserted 1, updated 1, deleted 0, unchanged 0")
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+	})
+}
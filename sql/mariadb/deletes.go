@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// deleteTemplateText deletes the row of a tombstone, and in history mode all its versions.
+const deleteTemplateText = `DELETE FROM {{tick .Name}}
+	WHERE {{range $i, $e := .KeyColumns}}{{if $i}} AND {{end}}{{tick $e.Name}} = ?{{end}};`
+
+// softDeleteTemplateText flags the row of a tombstone as deleted,
+// updating the audit columns if the table has them.
+const softDeleteTemplateText = `UPDATE {{tick .Name}} SET {{tick "_deleted"}} = 1{{range .UpdateColumns}}, {{tick .Name}} = ?{{end}}
+	WHERE {{range .KeyColumns}}{{tick .Name}} = ? AND {{end}}({{tick "_deleted"}} IS NULL OR {{tick "_deleted"}} = 0);`
+
+// closeCurrentTemplateText closes the current version of the row of a tombstone in history mode.
+const closeCurrentTemplateText = `UPDATE {{tick .Name}} SET {{tick "_valid_to"}} = ?, {{tick "_is_current"}} = 0
+	WHERE {{range .KeyColumns}}{{tick .Name}} = ? AND {{end}}{{tick "_is_current"}} = 1;`
+
+// createDeleteSQL renders the statement which applies the Deletes policy
+// in options to a tombstone, and returns its parameters.
+func createDeleteSQL(datapoint pipeline.DataPoint, options tableOptions) (sql string, params []interface{}, err error) {
+
+	name := shapeutils.CanonicalName(datapoint)
+
+	if len(datapoint.Shape.KeyNames) == 0 {
+		err = fmt.Errorf("can't delete a row of %s, because the data point has no keys", name)
+		return
+	}
+
+	model := sqlTableModel{
+		Name:  options.table(name),
+		Now:   time.Now().UTC(),
+		RunID: options.RunID,
+	}
+	for _, k := range datapoint.Shape.KeyNames {
+		if _, ok := datapoint.Data[k]; !ok {
+			err = fmt.Errorf("can't delete a row of %s, because the data point has no value for key %s", name, k)
+			return
+		}
+		model.Columns = append(model.Columns, sqlColumnModel{Name: escapeString(k), Property: k, IsKey: true})
+	}
+
+	var t *template.Template
+
+	switch {
+	case options.Deletes == shapeutils.DeletesHard:
+		t = deleteTemplate
+	case options.History:
+		t = closeCurrentTemplate
+		params = append(params, versionTime())
+	default:
+		t = softDeleteTemplate
+		for _, c := range auditColumns(options) {
+			if c.Name == auditUpdatedAt || c.Name == auditRunID {
+				model.Columns = append(model.Columns, c)
+				params = append(params, auditValue(c, datapoint, model))
+			}
+		}
+	}
+
+	w := &bytes.Buffer{}
+	err = t.Execute(w, model)
+	if err != nil {
+		return
+	}
+
+	sql = w.String()
+
+	for _, k := range model.KeyColumns() {
+		params = append(params, datapoint.Data[k.Property])
+	}
+
+	return
+}
+
+// countDelete classifies the row of a tombstone.
+func countDelete(affected int64) writeCounts {
+	if affected > 0 {
+		return writeCounts{Deleted: 1}
+	}
+	return writeCounts{Unchanged: 1}
+}
+
+// deleteRow applies the Deletes policy to the row of a tombstone.
+func (h *mariaSubscriber) deleteRow(dataPoint pipeline.DataPoint) error {
+
+	// A shape without a table has no rows to delete,
+	// and no rows are written in plan mode.
+	if !h.knownShapes.Knows(shapeutils.CanonicalName(dataPoint)) || h.planning() {
+		h.txMu.Lock()
+		h.pending.add(writeCounts{Unchanged: 1})
+		h.txMu.Unlock()
+		return nil
+	}
+
+	// Buffered rows were received before the tombstone, so they are written
+	// first. Rows of child tables may belong to the deleted row.
+	err := h.flushBatches()
+	if err != nil {
+		return err
+	}
+
+	deleteCommand, deleteParameters, err := createDeleteSQL(dataPoint, h.tableOptions())
+	if err != nil {
+		return err
+	}
+
+	// A hard delete also deletes the rows of the child tables which belong to the row.
+	if h.settings.Deletes == shapeutils.DeletesHard {
+		return h.execCascading(1, countDelete, deleteCommand, deleteParameters...)
+	}
+
+	return h.execCounted(1, countDelete, deleteCommand, deleteParameters...)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDeletes(t *testing.T) {
+
+	Convey("Given a tombstone", t, func() {
+
+		dp := pipeline.DataPoint{
+			Entity: "Products",
+			Source: "Test",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"ID"},
+				Properties: []string{"ID:integer", "_deleted:bool"},
+			},
+			Data: map[string]interface{}{
+				"ID":       1,
+				"_deleted": true,
+			},
+		}
+
+		Convey("When we generate SQL for hard deletes", func() {
+			actual, params, err := createDeleteSQL(dp, tableOptions{Deletes: shapeutils.DeletesHard})
+
+			Convey("Then the row should be deleted by its keys", nil)
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`DELETE FROM "Test.Products"
+	WHERE "ID" = ?;`))
+			So(params, ShouldResemble, []interface{}{1})
+		})
+
+		Convey("When we generate SQL for soft deletes with audit columns", func() {
+			actual, params, err := createDeleteSQL(dp, tableOptions{Deletes: shapeutils.DeletesSoft, Audit: true, RunID: "run-1"})
+
+			Convey("Then the row should be flagged and its audit columns updated", nil)
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`UPDATE "Test.Products" SET "_deleted" = 1, "_updated_at" = ?, "_run_id" = ?
+	WHERE "ID" = ? AND ("_deleted" IS NULL OR "_deleted" = 0);`))
+			So(params, ShouldHaveLength, 3)
+			So(params[1:], ShouldResemble, []interface{}{"run-1", 1})
+		})
+
+		Convey("When we generate SQL for soft deletes in history mode", func() {
+			actual, params, err := createDeleteSQL(dp, tableOptions{Deletes: shapeutils.DeletesSoft, History: true})
+
+			Convey("Then the current version should be closed", nil)
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`UPDATE "Test.Products" SET "_valid_to" = ?, "_is_current" = 0
+	WHERE "ID" = ? AND "_is_current" = 1;`))
+			So(params, ShouldHaveLength, 2)
+		})
+
+		Convey("When the tombstone has no keys", func() {
+			dp.Shape.KeyNames = nil
+			_, _, err := createDeleteSQL(dp, tableOptions{Deletes: shapeutils.DeletesHard})
+
+			Convey("Then there should be an error", func() {
+				So(err, ShouldNotBeNil)
+			})
+		})
+
+		Convey("When the subscriber receives it", func() {
+			db, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+
+			Reset(func() {
+				db.Close()
+			})
+
+			sut := &mariaSubscriber{
+				db:          db,
+				knownShapes: shapeutils.NewShapeCache(),
+				settings:    &settings{Retries: 3, OnError: onErrorFail, Deletes: shapeutils.DeletesHard},
+			}
+			tombstone, _ := shapeutils.SplitDeleted(dp)
+			_, err = sut.knownShapes.Remember(shapeutils.NewKnownShape(tombstone))
+			So(err, ShouldBeNil)
+
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM `Test.Products`")).
+				WithArgs(1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			err = sut.receive(dp)
+
+			Convey("Then the row should be deleted and counted", func() {
+				So(err, ShouldBeNil)
+				So(sut.pending, ShouldResemble, writeCounts{Deleted: 1})
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+
+		Convey("When the subscriber receives it in a transaction, and the shape has child tables", func() {
+			db, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+
+			Reset(func() {
+				db.Close()
+			})
+
+			sut := &mariaSubscriber{
+				db:            db,
+				transactional: true,
+				knownShapes:   shapeutils.NewShapeCache(),
+				settings:      &settings{Retries: 3, OnError: onErrorFail, Deletes: shapeutils.DeletesHard, Nested: shapeutils.NestedChildTables},
+			}
+			tombstone, _ := shapeutils.SplitDeleted(dp)
+			_, err = sut.knownShapes.Remember(shapeutils.NewKnownShape(tombstone))
+			So(err, ShouldBeNil)
+
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("SET @@session.unique_checks = 0;")).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta("SET @@session.foreign_key_checks = 0;")).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta("SET @@session.foreign_key_checks = 1;")).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM `Test.Products`")).
+				WithArgs(1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectExec(regexp.QuoteMeta("SET @@session.foreign_key_checks = 0;")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+			err = sut.receive(dp)
+
+			Convey("Then the row should be deleted with foreign key checks, so that its child rows are deleted too", func() {
+				So(err, ShouldBeNil)
+				So(sut.pending, ShouldResemble, writeCounts{Deleted: 1})
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Soft deletes should add a hidden _deleted column which writes restore", t, func() {
+		columns := auditColumns(tableOptions{Deletes: shapeutils.DeletesSoft})
+		So(columns, ShouldHaveLength, 1)
+		So(columns[0].Name, ShouldEqual, "_deleted")
+		So(isHiddenColumn("_deleted"), ShouldBeTrue)
+		So(auditValue(columns[0], pipeline.DataPoint{}, sqlTableModel{}), ShouldEqual, false)
+	})
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/deadletter"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// tableRef identifies a table in information_schema.
+type tableRef struct {
+	database string
+	name     string
+}
+
+// discoveredTable is a table discovered in the database, and the shape it stores.
+type discoveredTable struct {
+	shapeName string
+	table     string // The escaped name of the table, qualified if it is in another database
+	columns   []shapeutils.Column
+	keys      []string // The columns of the primary key, in order
+	indexes   []sqlIndexModel
+}
+
+// getKnownShapes discovers the shapes stored in the tables of the database, along with
+// the columns of the tables, from information_schema. Tables which are not named like
+// their shapes have the names of the shapes in their comments. When shapes are routed
+// to other databases, the tables of the shapes are discovered in them too.
+func (h *mariaSubscriber) getKnownShapes() ([]*shapeutils.KnownShape, error) {
+
+	refs, tables, err := h.readTables()
+	if err != nil || len(refs) == 0 {
+		return nil, err
+	}
+
+	databases := []interface{}{}
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		if !seen[ref.database] {
+			seen[ref.database] = true
+			databases = append(databases, ref.database)
+		}
+	}
+
+	err = h.readColumns(databases, tables)
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.readStatistics(databases, tables)
+	if err != nil {
+		return nil, err
+	}
+
+	var shapes []*shapeutils.KnownShape
+
+	for _, ref := range refs {
+		t := tables[ref]
+
+		dp := pipeline.DataPoint{
+			Source: t.shapeName,
+			Shape:  pipeline.Shape{},
+		}
+		hidden := map[string]bool{}
+		var columns []shapeutils.Column
+
+		for _, c := range t.columns {
+			if isHiddenColumn(c.Name) {
+				hidden[c.Name] = true
+				continue
+			}
+			typ := h.types.fromSQL(t.shapeName, c.Name, c.Type)
+			h.types.observe(t.shapeName, c.Name, typ, c.Type)
+			dp.Shape.Properties = append(dp.Shape.Properties, c.Name+":"+typ)
+			columns = append(columns, c)
+		}
+
+		// The keys of a table in history mode include the start of the version.
+		for _, k := range t.keys {
+			if !isHiddenColumn(k) {
+				dp.Shape.KeyNames = append(dp.Shape.KeyNames, k)
+			}
+		}
+
+		if hidden[historyValidFrom] != h.settings.History {
+			h.unversioned = append(h.unversioned, t.shapeName)
+		}
+
+		for _, c := range auditColumns(h.tableOptions()) {
+			if !hidden[c.Name] {
+				h.unaudited = append(h.unaudited, t.shapeName)
+				break
+			}
+		}
+
+		h.recordIndexes(t.shapeName, t.indexes)
+
+		shape := shapeutils.NewKnownShape(dp)
+		shape.Columns = columns
+
+		shapes = append(shapes, shape)
+	}
+
+	return shapes, nil
+}
+
+// readTables reads the tables which store shapes, in the order information_schema returns them.
+func (h *mariaSubscriber) readTables() ([]tableRef, map[tableRef]*discoveredTable, error) {
+
+	naming := h.tableOptions().Naming
+
+	// The tables created in other databases have the names of their shapes in
+	// their comments. The tables in the databases shapes are mapped to may have
+	// been created without, and are named like the shapes.
+	query := "SELECT COALESCE(TABLE_SCHEMA = DATABASE(), 0), TABLE_SCHEMA, TABLE_NAME, TABLE_COMMENT FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE()"
+	if naming.routes() {
+		query += fmt.Sprintf(" OR TABLE_COMMENT LIKE '%s%%'", shapeCommentPrefix)
+	}
+	databases := naming.mappedDatabases()
+	if len(databases) > 0 {
+		query += " OR " + inDatabases(databases)
+	}
+
+	rows, err := h.db.Query(query, databases...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var refs []tableRef
+	tables := map[tableRef]*discoveredTable{}
+
+	for rows.Next() {
+		var (
+			current bool
+			ref     tableRef
+			comment string
+		)
+		err = rows.Scan(&current, &ref.database, &ref.name, &comment)
+		if err != nil {
+			return nil, nil, err
+		}
+		// The metadata tables don't hold shapes.
+		if ref.name == shapeStoreTable || ref.name == heldTable || ref.name == deadletter.DefaultTable || ref.name == h.settings.DeadLetterTable ||
+			strings.HasPrefix(ref.name, stagingTablePrefix) || strings.HasPrefix(ref.name, shadowTablePrefix) ||
+			strings.HasPrefix(ref.name, oldTablePrefix) {
+			continue
+		}
+
+		t := &discoveredTable{shapeName: ref.name, table: ref.name}
+		if strings.HasPrefix(comment, shapeCommentPrefix) {
+			t.shapeName = strings.TrimPrefix(comment, shapeCommentPrefix)
+		}
+		if !current {
+			t.table = qualifyTableName(ref.database, ref.name)
+			// Other subscribers may route their shapes to the database.
+			if naming.table(t.shapeName) != t.table {
+				continue
+			}
+		}
+
+		refs = append(refs, ref)
+		tables[ref] = t
+	}
+
+	return refs, tables, rows.Err()
+}
+
+// inDatabases renders the condition selecting the rows of information_schema in databases.
+func inDatabases(databases []interface{}) string {
+	return "TABLE_SCHEMA IN (" + strings.TrimSuffix(strings.Repeat("?, ", len(databases)), ", ") + ")"
+}
+
+// readColumns reads the columns of the tables in the order they are in the tables.
+func (h *mariaSubscriber) readColumns(databases []interface{}, tables map[tableRef]*discoveredTable) error {
+
+	rows, err := h.db.Query("SELECT TABLE_SCHEMA, TABLE_NAME, COLUMN_NAME, COLUMN_TYPE, IS_NULLABLE, CHARACTER_MAXIMUM_LENGTH, "+
+		"NUMERIC_PRECISION, NUMERIC_SCALE, COLUMN_DEFAULT, COLUMN_COMMENT FROM information_schema.COLUMNS WHERE "+
+		inDatabases(databases)+" ORDER BY TABLE_SCHEMA, TABLE_NAME, ORDINAL_POSITION", databases...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			ref       tableRef
+			c         shapeutils.Column
+			nullable  string
+			length    sql.NullInt64
+			precision sql.NullInt64
+			scale     sql.NullInt64
+			def       sql.NullString
+		)
+		err = rows.Scan(&ref.database, &ref.name, &c.Name, &c.Type, &nullable, &length, &precision, &scale, &def, &c.Comment)
+		if err != nil {
+			return err
+		}
+
+		t, ok := tables[ref]
+		if !ok {
+			continue
+		}
+
+		c.Nullable = nullable == "YES"
+		if length.Valid {
+			c.Length = &length.Int64
+		}
+		if precision.Valid {
+			c.Precision = &precision.Int64
+		}
+		if scale.Valid {
+			c.Scale = &scale.Int64
+		}
+		if def.Valid {
+			c.Default = &def.String
+		}
+
+		t.columns = append(t.columns, c)
+	}
+
+	return rows.Err()
+}
+
+// readStatistics reads the primary keys and the names of the indexes of the tables.
+func (h *mariaSubscriber) readStatistics(databases []interface{}, tables map[tableRef]*discoveredTable) error {
+
+	rows, err := h.db.Query("SELECT TABLE_SCHEMA, TABLE_NAME, INDEX_NAME, COLUMN_NAME FROM information_schema.STATISTICS WHERE "+
+		inDatabases(databases)+" ORDER BY TABLE_SCHEMA, TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX", databases...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			ref    tableRef
+			index  string
+			column string
+		)
+		err = rows.Scan(&ref.database, &ref.name, &index, &column)
+		if err != nil {
+			return err
+		}
+
+		t, ok := tables[ref]
+		if !ok {
+			continue
+		}
+
+		if index == "PRIMARY" {
+			t.keys = append(t.keys, column)
+		}
+		if n := len(t.indexes); n == 0 || t.indexes[n-1].Name != index {
+			t.indexes = append(t.indexes, sqlIndexModel{Name: index})
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestDiscovery(t *testing.T) {
+
+	tableColumns := []string{"current", "TABLE_SCHEMA", "TABLE_NAME", "TABLE_COMMENT"}
+	columnColumns := []string{"TABLE_SCHEMA", "TABLE_NAME", "COLUMN_NAME", "COLUMN_TYPE", "IS_NULLABLE", "CHARACTER_MAXIMUM_LENGTH",
+		"NUMERIC_PRECISION", "NUMERIC_SCALE", "COLUMN_DEFAULT", "COLUMN_COMMENT"}
+	statisticsColumns := []string{"TABLE_SCHEMA", "TABLE_NAME", "INDEX_NAME", "COLUMN_NAME"}
+
+	Convey("Given a database with tables", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		s := &settings{History: true}
+		types, err := newTypeMapper(s)
+		So(err, ShouldBeNil)
+
+		sut := &mariaSubscriber{db: db, settings: s, types: types}
+
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE()")).
+			WillReturnRows(sqlmock.NewRows(tableColumns).
+				AddRow(1, "pipeline", "Test.Products", "").
+				AddRow(1, "pipeline", shapeStoreTable, ""))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.COLUMNS WHERE TABLE_SCHEMA IN (?) ORDER BY TABLE_SCHEMA, TABLE_NAME, ORDINAL_POSITION")).
+			WithArgs("pipeline").
+			WillReturnRows(sqlmock.NewRows(columnColumns).
+				AddRow("pipeline", "Test.Products", "Region", "varchar(10)", "NO", 10, nil, nil, nil, "").
+				AddRow("pipeline", "Test.Products", "ID", "int(10)", "NO", nil, 10, 0, nil, "").
+				AddRow("pipeline", "Test.Products", "Price", "double", "YES", nil, 22, nil, "0", "The list price").
+				AddRow("pipeline", "Test.Products", "_valid_from", "datetime(6)", "NO", nil, nil, nil, nil, "").
+				AddRow("pipeline", shapeStoreTable, "name", "varchar(255)", "NO", 255, nil, nil, nil, ""))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.STATISTICS WHERE TABLE_SCHEMA IN (?) ORDER BY TABLE_SCHEMA, TABLE_NAME, INDEX_NAME, SEQ_IN_INDEX")).
+			WithArgs("pipeline").
+			WillReturnRows(sqlmock.NewRows(statisticsColumns).
+				AddRow("pipeline", "Test.Products", "PRIMARY", "ID").
+				AddRow("pipeline", "Test.Products", "PRIMARY", "Region").
+				AddRow("pipeline", "Test.Products", "PRIMARY", "_valid_from").
+				AddRow("pipeline", "Test.Products", "ix_current", "ID"))
+
+		shapes, err := sut.getKnownShapes()
+
+		Convey("Then the shapes should have the keys in the order of the primary key", func() {
+			So(err, ShouldBeNil)
+			So(shapes, ShouldHaveLength, 1)
+			So(shapes[0].Name, ShouldEqual, "Test.Products")
+			So(shapes[0].Keys, ShouldResemble, []string{"ID", "Region"})
+			So(shapes[0].Properties, ShouldResemble, []pipeline.PropertyDefinition{
+				{Name: "ID", Type: "integer"},
+				{Name: "Price", Type: "float"},
+				{Name: "Region", Type: "string"},
+			})
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+
+		Convey("Then the shapes should have the metadata of their columns", func() {
+			ten, twentyTwo, zero, def := int64(10), int64(22), int64(0), "0"
+			So(shapes[0].Columns, ShouldResemble, []shapeutils.Column{
+				{Name: "Region", Type: "varchar(10)", Length: &ten},
+				{Name: "ID", Type: "int(10)", Precision: &ten, Scale: &zero},
+				{Name: "Price", Type: "double", Nullable: true, Precision: &twentyTwo, Default: &def, Comment: "The list price"},
+			})
+		})
+
+		Convey("Then the indexes of the tables should be recorded", func() {
+			So(sut.indexes["Test.Products"], ShouldResemble, map[string]bool{"PRIMARY": true, "ix_current": true})
+		})
+
+		Convey("Then the tables should have the history columns", func() {
+			So(sut.checkHistory(), ShouldBeNil)
+		})
+	})
+
+	Convey("Given a database with tables named by a strategy", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		s := &settings{TableNameCase: tableNameCaseSnake, SourceAsDatabase: true}
+		types, err := newTypeMapper(s)
+		So(err, ShouldBeNil)
+
+		sut := &mariaSubscriber{db: db, settings: s, types: types}
+
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() OR TABLE_COMMENT LIKE 'shape:%'")).
+			WillReturnRows(sqlmock.NewRows(tableColumns).
+				AddRow(1, "pipeline", "Orders", "").
+				AddRow(0, "test", "order_items", "shape:Test.OrderItems").
+				AddRow(0, "other", "orders", "shape:Test.Orders"))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.COLUMNS WHERE TABLE_SCHEMA IN (?, ?)")).
+			WithArgs("pipeline", "test").
+			WillReturnRows(sqlmock.NewRows(columnColumns).
+				AddRow("pipeline", "Orders", "id", "int(10)", "NO", nil, 10, 0, nil, "").
+				AddRow("test", "order_items", "id", "int(10)", "NO", nil, 10, 0, nil, ""))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.STATISTICS WHERE TABLE_SCHEMA IN (?, ?)")).
+			WithArgs("pipeline", "test").
+			WillReturnRows(sqlmock.NewRows(statisticsColumns))
+
+		shapes, err := sut.getKnownShapes()
+
+		Convey("Then the tables should be discovered as their shapes, unless they aren't routed there", func() {
+			So(err, ShouldBeNil)
+			So(shapes, ShouldHaveLength, 2)
+			So(shapes[0].Name, ShouldEqual, "Orders")
+			So(shapes[1].Name, ShouldEqual, "Test.OrderItems")
+			So(shapes[1].Columns, ShouldHaveLength, 1)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+	Convey("Given a database a shape is mapped to, with a table created without a comment", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		s := &settings{Databases: map[string]string{"Orders": "sales"}}
+		types, err := newTypeMapper(s)
+		So(err, ShouldBeNil)
+
+		sut := &mariaSubscriber{db: db, settings: s, types: types}
+
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.TABLES WHERE TABLE_SCHEMA = DATABASE() OR TABLE_COMMENT LIKE 'shape:%' OR TABLE_SCHEMA IN (?)")).
+			WithArgs("sales").
+			WillReturnRows(sqlmock.NewRows(tableColumns).
+				AddRow(0, "sales", "Orders", "").
+				AddRow(0, "sales", "Customers", ""))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.COLUMNS WHERE TABLE_SCHEMA IN (?)")).
+			WithArgs("sales").
+			WillReturnRows(sqlmock.NewRows(columnColumns).
+				AddRow("sales", "Orders", "id", "int(10)", "NO", nil, 10, 0, nil, "").
+				AddRow("sales", "Customers", "id", "int(10)", "NO", nil, 10, 0, nil, ""))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.STATISTICS WHERE TABLE_SCHEMA IN (?)")).
+			WithArgs("sales").
+			WillReturnRows(sqlmock.NewRows(statisticsColumns))
+
+		shapes, err := sut.getKnownShapes()
+
+		Convey("Then the table should be discovered as the shape named like it", func() {
+			So(err, ShouldBeNil)
+			So(shapes, ShouldHaveLength, 1)
+			So(shapes[0].Name, ShouldEqual, "Orders")
+			So(shapes[0].Columns, ShouldHaveLength, 1)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-sql-driver/mysql"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/deadletter"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// Policies for rows which can't be written.
+const (
+	// onErrorFail rolls back the current transaction and fails the data point.
+	onErrorFail = "fail"
+	// onErrorContinue skips the row and continues with the run. Only errors
+	// caused by the row itself are skipped, a deadlock or a lost connection
+	// which can't be retried still fails the run.
+	onErrorContinue = "continue"
+)
+
+// errorClass is the kind of failure of a statement writing rows.
+type errorClass string
+
+const (
+	errorConstraint     errorClass = "constraint violation"
+	errorTruncation     errorClass = "data truncation"
+	errorDeadlock       errorClass = "deadlock"
+	errorConnectionLost errorClass = "connection lost"
+	errorOther          errorClass = "error"
+)
+
+// writeError is the classified error of a statement writing rows.
+type writeError struct {
+	Class errorClass
+	Err   error
+}
+
+func (e *writeError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Class, e.Err)
+}
+
+// transient reports whether the statement may succeed if it is retried.
+func (e *writeError) transient() bool {
+	return e.Class == errorDeadlock || e.Class == errorConnectionLost
+}
+
+// classifyError wraps err in a writeError, using the MariaDB error number
+// or the driver error to decide its class.
+func classifyError(err error) *writeError {
+
+	if we, ok := err.(*writeError); ok {
+		return we
+	}
+
+	class := errorOther
+
+	switch e := err.(type) {
+	case *mysql.MySQLError:
+		switch e.Number {
+		case 1022, 1048, 1062, 1169, 1216, 1217, 1364, 1451, 1452, 1557, 1586:
+			class = errorConstraint
+		case 1264, 1265, 1292, 1366, 1406:
+			class = errorTruncation
+		case 1205, 1213:
+			class = errorDeadlock
+		case 1053, 1152, 1153, 1154, 1156, 1158, 1159, 1160, 1161, 2006, 2013:
+			class = errorConnectionLost
+		}
+	default:
+		if err == mysql.ErrInvalidConn || err == driver.ErrBadConn {
+			class = errorConnectionLost
+		}
+	}
+
+	return &writeError{Class: class, Err: err}
+}
+
+// reject applies the OnError policy to a data point which couldn't be written.
+// It returns nil if the data point was skipped, otherwise the error.
+func (h *mariaSubscriber) reject(dataPoint pipeline.DataPoint, err error) error {
+
+	we, ok := err.(*writeError)
+	if !ok || we.transient() || h.settings.OnError != onErrorContinue {
+		return err
+	}
+
+	name := shapeutils.CanonicalName(dataPoint)
+
+	if h.deadLetters != nil {
+		// A row which can't be kept for replaying must not be skipped.
+		if dlErr := h.deadLetters.Write(deadletter.NewEntry(name, dataPoint, we)); dlErr != nil {
+			logrus.Error("Couldn't write dead letter: ", dlErr)
+			return err
+		}
+	}
+
+	h.txMu.Lock()
+	h.rejected++
+	h.txMu.Unlock()
+
+	logrus.WithFields(logrus.Fields{
+		"shape": name,
+		"class": we.Class,
+		"data":  dataPoint.Data,
+	}).Warn("Skipped data point which couldn't be written: ", we.Err)
+
+	return nil
+}
+
+// newDeadLetterStore creates the dead letter store selected in the settings,
+// or returns nil if skipped rows should only be logged.
+func newDeadLetterStore(s *settings, db *sql.DB) (deadletter.Store, error) {
+	switch s.DeadLetter {
+	case "":
+		return nil, nil
+	case "file":
+		if s.DeadLetterFile == "" {
+			return nil, fmt.Errorf("settings didn't contain DeadLetterFile key, which is required when DeadLetter is %q", s.DeadLetter)
+		}
+		return deadletter.NewFileStore(s.DeadLetterFile)
+	case "table":
+		return deadletter.NewTableStore(db, deadletter.MariaDB, s.DeadLetterTable)
+	}
+
+	return nil, fmt.Errorf("unknown DeadLetter %q, expected \"file\" or \"table\"", s.DeadLetter)
+}
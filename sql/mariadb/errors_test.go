@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestClassifyError(t *testing.T) {
+
+	Convey("Given errors returned by the driver", t, func() {
+
+		cases := []struct {
+			err       error
+			class     errorClass
+			transient bool
+		}{
+			{&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"}, errorConstraint, false},
+			{&mysql.MySQLError{Number: 1452, Message: "Cannot add or update a child row"}, errorConstraint, false},
+			{&mysql.MySQLError{Number: 1406, Message: "Data too long for column"}, errorTruncation, false},
+			{&mysql.MySQLError{Number: 1264, Message: "Out of range value"}, errorTruncation, false},
+			{&mysql.MySQLError{Number: 1213, Message: "Deadlock found"}, errorDeadlock, true},
+			{&mysql.MySQLError{Number: 1205, Message: "Lock wait timeout exceeded"}, errorDeadlock, true},
+			{&mysql.MySQLError{Number: 2006, Message: "MySQL server has gone away"}, errorConnectionLost, true},
+			{mysql.ErrInvalidConn, errorConnectionLost, true},
+			{driver.ErrBadConn, errorConnectionLost, true},
+			{errors.New("something else"), errorOther, false},
+		}
+
+		Convey("Then each should be classified", func() {
+			for _, c := range cases {
+				we := classifyError(c.err)
+				So(we.Class, ShouldEqual, c.class)
+				So(we.transient(), ShouldEqual, c.transient)
+				So(we.Err, ShouldEqual, c.err)
+			}
+		})
+
+		Convey("Then classifying a classified error should return it unchanged", func() {
+			we := classifyError(cases[0].err)
+			So(classifyError(we), ShouldEqual, we)
+		})
+	})
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// The columns a table has in history mode, in addition to the properties of the
+// shape. The primary key is the shape's keys and _valid_from, so that a row can
+// have many versions, of which only the current one has _is_current set.
+// _row_hash is the hash of the values of the properties which are not keys,
+// used to find out whether a row has changed.
+const (
+	historyValidFrom = "_valid_from"
+	historyValidTo   = "_valid_to"
+	historyIsCurrent = "_is_current"
+	historyRowHash   = "_row_hash"
+)
+
+// historyColumns are the columns which don't store properties.
+var historyColumns = []string{historyValidFrom, historyValidTo, historyIsCurrent, historyRowHash}
+
+// isHiddenColumn reports whether a column is written by the subscriber rather than
+// storing a property. Such columns are excluded from the shapes discovered in the database.
+func isHiddenColumn(name string) bool {
+	for _, c := range historyColumns {
+		if c == name {
+			return true
+		}
+	}
+	for _, c := range auditColumnTypes {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// closeVersionTemplateText closes the current version of a row if it has changed.
+const closeVersionTemplateText = `UPDATE {{tick .Name}} SET {{tick "_valid_to"}} = ?, {{tick "_is_current"}} = 0
+	WHERE {{range .KeyColumns}}{{tick .Name}} = ? AND {{end}}{{tick "_is_current"}} = 1 AND {{tick "_row_hash"}} <> ?;`
+
+// insertVersionTemplateText inserts a new version of a row,
+// unless the row has a current version which was not closed.
+const insertVersionTemplateText = `INSERT INTO {{tick .Name}} ({{range .Columns}}{{tick .Name}}, {{end}}{{tick "_valid_from"}}, {{tick "_valid_to"}}, {{tick "_is_current"}}, {{tick "_row_hash"}})
+	SELECT {{range .Columns}}?, {{end}}?, NULL, 1, ? FROM DUAL{{if .KeyColumns}}
+	WHERE NOT EXISTS (SELECT 1 FROM {{tick .Name}} WHERE {{range .KeyColumns}}{{tick .Name}} = ? AND {{end}}{{tick "_is_current"}} = 1){{end}};`
+
+// KeyColumns returns the columns which are keys.
+func (m sqlTableModel) KeyColumns() sqlColumns {
+	var columns sqlColumns
+	for _, c := range m.Columns {
+		if c.IsKey {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+// createHistorySQL renders the statements which write a version of a data point:
+// the statement closing the current version and the statement inserting the new one.
+// A shape without keys has no versions, so its rows are only inserted.
+func createHistorySQL(datapoint pipeline.DataPoint, knownShape *shapeutils.KnownShape, now time.Time, options tableOptions) (closeSQL string, closeParams []interface{}, insertSQL string, insertParams []interface{}, err error) {
+
+	model := newUpsertModel(knownShape, 1, nil, options)
+	model.Now = now
+	hash := rowHash(datapoint, model)
+
+	w := &bytes.Buffer{}
+	if err = insertVersionTemplate.Execute(w, model); err != nil {
+		return
+	}
+	insertSQL = w.String()
+
+	insertParams = append(upsertParameters(datapoint, model), now, hash)
+
+	keys := model.KeyColumns()
+	if len(keys) == 0 {
+		return
+	}
+
+	w.Reset()
+	if err = closeVersionTemplate.Execute(w, model); err != nil {
+		return
+	}
+	closeSQL = w.String()
+
+	closeParams = []interface{}{now}
+	for _, k := range keys {
+		closeParams = append(closeParams, datapoint.Data[k.Property])
+		insertParams = append(insertParams, datapoint.Data[k.Property])
+	}
+	closeParams = append(closeParams, hash)
+
+	return
+}
+
+// rowHash returns the hash of the values of the properties of model which are
+// not keys. The values are hashed by property name, and null values are left
+// out, so that the hash doesn't change when the table gets another column or
+// its columns are discovered in another order.
+func rowHash(datapoint pipeline.DataPoint, model sqlTableModel) string {
+
+	values := map[string]interface{}{}
+	for _, c := range model.UpdateColumns() {
+		if c.Audit {
+			continue
+		}
+		if v := datapoint.Data[c.Property]; v != nil {
+			values[c.Property] = v
+		}
+	}
+
+	// The keys of maps are encoded in sorted order. Values which can't be
+	// encoded are hashed as null, which at worst creates a version which isn't needed.
+	data, _ := json.Marshal(values)
+	sum := sha1.Sum(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+var (
+	versionMu   sync.Mutex
+	lastVersion time.Time
+)
+
+// versionTime returns the time a new version is valid from. The times are
+// increasing, so that two versions of a row written in the same microsecond
+// don't have the same primary key.
+func versionTime() time.Time {
+
+	versionMu.Lock()
+	defer versionMu.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	if !now.After(lastVersion) {
+		now = lastVersion.Add(time.Microsecond)
+	}
+	lastVersion = now
+
+	return now
+}
+
+// writeVersion closes the current version of the data point's row if it has
+// changed, and inserts the data point as the new current version.
+func (h *mariaSubscriber) writeVersion(knownShape *shapeutils.KnownShape, dataPoint pipeline.DataPoint) error {
+
+	closeSQL, closeParams, insertSQL, insertParams, err := createHistorySQL(dataPoint, knownShape, versionTime(), h.tableOptions())
+	if err != nil {
+		return err
+	}
+
+	// A closed version means the row was updated, otherwise
+	// the row was inserted if the new version was.
+	closed := int64(0)
+	if closeSQL != "" {
+		err = h.execCounted(0, func(affected int64) writeCounts {
+			closed = affected
+			return writeCounts{}
+		}, closeSQL, closeParams...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return h.execCounted(1, func(affected int64) writeCounts {
+		switch {
+		case closed > 0:
+			return writeCounts{Updated: 1}
+		case affected > 0:
+			return writeCounts{Inserted: 1}
+		}
+		return writeCounts{Unchanged: 1}
+	}, insertSQL, insertParams...)
+}
+
+// checkHistory fails if tables were discovered which don't keep the versions of
+// their rows the way the History setting does. The primary key of a history
+// table includes _valid_from, so the tables can't be converted in place.
+func (h *mariaSubscriber) checkHistory() error {
+
+	if len(h.unversioned) == 0 {
+		return nil
+	}
+
+	if h.settings.History {
+		return fmt.Errorf("History is set, but the tables of %s were created without it; drop or rename them to recreate them with history columns",
+			strings.Join(h.unversioned, ", "))
+	}
+
+	return fmt.Errorf("History isn't set, but the tables of %s were created with it; set History, or drop or rename them",
+		strings.Join(h.unversioned, ", "))
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCreateHistorySQL(t *testing.T) {
+
+	Convey("Given a data point of a shape with keys", t, func() {
+
+		dp := pipeline.DataPoint{
+			Entity: "Products",
+			Source: "Test",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"ID"},
+				Properties: []string{"ID:integer", "Name:string"},
+			},
+			Data: map[string]interface{}{
+				"ID":   1,
+				"Name": "First",
+			},
+		}
+		shape := shapeutils.NewKnownShape(dp)
+		now := time.Date(2017, 6, 1, 0, 0, 0, 0, time.UTC)
+
+		Convey("When we generate history SQL", func() {
+
+			closeSQL, closeParams, insertSQL, insertParams, err := createHistorySQL(dp, shape, now, tableOptions{})
+			hash := rowHash(dp, newUpsertModel(shape, 1, nil, tableOptions{}))
+
+			Convey("Then there should be no error", nil)
+			So(err, ShouldBeNil)
+			Convey("Then the current version should be closed if the row has changed", nil)
+			So(closeSQL, ShouldEqual, e(`UPDATE "Test.Products" SET "_valid_to" = ?, "_is_current" = 0
+	WHERE "ID" = ? AND "_is_current" = 1 AND "_row_hash" <> ?;`))
+			So(closeParams, ShouldResemble, []interface{}{now, 1, hash})
+			Convey("Then a new version should be inserted if there is no current version", nil)
+			So(insertSQL, ShouldEqual, e(`INSERT INTO "Test.Products" ("ID", "Name", "_valid_from", "_valid_to", "_is_current", "_row_hash")
+	SELECT ?, ?, ?, NULL, 1, ? FROM DUAL
+	WHERE NOT EXISTS (SELECT 1 FROM "Test.Products" WHERE "ID" = ? AND "_is_current" = 1);`))
+			So(insertParams, ShouldResemble, []interface{}{1, "First", now, hash, 1})
+		})
+
+		Convey("Then the hash should only change with the values which are not keys", func() {
+			model := newUpsertModel(shape, 1, nil, tableOptions{})
+			hash := rowHash(dp, model)
+
+			other := dp
+			other.Data = map[string]interface{}{"ID": 2, "Name": "First"}
+			So(rowHash(other, model), ShouldEqual, hash)
+
+			other.Data = map[string]interface{}{"ID": 1, "Name": "Second"}
+			So(rowHash(other, model), ShouldNotEqual, hash)
+		})
+		Convey("When the table gets another column before the data point is written again", func() {
+			_, closeParams, _, _, err := createHistorySQL(dp, shape, now, tableOptions{})
+			So(err, ShouldBeNil)
+
+			wider := dp
+			wider.Shape.Properties = []string{"Price:float", "Name:string", "ID:integer"}
+			widerShape := shapeutils.NewKnownShape(wider)
+
+			_, widerParams, _, _, err := createHistorySQL(dp, widerShape, now, tableOptions{})
+
+			Convey("Then the current version should be closed with the same hash", func() {
+				So(err, ShouldBeNil)
+				So(widerParams, ShouldResemble, closeParams)
+			})
+		})
+	})
+
+	Convey("Given a database with a table created without History", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		s := &settings{History: true}
+		types, err := newTypeMapper(s)
+		So(err, ShouldBeNil)
+
+		sut := &mariaSubscriber{db: db, settings: s, types: types}
+
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.TABLES")).
+			WillReturnRows(sqlmock.NewRows([]string{"current", "TABLE_SCHEMA", "TABLE_NAME", "TABLE_COMMENT"}).
+				AddRow(1, "pipeline", "Test.Products", ""))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.COLUMNS")).
+			WillReturnRows(sqlmock.NewRows([]string{"TABLE_SCHEMA", "TABLE_NAME", "COLUMN_NAME", "COLUMN_TYPE", "IS_NULLABLE",
+				"CHARACTER_MAXIMUM_LENGTH", "NUMERIC_PRECISION", "NUMERIC_SCALE", "COLUMN_DEFAULT", "COLUMN_COMMENT"}).
+				AddRow("pipeline", "Test.Products", "ID", "int(10)", "NO", nil, 10, 0, nil, ""))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.STATISTICS")).
+			WillReturnRows(sqlmock.NewRows([]string{"TABLE_SCHEMA", "TABLE_NAME", "INDEX_NAME", "COLUMN_NAME"}).
+				AddRow("pipeline", "Test.Products", "PRIMARY", "ID"))
+
+		_, err = sut.getKnownShapes()
+		So(err, ShouldBeNil)
+
+		Convey("When History is set", func() {
+			err = sut.checkHistory()
+
+			Convey("Then Init should fail", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "History is set, but the tables of Test.Products were created without it")
+			})
+		})
+	})
+
+	Convey("Versions should be valid from increasing times", t, func() {
+		first := versionTime()
+		So(versionTime().After(first), ShouldBeTrue)
+	})
+}
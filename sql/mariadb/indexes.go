@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// indexSettings declares a secondary index of the table of a shape.
+type indexSettings struct {
+	// Name is the name of the index (default ix_ and the columns joined by _).
+	Name string
+	// Columns are the properties the index is on, in order. A property can
+	// have a prefix length, e.g. Name(100), which text columns need.
+	Columns []string
+	// Unique makes the index unique.
+	Unique bool
+}
+
+// indexColumnPattern matches a column of an index with a prefix length.
+var indexColumnPattern = regexp.MustCompile(`^(.+)\((\d+)\)$`)
+
+// parseIndexColumn returns the property of a column of an index,
+// and its prefix length, or "" if it has none.
+func parseIndexColumn(column string) (string, string) {
+	if match := indexColumnPattern.FindStringSubmatch(column); match != nil {
+		return match[1], match[2]
+	}
+	return column, ""
+}
+
+func (s indexSettings) name() string {
+	if s.Name != "" {
+		return escapeString(s.Name)
+	}
+
+	names := []string{}
+	for _, c := range s.Columns {
+		p, _ := parseIndexColumn(c)
+		names = append(names, p)
+	}
+
+	return escapeString("ix_" + strings.Join(names, "_"))
+}
+
+// validateIndexes checks the indexes in the settings.
+func validateIndexes(s *settings) error {
+	for shape, indexes := range s.Indexes {
+		for _, index := range indexes {
+			if len(index.Columns) == 0 {
+				return fmt.Errorf("an index of %s has no columns", shape)
+			}
+			if len(index.name()) > 64 {
+				return fmt.Errorf("the name of index %s of %s is longer than 64 characters", index.name(), shape)
+			}
+			// Every version of a row has the same keys.
+			if index.Unique && s.History {
+				return errors.New("unique indexes can't be used with History")
+			}
+		}
+	}
+	return nil
+}
+
+// hasUniqueIndexes reports whether a unique index is declared in the settings.
+func (s *settings) hasUniqueIndexes() bool {
+	for _, indexes := range s.Indexes {
+		for _, index := range indexes {
+			if index.Unique {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type sqlIndexModel struct {
+	Name    string
+	Columns string // The columns of the index, rendered
+	Unique  bool
+}
+
+// indexModels returns the models of the declared indexes which are not in existing
+// and whose properties are all in properties, so that the table has their columns.
+func indexModels(declared []indexSettings, properties map[string]bool, existing map[string]bool) []sqlIndexModel {
+
+	var models []sqlIndexModel
+
+	for _, index := range declared {
+		name := index.name()
+		if existing[name] {
+			continue
+		}
+
+		columns := []string{}
+		for _, c := range index.Columns {
+			p, prefix := parseIndexColumn(c)
+			if !properties[p] {
+				break
+			}
+			column := "`" + escapeString(p) + "`"
+			if prefix != "" {
+				column += "(" + prefix + ")"
+			}
+			columns = append(columns, column)
+		}
+
+		if len(columns) == len(index.Columns) {
+			models = append(models, sqlIndexModel{Name: name, Columns: strings.Join(columns, ", "), Unique: index.Unique})
+		}
+	}
+
+	return models
+}
+
+// newTableIndexes returns the models of the declared indexes of a
+// new table which are created with it.
+func newTableIndexes(shapeName string, properties map[string]string, options tableOptions) []sqlIndexModel {
+
+	names := map[string]bool{}
+	for p := range properties {
+		names[p] = true
+	}
+
+	return indexModels(options.Indexes[shapeName], names, nil)
+}
+
+const addIndexesTemplateText = `ALTER TABLE {{tick .Name}}{{range $i, $e := .Indexes}}
+	{{if $i}},{{end}}ADD {{if $e.Unique}}UNIQUE {{end}}INDEX IF NOT EXISTS {{tick $e.Name}} ({{$e.Columns}}){{end}};`
+
+// createAddIndexesSQL renders the statement adding indexes to the table of a shape.
+func createAddIndexesSQL(shapeName string, indexes []sqlIndexModel, options tableOptions) (string, error) {
+
+	model := sqlTableModel{
+		Name:    options.table(shapeName),
+		Indexes: indexes,
+	}
+
+	w := &bytes.Buffer{}
+	err := addIndexesTemplate.Execute(w, model)
+
+	return w.String(), err
+}
+
+// recordIndexes records that the table of a shape has the indexes.
+func (h *mariaSubscriber) recordIndexes(shapeName string, indexes []sqlIndexModel) {
+
+	h.indexMu.Lock()
+	defer h.indexMu.Unlock()
+
+	if h.indexes == nil {
+		h.indexes = map[string]map[string]bool{}
+	}
+
+	if h.indexes[shapeName] == nil {
+		h.indexes[shapeName] = map[string]bool{}
+	}
+	for _, index := range indexes {
+		h.indexes[shapeName][index.Name] = true
+	}
+}
+
+// ensureIndexes adds the declared indexes of a shape which its table doesn't have,
+// as soon as the table has their columns.
+func (h *mariaSubscriber) ensureIndexes(shapeName string, properties []pipeline.PropertyDefinition) error {
+
+	declared := h.settings.Indexes[shapeName]
+	if len(declared) == 0 {
+		return nil
+	}
+
+	names := map[string]bool{}
+	for _, p := range properties {
+		names[p.Name] = true
+	}
+
+	h.indexMu.Lock()
+	indexes := indexModels(declared, names, h.indexes[shapeName])
+	h.indexMu.Unlock()
+
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	sqlCommand, err := createAddIndexesSQL(shapeName, indexes, h.tableOptions())
+	if err != nil {
+		return err
+	}
+
+	err = h.execDDL(shapeName, sqlCommand)
+	if err != nil {
+		return fmt.Errorf("couldn't add indexes to %s: %s", shapeName, err)
+	}
+
+	logrus.Infof("Added %d indexes to %s", len(indexes), shapeName)
+
+	h.recordIndexes(shapeName, indexes)
+
+	return nil
+}
+
+// addIndexes adds the declared indexes which the tables
+// discovered in the database don't have.
+func (h *mariaSubscriber) addIndexes() error {
+
+	for _, shape := range h.knownShapes.GetAllShapeDefinitions() {
+
+		h.indexMu.Lock()
+		_, discovered := h.indexes[shape.Name]
+		h.indexMu.Unlock()
+
+		if !discovered {
+			continue
+		}
+
+		err := h.ensureIndexes(shape.Name, shape.Properties)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// countCollisionsTemplateText counts the rows whose values in a unique index are
+// the values of rows with other keys. The values of the rows are selected as a
+// derived table, with the columns of the index as u0, u1, ... and the keys as k0, k1, ...
+const countCollisionsTemplateText = `SELECT COUNT(*) FROM {{tick .Name}} AS t
+	JOIN ({{range $r, $_ := .Rows}}{{if $r}}
+		UNION ALL {{end}}SELECT {{range $i, $e := $.Columns}}{{if $i}}, {{end}}? AS {{tick (printf "u%d" $i)}}{{end}}{{range $i, $e := $.Keys}}, ? AS {{tick (printf "k%d" $i)}}{{end}}{{end}}) AS r
+	ON {{range $i, $e := .Columns}}{{if $i}} AND {{end}}{{if $e.Prefix}}LEFT(t.{{tick $e.Name}}, {{$e.Prefix}}) = LEFT(r.{{tick (printf "u%d" $i)}}, {{$e.Prefix}}){{else}}t.{{tick $e.Name}} = r.{{tick (printf "u%d" $i)}}{{end}}{{end}}
+	WHERE NOT ({{range $i, $e := .Keys}}{{if $i}} AND {{end}}t.{{tick $e}} <=> r.{{tick (printf "k%d" $i)}}{{end}});`
+
+type sqlIndexColumnModel struct {
+	Name     string
+	Property string
+	Prefix   string // The prefix length of the column in the index, if any
+}
+
+type sqlCollisionsModel struct {
+	Name    string
+	Columns []sqlIndexColumnModel // The columns of the unique index
+	Keys    []string              // The key columns
+	Rows    []struct{}
+}
+
+// uniqueIndexColumns returns the columns of the declared unique indexes
+// of a shape whose properties are all in the shape.
+func uniqueIndexColumns(declared []indexSettings, knownShape *shapeutils.KnownShape) map[string][]sqlIndexColumnModel {
+
+	properties := map[string]bool{}
+	for _, p := range knownShape.Properties {
+		properties[p.Name] = true
+	}
+
+	indexes := map[string][]sqlIndexColumnModel{}
+
+	for _, index := range declared {
+		if !index.Unique {
+			continue
+		}
+
+		var columns []sqlIndexColumnModel
+		for _, c := range index.Columns {
+			p, prefix := parseIndexColumn(c)
+			if !properties[p] {
+				break
+			}
+			columns = append(columns, sqlIndexColumnModel{Name: escapeString(p), Property: p, Prefix: prefix})
+		}
+
+		if len(columns) == len(index.Columns) {
+			indexes[index.name()] = columns
+		}
+	}
+
+	return indexes
+}
+
+// indexValue returns the value of a column of an index,
+// cut to the prefix length of the column.
+func indexValue(c sqlIndexColumnModel, dp pipeline.DataPoint) interface{} {
+
+	v := dp.Data[c.Property]
+	if s, ok := v.(string); ok && c.Prefix != "" {
+		n, _ := strconv.Atoi(c.Prefix)
+		if r := []rune(s); len(r) > n {
+			return string(r[:n])
+		}
+	}
+
+	return v
+}
+
+// createCountCollisionsSQL renders the query counting the data points whose values in
+// the unique index with columns collide with rows with other keys. It returns an empty
+// string if none of the data points has values for all the columns, because nulls
+// don't collide.
+func createCountCollisionsSQL(dataPoints []pipeline.DataPoint, knownShape *shapeutils.KnownShape, columns []sqlIndexColumnModel, options tableOptions) (sql string, params []interface{}, err error) {
+
+	model := sqlCollisionsModel{
+		Name:    options.table(knownShape.Name),
+		Columns: columns,
+	}
+
+	keys := newUpsertModel(knownShape, 0, nil, options).KeyColumns()
+	for _, k := range keys {
+		model.Keys = append(model.Keys, k.Name)
+	}
+
+rows:
+	for _, dp := range dataPoints {
+		values := []interface{}{}
+		for _, c := range columns {
+			v := indexValue(c, dp)
+			if v == nil {
+				continue rows
+			}
+			values = append(values, v)
+		}
+		for _, k := range keys {
+			values = append(values, dp.Data[k.Property])
+		}
+
+		model.Rows = append(model.Rows, struct{}{})
+		params = append(params, values...)
+	}
+
+	if len(model.Rows) == 0 {
+		return
+	}
+
+	w := &bytes.Buffer{}
+	err = countCollisionsTemplate.Execute(w, model)
+	if err != nil {
+		return
+	}
+
+	sql = w.String()
+
+	return
+}
+
+// checkUniqueIndexes returns a constraint violation if the values of a data point
+// in a unique index of its table are the values of a row with other keys, or of
+// another of the data points, because the upsert would update that row instead.
+func (h *mariaSubscriber) checkUniqueIndexes(knownShape *shapeutils.KnownShape, dataPoints []pipeline.DataPoint) error {
+
+	declared := h.settings.Indexes[knownShape.Name]
+	if len(declared) == 0 || h.planning() {
+		return nil
+	}
+
+	// Without keys every row is inserted, and a collision fails the insert.
+	keys := newUpsertModel(knownShape, 0, nil, tableOptions{}).KeyColumns()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	for name, columns := range uniqueIndexColumns(declared, knownShape) {
+
+		// The rows of the data points aren't in the table yet,
+		// so their collisions with each other are found here.
+		seen := map[string]string{}
+	rows:
+		for _, dp := range dataPoints {
+			values := []interface{}{}
+			for _, c := range columns {
+				v := indexValue(c, dp)
+				if v == nil {
+					continue rows
+				}
+				values = append(values, v)
+			}
+			keyValues := []interface{}{}
+			for _, k := range keys {
+				keyValues = append(keyValues, dp.Data[k.Property])
+			}
+
+			unique, _ := json.Marshal(values)
+			key, _ := json.Marshal(keyValues)
+			if other, ok := seen[string(unique)]; ok && other != string(key) {
+				return &writeError{Class: errorConstraint, Err: fmt.Errorf("rows of %s with the keys %s and %s have the same values in the unique index %s", knownShape.Name, other, key, name)}
+			}
+			seen[string(unique)] = string(key)
+		}
+
+		query, params, err := createCountCollisionsSQL(dataPoints, knownShape, columns, h.tableOptions())
+		if err != nil {
+			return err
+		}
+		if query == "" {
+			continue
+		}
+
+		var collisions int
+		err = h.queryRow(query, params, &collisions)
+		if err != nil {
+			return classifyError(err)
+		}
+
+		if collisions > 0 {
+			return &writeError{Class: errorConstraint, Err: fmt.Errorf("the values in the unique index %s of %s are already in a row of %s with other keys", name, knownShape.Name, h.tableOptions().table(knownShape.Name))}
+		}
+	}
+
+	return nil
+}
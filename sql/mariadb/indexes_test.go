@@ -0,0 +1,162 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestIndexes(t *testing.T) {
+
+	declared := []indexSettings{
+		{Columns: []string{"Name(100)"}},
+		{Name: "ux_sku", Columns: []string{"Region", "SKU"}, Unique: true},
+	}
+	options := tableOptions{Indexes: map[string][]indexSettings{"test": declared}}
+
+	Convey("Given a new shape with declared indexes", t, func() {
+		shape := shapeutils.ShapeDelta{
+			IsNew:   true,
+			Name:    "test",
+			NewKeys: []string{"id"},
+			NewProperties: map[string]string{
+				"id":     "integer",
+				"Name":   "string",
+				"Region": "string",
+				"SKU":    "string",
+			},
+		}
+
+		actual, err := createShapeChangeSQL(shape, nil, options)
+
+		Convey("Then the indexes should be created with the table", func() {
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`CREATE TABLE IF NOT EXISTS "test" (
+	"Name" VARCHAR(1000) NULL,
+	"Region" VARCHAR(1000) NULL,
+	"SKU" VARCHAR(1000) NULL,
+	"id" INT(10) NOT NULL,
+	PRIMARY KEY ("id"),
+	INDEX "ix_Name" ("Name"(100)),
+	UNIQUE INDEX "ux_sku" ("Region", "SKU")
+)`))
+		})
+	})
+
+	Convey("Indexes should only be added when the table has their columns and doesn't have them", t, func() {
+		models := indexModels(declared, map[string]bool{"Name": true, "SKU": true}, nil)
+		So(models, ShouldResemble, []sqlIndexModel{{Name: "ix_Name", Columns: "`Name`(100)"}})
+
+		models = indexModels(declared, map[string]bool{"Name": true, "Region": true, "SKU": true}, map[string]bool{"ix_Name": true})
+		So(models, ShouldResemble, []sqlIndexModel{{Name: "ux_sku", Columns: "`Region`, `SKU`", Unique: true}})
+
+		actual, err := createAddIndexesSQL("test", models, tableOptions{})
+		So(err, ShouldBeNil)
+		So(actual, ShouldEqual, e(`ALTER TABLE "test"
+	ADD UNIQUE INDEX IF NOT EXISTS "ux_sku" ("Region", "SKU");`))
+	})
+
+	Convey("Given a subscriber with declared indexes", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		sut := &mariaSubscriber{
+			db:       db,
+			settings: &settings{Indexes: options.Indexes, Schema: schemaApply},
+		}
+
+		Convey("When a table which has some of them gets the columns of the others", func() {
+			sut.recordIndexes("test", []sqlIndexModel{{Name: "PRIMARY"}, {Name: "ix_Name"}})
+
+			mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE `test`\n\tADD UNIQUE INDEX IF NOT EXISTS `ux_sku`")).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+
+			err := sut.ensureIndexes("test", []pipeline.PropertyDefinition{{Name: "Name"}, {Name: "Region"}, {Name: "SKU"}})
+
+			Convey("Then only the missing indexes should be added", func() {
+				So(err, ShouldBeNil)
+				So(sut.indexes["test"], ShouldContainKey, "ux_sku")
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Invalid indexes should be rejected", t, func() {
+		So(validateIndexes(&settings{Indexes: map[string][]indexSettings{"test": {{Name: "ix"}}}}), ShouldNotBeNil)
+		So(validateIndexes(&settings{History: true, Indexes: options.Indexes}), ShouldNotBeNil)
+		So(validateIndexes(&settings{Indexes: options.Indexes}), ShouldBeNil)
+	})
+
+	Convey("Given a subscriber with a unique index", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		sut := &mariaSubscriber{
+			db: db,
+			settings: &settings{Schema: schemaApply, Indexes: map[string][]indexSettings{
+				"Test.Products": {{Name: "ux_sku", Columns: []string{"SKU(20)"}, Unique: true}},
+			}},
+		}
+
+		dp := func(id int, sku interface{}) pipeline.DataPoint {
+			return pipeline.DataPoint{
+				Source: "Test",
+				Entity: "Products",
+				Shape:  pipeline.Shape{KeyNames: []string{"id"}, Properties: []string{"id:integer", "SKU:string"}},
+				Data:   map[string]interface{}{"id": id, "SKU": sku},
+			}
+		}
+		shape := shapeutils.NewKnownShape(dp(1, "A-1"))
+
+		Convey("When a row with the values of a row with another key is written", func() {
+			mock.ExpectQuery(regexp.QuoteMeta(e(`SELECT COUNT(*) FROM "Test.Products" AS t
+	JOIN (SELECT ? AS "u0", ? AS "k0") AS r
+	ON LEFT(t."SKU", 20) = LEFT(r."u0", 20)
+	WHERE NOT (t."id" <=> r."k0");`))).
+				WithArgs("A-1", 1).
+				WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+			err := sut.writeRow(shape, dp(1, "A-1"))
+
+			Convey("Then it should be rejected as a constraint violation without being upserted", func() {
+				So(err, ShouldNotBeNil)
+				So(classifyError(err).Class, ShouldEqual, errorConstraint)
+				So(err.Error(), ShouldContainSubstring, "ux_sku")
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+
+		Convey("When rows with other keys have the same values in one batch", func() {
+			err := sut.checkUniqueIndexes(shape, []pipeline.DataPoint{dp(1, "A-1"), dp(2, nil), dp(3, "A-1")})
+
+			Convey("Then the collision should be found without querying the table", func() {
+				So(err, ShouldNotBeNil)
+				So(classifyError(err).Class, ShouldEqual, errorConstraint)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+
+		Convey("When the rows only have null values in the index", func() {
+			err := sut.checkUniqueIndexes(shape, []pipeline.DataPoint{dp(1, nil), dp(2, nil)})
+
+			Convey("Then they should not collide", func() {
+				So(err, ShouldBeNil)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// heldTable keeps the data points which are held for type inference. They are
+// written to it in the transaction the rows are written in, so they are committed
+// along with the rows, and the ones which were not written are loaded back at Init.
+const heldTable = "_naveego_held"
+
+const createHeldTableSQL = "CREATE TABLE IF NOT EXISTS `" + heldTable + "` (\n" +
+	"\t`id` BIGINT NOT NULL AUTO_INCREMENT,\n" +
+	"\t`shape_name` VARCHAR(255) NOT NULL,\n" +
+	"\t`data_point` LONGTEXT NOT NULL,\n" +
+	"\tPRIMARY KEY (`id`),\n" +
+	"\tINDEX `ix_shape_name` (`shape_name`)\n" +
+	")"
+
+// inferTypes samples dataPoint and returns the data points which can be
+// written now, with their inferred types applied. Data points of a shape
+// which doesn't have a table yet are held until the inferrer is ready,
+// so that the table is created with the inferred types. The values of a
+// shape which has a table are not sampled, the data points get the types
+// of its columns.
+func (h *mariaSubscriber) inferTypes(dataPoint pipeline.DataPoint) ([]pipeline.DataPoint, error) {
+
+	name := shapeutils.CanonicalName(dataPoint)
+
+	h.heldMu.Lock()
+	defer h.heldMu.Unlock()
+
+	known := h.knownShapes.Knows(name)
+	if !known {
+		h.inferrer.Observe(dataPoint)
+
+		if !h.inferrer.Ready(dataPoint) {
+			err := h.hold(name, dataPoint)
+			if err != nil {
+				return nil, err
+			}
+			h.held[name] = append(h.held[name], dataPoint)
+			return nil, nil
+		}
+	}
+
+	dataPoints := append(h.held[name], dataPoint)
+	delete(h.held, name)
+
+	for i, dp := range dataPoints {
+		dataPoints[i] = h.applyTypes(dp, known)
+	}
+
+	return dataPoints, nil
+}
+
+// applyTypes applies the types of the columns of the table of a known shape
+// to a data point, or the types the inferrer committed for a new one.
+func (h *mariaSubscriber) applyTypes(dataPoint pipeline.DataPoint, known bool) pipeline.DataPoint {
+	if known {
+		return h.knownShapes.ApplyTypes(dataPoint)
+	}
+	return h.inferrer.Apply(dataPoint)
+}
+
+// hold writes a data point to the held table. Nothing is written in plan mode.
+func (h *mariaSubscriber) hold(shapeName string, dataPoint pipeline.DataPoint) error {
+
+	if h.planning() {
+		return nil
+	}
+
+	data, err := json.Marshal(dataPoint)
+	if err != nil {
+		return err
+	}
+
+	return h.exec(0, "INSERT INTO `"+heldTable+"` (`shape_name`, `data_point`) VALUES (?, ?)", shapeName, string(data))
+}
+
+// forgetHeld deletes the held data points of a shape, once they have been written.
+func (h *mariaSubscriber) forgetHeld(shapeName string) error {
+
+	if h.planning() {
+		return nil
+	}
+
+	return h.exec(0, "DELETE FROM `"+heldTable+"` WHERE `shape_name` = ?", shapeName)
+}
+
+// loadHeld creates the held table, and holds the data points in it
+// again, which were held but not written when the subscriber stopped.
+func (h *mariaSubscriber) loadHeld() error {
+
+	if h.inferrer == nil || h.planning() {
+		return nil
+	}
+
+	err := h.execDDL(heldTable, createHeldTableSQL)
+	if err != nil {
+		return fmt.Errorf("couldn't create the table of held data points: %s", err)
+	}
+
+	rows, err := h.db.Query("SELECT `shape_name`, `data_point` FROM `" + heldTable + "` ORDER BY `id`")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	h.heldMu.Lock()
+	defer h.heldMu.Unlock()
+
+	for rows.Next() {
+		var (
+			name      string
+			data      string
+			dataPoint pipeline.DataPoint
+		)
+		err = rows.Scan(&name, &data)
+		if err != nil {
+			return err
+		}
+
+		err = json.Unmarshal([]byte(data), &dataPoint)
+		if err != nil {
+			return fmt.Errorf("couldn't read a held data point of %s: %s", name, err)
+		}
+
+		if !h.knownShapes.Knows(name) {
+			h.inferrer.Observe(dataPoint)
+		}
+		h.held[name] = append(h.held[name], dataPoint)
+	}
+
+	return rows.Err()
+}
+
+// releaseHeld writes all the held data points, using whatever
+// types have been inferred so far.
+func (h *mariaSubscriber) releaseHeld() error {
+
+	if h.inferrer == nil {
+		return nil
+	}
+
+	h.heldMu.Lock()
+	held := h.held
+	h.held = map[string][]pipeline.DataPoint{}
+	h.heldMu.Unlock()
+
+	for name, dataPoints := range held {
+		known := h.knownShapes.Knows(name)
+		for _, dp := range dataPoints {
+			dp = h.applyTypes(dp, known)
+			err := h.receive(dp)
+			if err != nil && h.reject(dp, err) != nil {
+				return err
+			}
+		}
+
+		err := h.forgetHeld(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestInference(t *testing.T) {
+
+	dp := func(id, price interface{}) pipeline.DataPoint {
+		return pipeline.DataPoint{
+			Source: "Test",
+			Entity: "Products",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"id"},
+				Properties: []string{"id:integer", "price:string"},
+			},
+			Data: map[string]interface{}{"id": id, "price": price},
+		}
+	}
+
+	Convey("Given a subscriber which infers types", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		s := &settings{Retries: 3, OnError: onErrorFail, InferTypes: true}
+		types, err := newTypeMapper(s)
+		So(err, ShouldBeNil)
+
+		sut := &mariaSubscriber{
+			db:          db,
+			settings:    s,
+			types:       types,
+			knownShapes: shapeutils.NewShapeCache(),
+			inferrer:    shapeutils.NewTypeInferrer(2, 10),
+			held:        map[string][]pipeline.DataPoint{},
+		}
+
+		Convey("When a data point of a new shape is received", func() {
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `_naveego_held` (`shape_name`, `data_point`) VALUES (?, ?)")).
+				WithArgs("Test.Products", sqlmock.AnyArg()).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			dataPoints, err := sut.inferTypes(dp(1, 1.5))
+
+			Convey("Then it should be kept in the held table", func() {
+				So(err, ShouldBeNil)
+				So(dataPoints, ShouldBeEmpty)
+				So(sut.held["Test.Products"], ShouldHaveLength, 1)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+
+			Convey("When enough values have been sampled", func() {
+				dataPoints, err = sut.inferTypes(dp(2, 2.5))
+
+				Convey("Then the held data points should be released with the inferred types", func() {
+					So(err, ShouldBeNil)
+					So(dataPoints, ShouldHaveLength, 2)
+					So(dataPoints[0].Shape.Properties, ShouldResemble, []string{"id:integer", "price:float"})
+					So(dataPoints[1].Data["id"], ShouldEqual, 2)
+					So(sut.held, ShouldBeEmpty)
+				})
+			})
+
+			Convey("When the held data points are written at Dispose", func() {
+				mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS `Test.Products`")).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `Test.Products`")).WillReturnResult(sqlmock.NewResult(1, 1))
+				mock.ExpectExec(regexp.QuoteMeta("DELETE FROM `_naveego_held` WHERE `shape_name` = ?")).
+					WithArgs("Test.Products").
+					WillReturnResult(sqlmock.NewResult(0, 1))
+
+				err = sut.releaseHeld()
+
+				Convey("Then they should be deleted from the held table", func() {
+					So(err, ShouldBeNil)
+					So(mock.ExpectationsWereMet(), ShouldBeNil)
+				})
+			})
+		})
+
+		Convey("When a data point of a shape with a table is received", func() {
+			shape, _ := sut.knownShapes.Analyze(pipeline.DataPoint{
+				Source: "Test",
+				Entity: "Products",
+				Shape:  pipeline.Shape{KeyNames: []string{"id"}, Properties: []string{"id:integer", "price:float"}},
+			})
+			sut.knownShapes.Remember(shape)
+
+			dataPoints, err := sut.inferTypes(dp(1, "1.5"))
+
+			Convey("Then it should get the types of the columns without being sampled", func() {
+				So(err, ShouldBeNil)
+				So(dataPoints, ShouldHaveLength, 1)
+				So(dataPoints[0].Shape.Properties, ShouldResemble, []string{"id:integer", "price:float"})
+				_, sampled := sut.inferrer.Proposal(dp(nil, nil), "price")
+				So(sampled, ShouldBeFalse)
+			})
+		})
+
+		Convey("When the held table has data points which were not written", func() {
+			data, _ := json.Marshal(dp(1.0, 1.5))
+
+			mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS `_naveego_held`")).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT `shape_name`, `data_point` FROM `_naveego_held` ORDER BY `id`")).
+				WillReturnRows(sqlmock.NewRows([]string{"shape_name", "data_point"}).AddRow("Test.Products", string(data)))
+
+			err = sut.loadHeld()
+
+			Convey("Then they should be held and sampled again", func() {
+				So(err, ShouldBeNil)
+				So(sut.held["Test.Products"], ShouldHaveLength, 1)
+				So(sut.held["Test.Products"][0].Data["price"], ShouldEqual, 1.5)
+				proposal, _ := sut.inferrer.Proposal(dp(nil, nil), "price")
+				So(proposal.Samples, ShouldEqual, 1)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+	})
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// Strategies for changes to the keys of existing tables.
+const (
+	// keyChangesAlter replaces the primary key of the table in place.
+	keyChangesAlter = "alter"
+	// keyChangesRebuild copies the rows into a shadow table with the new
+	// primary key, and swaps it with the table with an atomic RENAME TABLE.
+	keyChangesRebuild = "rebuild"
+)
+
+// The tables of a rebuild are excluded from the shapes discovered in the database.
+const (
+	shadowTablePrefix = "_naveego_shadow_"
+	oldTablePrefix    = "_naveego_old_"
+)
+
+// countDuplicatesTemplateText counts the sets of rows which have the same values of
+// the new keys, and the rows in them. Only the key columns the table already has are
+// grouped by, because the rows all get the same value of the columns which are added.
+const countDuplicatesTemplateText = `SELECT COUNT(*), COALESCE(SUM(d.n), 0) FROM (SELECT COUNT(*) AS n FROM {{tick .Name}}{{if .Keys}}
+	GROUP BY {{jointick .Keys}}{{end}}
+	HAVING COUNT(*) > 1) AS d;`
+
+// shadowKeysTemplateText replaces the primary key of the shadow table.
+const shadowKeysTemplateText = `ALTER TABLE {{tick .Shadow}}{{if .HadKeys}}
+	DROP PRIMARY KEY
+	,{{else}}
+	{{end}}ADD PRIMARY KEY ({{jointick .Keys}}{{if .History}}, {{tick "_valid_from"}}{{end}}){{if .History}}
+	,DROP INDEX IF EXISTS {{tick "ix_current"}}
+	,ADD INDEX {{tick "ix_current"}} ({{jointick .Keys}}, {{tick "_is_current"}}){{end}};`
+
+type sqlRebuildModel struct {
+	Name    string
+	Shadow  string // The table with the new keys the rows are copied into
+	Old     string // The name of the table after it was swapped with the shadow table
+	Keys    []string
+	HadKeys bool // Whether the table had a primary key
+	History bool
+}
+
+// createCountDuplicatesSQL renders the query counting the rows of the table of a shape
+// which would have the same values of its new keys.
+func createCountDuplicatesSQL(shapeInfo shapeutils.ShapeDelta, options tableOptions) (string, error) {
+
+	model := sqlTableModel{
+		Name: options.table(shapeInfo.Name),
+	}
+	for _, k := range append(shapeInfo.NewKeys, shapeInfo.ExistingKeys...) {
+		if _, added := shapeInfo.NewProperties[k]; !added {
+			model.Keys = append(model.Keys, escapeString(k))
+		}
+	}
+	// Versions of a row only differ in the start of the version.
+	if options.History {
+		model.Keys = append(model.Keys, "_valid_from")
+	}
+
+	w := &bytes.Buffer{}
+	err := countDuplicatesTemplate.Execute(w, model)
+
+	return w.String(), err
+}
+
+// createRebuildKeysSQL renders the statements which change the keys of the table
+// of a shape by rebuilding it. The table must already have the columns of the keys.
+func createRebuildKeysSQL(shapeInfo shapeutils.ShapeDelta, options tableOptions) ([]string, error) {
+
+	table := options.table(shapeInfo.Name)
+	database, name := splitTableName(table)
+
+	model := sqlRebuildModel{
+		Name:    table,
+		Shadow:  options.Naming.prefixed(shadowTablePrefix, name),
+		Old:     options.Naming.prefixed(oldTablePrefix, name),
+		HadKeys: len(shapeInfo.ExistingKeys) > 0,
+		History: options.History,
+	}
+	if database != "" {
+		model.Shadow = qualifyTableName(database, model.Shadow)
+		model.Old = qualifyTableName(database, model.Old)
+	}
+	for _, k := range append(shapeInfo.NewKeys, shapeInfo.ExistingKeys...) {
+		model.Keys = append(model.Keys, escapeString(k))
+	}
+
+	w := &bytes.Buffer{}
+	err := shadowKeysTemplate.Execute(w, model)
+	if err != nil {
+		return nil, err
+	}
+
+	return []string{
+		// A shadow table may be left over from a rebuild which failed.
+		fmt.Sprintf(dropTableSQL, model.Shadow),
+		fmt.Sprintf("CREATE TABLE `%s` LIKE `%s`;", model.Shadow, model.Name),
+		w.String(),
+		fmt.Sprintf("INSERT INTO `%s` SELECT * FROM `%s`;", model.Shadow, model.Name),
+		fmt.Sprintf("RENAME TABLE `%s` TO `%s`, `%s` TO `%s`;", model.Name, model.Old, model.Shadow, model.Name),
+		fmt.Sprintf("DROP TABLE `%s`;", model.Old),
+	}, nil
+}
+
+// checkKeys returns an error if the rows of the table of a shape would
+// have the same values of its new keys, before the keys are changed.
+func (h *mariaSubscriber) checkKeys(shapeDelta shapeutils.ShapeDelta) error {
+
+	query, err := createCountDuplicatesSQL(shapeDelta, h.tableOptions())
+	if err != nil {
+		return err
+	}
+
+	var duplicates, rows int
+	err = h.queryRow(query, nil, &duplicates, &rows)
+	if err != nil {
+		return fmt.Errorf("couldn't check the new keys of %s: %s", shapeDelta.Name, err)
+	}
+
+	if duplicates > 0 {
+		return fmt.Errorf("can't change the keys of %s to %v, because %d rows of its table have the same values of them in %d sets of duplicates",
+			shapeDelta.Name, append(shapeDelta.NewKeys, shapeDelta.ExistingKeys...), rows, duplicates)
+	}
+
+	return nil
+}
+
+// rebuildKeys changes the keys of the table of a shape by copying its rows into
+// a shadow table with the new keys, which then replaces the table. The table
+// isn't changed if any of the statements before the swap fails.
+func (h *mariaSubscriber) rebuildKeys(shapeDelta shapeutils.ShapeDelta) error {
+
+	statements, err := createRebuildKeysSQL(shapeDelta, h.tableOptions())
+	if err != nil {
+		return err
+	}
+
+	for _, statement := range statements {
+		err = h.execDDL(shapeDelta.Name, statement)
+		if err != nil {
+			return fmt.Errorf("couldn't rebuild %s with its new keys: %s", shapeDelta.Name, err)
+		}
+	}
+
+	logrus.Infof("Rebuilt %s with the keys %v", shapeDelta.Name, append(shapeDelta.NewKeys, shapeDelta.ExistingKeys...))
+
+	return nil
+}
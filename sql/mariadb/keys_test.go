@@ -0,0 +1,118 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestKeyChanges(t *testing.T) {
+
+	Convey("Given a shape whose keys have changed", t, func() {
+
+		shape := shapeutils.ShapeDelta{
+			Name:             "test",
+			HasKeyChanges:    true,
+			HasNewProperties: true,
+			NewKeys:          []string{"region", "sku"},
+			ExistingKeys:     []string{"id"},
+			NewProperties:    map[string]string{"region": "string"},
+		}
+
+		Convey("When we generate the SQL counting duplicates", func() {
+			actual, err := createCountDuplicatesSQL(shape, tableOptions{})
+
+			Convey("Then only the keys the table already has should be grouped by", func() {
+				So(err, ShouldBeNil)
+				So(actual, ShouldEqual, e(`SELECT COUNT(*), COALESCE(SUM(d.n), 0) FROM (SELECT COUNT(*) AS n FROM "test"
+	GROUP BY "sku", "id"
+	HAVING COUNT(*) > 1) AS d;`))
+			})
+		})
+
+		Convey("When we generate the SQL rebuilding the table", func() {
+			actual, err := createRebuildKeysSQL(shape, tableOptions{})
+
+			Convey("Then the rows should be copied into a shadow table with the new keys which replaces the table", func() {
+				So(err, ShouldBeNil)
+				So(actual, ShouldResemble, []string{
+					e(`DROP TABLE IF EXISTS "_naveego_shadow_test";`),
+					e(`CREATE TABLE "_naveego_shadow_test" LIKE "test";`),
+					e(`ALTER TABLE "_naveego_shadow_test"
+	DROP PRIMARY KEY
+	,ADD PRIMARY KEY ("region", "sku", "id");`),
+					e(`INSERT INTO "_naveego_shadow_test" SELECT * FROM "test";`),
+					e(`RENAME TABLE "test" TO "_naveego_old_test", "_naveego_shadow_test" TO "test";`),
+					e(`DROP TABLE "_naveego_old_test";`),
+				})
+			})
+		})
+
+		Convey("When the table had no keys", func() {
+			shape.ExistingKeys = nil
+			actual, err := createRebuildKeysSQL(shape, tableOptions{})
+
+			Convey("Then no primary key should be dropped", func() {
+				So(err, ShouldBeNil)
+				So(actual[2], ShouldEqual, e(`ALTER TABLE "_naveego_shadow_test"
+	ADD PRIMARY KEY ("region", "sku");`))
+			})
+		})
+
+		Convey("When the subscriber applies it", func() {
+
+			db, mock, err := sqlmock.New()
+			So(err, ShouldBeNil)
+
+			Reset(func() {
+				db.Close()
+			})
+
+			sut := &mariaSubscriber{
+				db:       db,
+				settings: &settings{Retries: 3, OnError: onErrorFail},
+			}
+			knownShape := &shapeutils.KnownShape{}
+
+			countDuplicates := func(duplicates, rows int) {
+				mock.ExpectQuery(regexp.QuoteMeta("GROUP BY `sku`, `id`")).
+					WillReturnRows(sqlmock.NewRows([]string{"duplicates", "rows"}).AddRow(duplicates, rows))
+			}
+
+			Convey("When rows would have the same keys", func() {
+				countDuplicates(2, 5)
+
+				err = sut.applyShapeChange(knownShape, shape)
+
+				Convey("Then the table should not be changed", func() {
+					So(err, ShouldNotBeNil)
+					So(err.Error(), ShouldContainSubstring, "5 rows of its table have the same values of them in 2 sets of duplicates")
+					So(mock.ExpectationsWereMet(), ShouldBeNil)
+				})
+			})
+
+			Convey("When the table is rebuilt", func() {
+				sut.settings.KeyChanges = keyChangesRebuild
+
+				countDuplicates(0, 0)
+				mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE `test`\n\tADD COLUMN IF NOT EXISTS `region`")).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(regexp.QuoteMeta("DROP TABLE IF EXISTS `_naveego_shadow_test`")).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE `_naveego_shadow_test` LIKE `test`")).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(regexp.QuoteMeta("ADD PRIMARY KEY")).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `_naveego_shadow_test`")).WillReturnResult(sqlmock.NewResult(0, 3))
+				mock.ExpectExec(regexp.QuoteMeta("RENAME TABLE")).WillReturnResult(sqlmock.NewResult(0, 0))
+				mock.ExpectExec(regexp.QuoteMeta("DROP TABLE `_naveego_old_test`")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+				err = sut.applyShapeChange(knownShape, shape)
+
+				Convey("Then the columns should be added in place and the keys changed on the shadow table", func() {
+					So(err, ShouldBeNil)
+					So(mock.ExpectationsWereMet(), ShouldBeNil)
+				})
+			})
+		})
+	})
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/Sirupsen/logrus"
 	_ "github.com/denisenkom/go-mssqldb"
 	"github.com/naveego/navigator-go/subscribers/server"
+	"github.com/naveego/pipeline-subscribers/deadletter"
 )
 
 var (
@@ -37,6 +38,15 @@ func main() {
 		knownShapes: shapeutils.NewShapeCache(),
 	}
 
+	if deadletter.Replaying() {
+		replayed, err := deadletter.ReplayFromFlags(subscriber)
+		logrus.Infof("Replayed %d data points", replayed)
+		if err != nil {
+			logrus.Fatal("Error replaying dead letters: ", err)
+		}
+		return
+	}
+
 	srv := server.NewSubscriberServer(addr, subscriber)
 
 	err := srv.ListenAndServe()
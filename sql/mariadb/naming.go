@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	tableNameCaseSnake = "snake"
+	tableNameCaseLower = "lower"
+
+	// maxTableNameLength is the longest name MariaDB allows for a table or database.
+	maxTableNameLength = 64
+
+	// shapeCommentPrefix starts the comments of tables whose names are not the names of
+	// their shapes. The rest of the comment is the name of the shape, so that
+	// getKnownShapes can map the table back to it.
+	shapeCommentPrefix = "shape:"
+
+	createDatabaseSQL = "CREATE DATABASE IF NOT EXISTS `%s`"
+)
+
+// tableNamer maps the names of shapes to the names of their tables.
+// Its zero value names the tables like their shapes.
+type tableNamer struct {
+	// Prefix and Suffix are added to the names of the tables.
+	Prefix string
+	Suffix string
+	// Case converts the names of the shapes: "snake" to snake_case, "lower" to lower case.
+	Case string
+	// MaxLength is the longest name of a table (default 64). Longer names are
+	// shortened and end with a hash of the whole name, so that they stay unique.
+	MaxLength int
+	// SourceAsDatabase puts the tables of a source into the database named like
+	// it, so that the names of shapes source.entity map to source.entity tables.
+	SourceAsDatabase bool
+	// DatabaseSeparator ends the prefixes of the names of shapes which name
+	// their databases, like the schema__table names of the MSSQL subscriber.
+	DatabaseSeparator string
+	// Databases maps the names of shapes, or of their sources, to the databases
+	// of their tables. The tables are named like the whole names of the shapes.
+	Databases map[string]string
+}
+
+// newTableNamer returns the tableNamer the settings configure.
+func newTableNamer(s *settings) tableNamer {
+	return tableNamer{
+		Prefix:            s.TablePrefix,
+		Suffix:            s.TableSuffix,
+		Case:              s.TableNameCase,
+		MaxLength:         s.TableNameMaxLength,
+		SourceAsDatabase:  s.SourceAsDatabase,
+		DatabaseSeparator: s.DatabaseSeparator,
+		Databases:         s.Databases,
+	}
+}
+
+// validateTableNaming checks the settings of the tableNamer.
+func validateTableNaming(s *settings) error {
+
+	switch s.TableNameCase {
+	case "", tableNameCaseSnake, tableNameCaseLower:
+	default:
+		return fmt.Errorf("unknown TableNameCase %q", s.TableNameCase)
+	}
+
+	// The hash which ends shortened names takes 9 characters, and the
+	// prefixes of the tables kept next to a table up to 16.
+	if s.TableNameMaxLength != 0 && (s.TableNameMaxLength < 32 || s.TableNameMaxLength > maxTableNameLength) {
+		return fmt.Errorf("TableNameMaxLength must be between 32 and %d, got %d", maxTableNameLength, s.TableNameMaxLength)
+	}
+
+	for name, database := range s.Databases {
+		if database == "" || len(database) > maxTableNameLength {
+			return fmt.Errorf("the database of %s must have a name of 1 to %d characters, got %q", name, maxTableNameLength, database)
+		}
+	}
+
+	return nil
+}
+
+// table returns the escaped name of the table of a shape. If the table is in
+// another database, the name is qualified with it, and renders as
+// `database`.`table` in backticks.
+func (n tableNamer) table(shapeName string) string {
+
+	database, name := n.route(shapeName)
+
+	name = n.shorten(escapeString(n.Prefix + n.convert(name) + n.Suffix))
+	if database == "" {
+		return name
+	}
+
+	return qualifyTableName(n.shorten(escapeString(database)), name)
+}
+
+// route returns the database the table of a shape is in, which is empty for the
+// database of the DataSourceName, and the part of the name of the shape which
+// names the table. Databases mapped to the shape come first, then the databases
+// mapped to its source, the prefix ending in the DatabaseSeparator and the source.
+func (n tableNamer) route(shapeName string) (string, string) {
+
+	if database, ok := n.Databases[shapeName]; ok {
+		return database, shapeName
+	}
+
+	source := ""
+	if i := strings.Index(shapeName, "."); i > 0 {
+		source = shapeName[:i]
+	}
+	if database, ok := n.Databases[source]; ok && source != "" {
+		return database, shapeName
+	}
+
+	if n.DatabaseSeparator != "" {
+		if i := strings.Index(shapeName, n.DatabaseSeparator); i > 0 {
+			return n.convert(shapeName[:i]), shapeName[i+len(n.DatabaseSeparator):]
+		}
+	}
+
+	if n.SourceAsDatabase && source != "" {
+		return n.convert(source), shapeName[len(source)+1:]
+	}
+
+	return "", shapeName
+}
+
+// routes returns whether the tables of some shapes may be in other databases.
+func (n tableNamer) routes() bool {
+	return n.SourceAsDatabase || n.DatabaseSeparator != "" || len(n.Databases) > 0
+}
+
+// mappedDatabases returns the databases in Databases, in order.
+func (n tableNamer) mappedDatabases() []interface{} {
+
+	names := []string{}
+	seen := map[string]bool{}
+	for _, database := range n.Databases {
+		if !seen[database] {
+			seen[database] = true
+			names = append(names, database)
+		}
+	}
+	sort.Strings(names)
+
+	databases := []interface{}{}
+	for _, name := range names {
+		databases = append(databases, name)
+	}
+
+	return databases
+}
+
+// createDatabase creates the database the table of a shape is routed to, if it doesn't exist.
+func (h *mariaSubscriber) createDatabase(shapeName string) error {
+
+	database, _ := splitTableName(h.tableOptions().table(shapeName))
+	if database == "" {
+		return nil
+	}
+
+	return h.execDDL(shapeName, fmt.Sprintf(createDatabaseSQL, database))
+}
+
+// comment returns the comment of the table of a shape, which is empty if
+// the name of the table is the name of the shape.
+func (n tableNamer) comment(shapeName string) string {
+	if n.table(shapeName) == escapeString(shapeName) {
+		return ""
+	}
+	// Backslashes would escape the quote ending the comment.
+	return shapeCommentPrefix + strings.Replace(escapeString(shapeName), `\`, "", -1)
+}
+
+func (n tableNamer) convert(name string) string {
+	switch n.Case {
+	case tableNameCaseSnake:
+		return snakeCase(name)
+	case tableNameCaseLower:
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+func (n tableNamer) shorten(name string) string {
+
+	max := n.MaxLength
+	if max == 0 {
+		max = maxTableNameLength
+	}
+	if len(name) <= max {
+		return name
+	}
+
+	hash := sha1.Sum([]byte(name))
+
+	return name[:max-9] + "_" + hex.EncodeToString(hash[:])[:8]
+}
+
+// prefixed returns the name of a table the subscriber keeps next to a table, like
+// its staging table. Only the name of the table is shortened, so that the tables
+// are still recognized by their prefixes.
+func (n tableNamer) prefixed(prefix, table string) string {
+
+	if n.MaxLength == 0 {
+		n.MaxLength = maxTableNameLength
+	}
+	n.MaxLength -= len(prefix)
+
+	return prefix + n.shorten(table)
+}
+
+var underscores = regexp.MustCompile(`_+`)
+
+// snakeCase converts a name like Test.OrderItems to test_order_items.
+func snakeCase(name string) string {
+
+	runes := []rune(name)
+	b := make([]rune, 0, len(runes)+4)
+
+	for i, r := range runes {
+		switch {
+		case unicode.IsUpper(r):
+			// A word starts at an upper case letter after a lower case letter or
+			// digit, or at the last upper case letter of an acronym like HTTPServer.
+			if i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]) ||
+				(unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1]))) {
+				b = append(b, '_')
+			}
+			b = append(b, unicode.ToLower(r))
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b = append(b, r)
+		default:
+			b = append(b, '_')
+		}
+	}
+
+	return strings.Trim(underscores.ReplaceAllString(string(b), "_"), "_")
+}
+
+// qualifyTableName returns the name of a table in a database,
+// which renders as `database`.`table` in backticks.
+func qualifyTableName(database, table string) string {
+	return database + "`.`" + table
+}
+
+// splitTableName returns the database a table name is qualified with, if any, and the name of the table.
+func splitTableName(table string) (string, string) {
+	if i := strings.Index(table, "`.`"); i >= 0 {
+		return table[:i], table[i+3:]
+	}
+	return "", table
+}
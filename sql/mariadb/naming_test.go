@@ -0,0 +1,122 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNaming(t *testing.T) {
+
+	Convey("Tables should be named like their shapes by default", t, func() {
+		n := tableNamer{}
+		So(n.table("Test.Products"), ShouldEqual, "Test.Products")
+		So(n.comment("Test.Products"), ShouldEqual, "")
+	})
+
+	Convey("Table names should be converted with the naming settings", t, func() {
+		So(tableNamer{Case: tableNameCaseSnake}.table("Test.OrderItems"), ShouldEqual, "test_order_items")
+		So(tableNamer{Case: tableNameCaseSnake}.table("HTTPServer Logs"), ShouldEqual, "http_server_logs")
+		So(tableNamer{Case: tableNameCaseLower}.table("Test.Products"), ShouldEqual, "test.products")
+		So(tableNamer{Prefix: "stg_", Suffix: "_v1"}.table("Test.Products"), ShouldEqual, "stg_Test.Products_v1")
+		So(tableNamer{SourceAsDatabase: true, Case: tableNameCaseSnake}.table("Test.OrderItems"), ShouldEqual, "test`.`order_items")
+		So(tableNamer{SourceAsDatabase: true}.table("Products"), ShouldEqual, "Products")
+	})
+
+	Convey("Tables should be routed to databases by mapping, prefix and source", t, func() {
+		n := tableNamer{
+			SourceAsDatabase:  true,
+			DatabaseSeparator: "__",
+			Databases:         map[string]string{"Test.Products": "catalog", "Staging": "stage"},
+		}
+		So(n.table("Test.Products"), ShouldEqual, "catalog`.`Test.Products")
+		So(n.table("Staging.Orders"), ShouldEqual, "stage`.`Staging.Orders")
+		So(n.table("sales__Orders"), ShouldEqual, "sales`.`Orders")
+		So(n.table("Test.Orders"), ShouldEqual, "Test`.`Orders")
+		So(n.table("Orders"), ShouldEqual, "Orders")
+		So(n.comment("sales__Orders"), ShouldEqual, "shape:sales__Orders")
+		So(tableNamer{DatabaseSeparator: "__"}.table("Test.Orders"), ShouldEqual, "Test.Orders")
+	})
+
+	Convey("Given a new shape routed to a database which may not exist", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		sut := &mariaSubscriber{
+			db:       db,
+			settings: &settings{Retries: 3, OnError: onErrorFail, DatabaseSeparator: "__", CreateDatabases: true},
+		}
+		types, err := newTypeMapper(sut.settings)
+		So(err, ShouldBeNil)
+		sut.types = types
+
+		shape := shapeutils.ShapeDelta{
+			IsNew:            true,
+			HasNewProperties: true,
+			Name:             "sales__Orders",
+			NewKeys:          []string{"id"},
+			NewProperties:    map[string]string{"id": "integer"},
+		}
+
+		mock.ExpectExec(regexp.QuoteMeta("CREATE DATABASE IF NOT EXISTS `sales`")).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS `sales`.`Orders`")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		err = sut.applyShapeChange(&shapeutils.KnownShape{}, shape)
+
+		Convey("Then the database should be created before the table", func() {
+			So(err, ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+
+	Convey("Long table names should be shortened with a hash of the whole name", t, func() {
+		n := tableNamer{MaxLength: 20}
+		a := n.table("Test.ProductCategories")
+		b := n.table("Test.ProductCategoryTranslations")
+		So(a, ShouldHaveLength, 20)
+		So(a, ShouldStartWith, "Test.Produc_")
+		So(b, ShouldNotEqual, a)
+
+		n = tableNamer{MaxLength: 32}
+		staging := stagingTableName("Test.ProductCategories", n)
+		So(staging, ShouldHaveLength, 32)
+		So(staging, ShouldStartWith, stagingTablePrefix+"Test.Pro_")
+		So(stagingTableName("Test.ProductCategoryTranslations", n), ShouldNotEqual, staging)
+	})
+
+	Convey("Given a new shape with a naming strategy", t, func() {
+		shape := shapeutils.ShapeDelta{
+			IsNew:         true,
+			Name:          "Test.OrderItems",
+			NewKeys:       []string{"id"},
+			NewProperties: map[string]string{"id": "integer"},
+		}
+		options := tableOptions{Naming: tableNamer{Case: tableNameCaseSnake, SourceAsDatabase: true}}
+
+		actual, err := createShapeChangeSQL(shape, nil, options)
+
+		Convey("Then the table should be named by the strategy and have the shape name in its comment", func() {
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`CREATE TABLE IF NOT EXISTS "test"."order_items" (
+	"id" INT(10) NOT NULL,
+	PRIMARY KEY ("id")
+) COMMENT = 'shape:Test.OrderItems'`))
+			So(stagingTableName(options.table(shape.Name), options.Naming), ShouldEqual, "test`.`_naveego_stage_order_items")
+		})
+	})
+
+	Convey("Invalid naming settings should be rejected", t, func() {
+		So(validateTableNaming(&settings{TableNameCase: "camel"}), ShouldNotBeNil)
+		So(validateTableNaming(&settings{TableNameMaxLength: 65}), ShouldNotBeNil)
+		So(validateTableNaming(&settings{Databases: map[string]string{"Test": ""}}), ShouldNotBeNil)
+		So(validateTableNaming(&settings{TableNameCase: tableNameCaseSnake, TableNameMaxLength: 32}), ShouldBeNil)
+	})
+}
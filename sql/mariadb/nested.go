@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/Sirupsen/logrus"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// receiveWithChildren writes a data point whose arrays are stored in child tables.
+// The parent row is written first, then the existing child rows of the parent
+// are replaced with the elements of the arrays.
+func (h *mariaSubscriber) receiveWithChildren(dataPoint pipeline.DataPoint) error {
+
+	parent, children := shapeutils.SplitDataPoint(dataPoint)
+
+	err := h.write(parent, h.applyShapeChange)
+	if err != nil {
+		return err
+	}
+
+	for _, child := range children {
+
+		if len(child.ParentKeys) == 0 {
+			logrus.Warnf("Shape %s has no keys, so array %s can't be stored in a child table", child.ParentName, child.Property)
+			continue
+		}
+
+		if h.knownShapes.Knows(child.Name) && !h.planning() {
+			// Buffered rows of the child table may belong to this parent.
+			err = h.flushBatch(child.Name)
+			if err != nil {
+				return err
+			}
+
+			var deleteCommand string
+			deleteCommand, err = createDeleteChildrenSQL(child, h.tableOptions())
+			if err != nil {
+				return err
+			}
+
+			err = h.exec(0, deleteCommand, child.ParentKeyValues...)
+			if err != nil {
+				return err
+			}
+		}
+
+		apply := h.applyChildShapeChange(child)
+
+		for _, dp := range child.DataPoints {
+			err = h.write(dp, apply)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyChildShapeChange returns a ShapeChangeFunc which alters a child table
+// like applyShapeChange and adds the foreign key to the parent when it is created.
+func (h *mariaSubscriber) applyChildShapeChange(child shapeutils.ChildDataPoints) shapeutils.ShapeChangeFunc {
+	return func(knownShape *shapeutils.KnownShape, shapeDelta shapeutils.ShapeDelta) error {
+
+		err := h.applyShapeChange(knownShape, shapeDelta)
+		if err != nil || !shapeDelta.IsNew {
+			return err
+		}
+
+		foreignKeyCommand, err := createForeignKeySQL(child, h.tableOptions())
+		if err != nil {
+			return err
+		}
+
+		// The child rows can be stored without the constraint,
+		// so failing to add it (e.g. because the key types differ) isn't fatal.
+		err = h.execDDL(child.Name, foreignKeyCommand)
+		if err != nil {
+			logrus.Warnf("Couldn't add foreign key from %s to %s: %s", child.Name, child.ParentName, err)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+const (
+	partitionByRange = "range"
+	partitionByHash  = "hash"
+
+	partitionIntervalMonth = "month"
+	partitionIntervalDay   = "day"
+
+	// maxValuePartition holds the rows after the last range partition. It is
+	// split when the upcoming partitions are added, so it is usually empty.
+	maxValuePartition = "pmax"
+
+	// maxPartitions is the largest number of partitions MariaDB allows in a table.
+	maxPartitions = 8192
+)
+
+// partitionSettings declares how the table of a shape is partitioned.
+// MariaDB requires the partitioned columns to be in every unique key of the table,
+// so they must be keys of the shape, and the tables can't have foreign keys.
+type partitionSettings struct {
+	// By is "range", which partitions the rows by the date in Property, or
+	// "hash", which spreads them over Count partitions by a hash of Columns.
+	By string
+	// Property is the date property range partitions are by.
+	Property string
+	// Interval is the span of the range partitions: "month" (default) or "day".
+	Interval string
+	// Ahead is the number of partitions after the current one which are
+	// created with the table and at Init (default 3).
+	Ahead int
+	// Retention is the number of partitions before the current one which are
+	// kept. The older partitions, and their rows, are dropped at Init. 0 keeps them all.
+	Retention int
+	// Columns are the properties of the hash (default the keys of the shape).
+	Columns []string
+	// Count is the number of hash partitions (default 8).
+	Count int
+}
+
+// validatePartitions checks the partitioning in the settings, and sets its defaults.
+func validatePartitions(s *settings) error {
+
+	if len(s.Partitions) > 0 && s.Nested == shapeutils.NestedChildTables {
+		return fmt.Errorf("Partitions can't be used with Nested %q, because partitioned tables can't have foreign keys", s.Nested)
+	}
+
+	for shape, p := range s.Partitions {
+		var columns []string
+
+		switch p.By {
+		case partitionByRange:
+			if p.Property == "" {
+				return fmt.Errorf("the range partitions of %s have no Property", shape)
+			}
+			switch p.Interval {
+			case "":
+				p.Interval = partitionIntervalMonth
+			case partitionIntervalMonth, partitionIntervalDay:
+			default:
+				return fmt.Errorf("unknown partition Interval %q of %s", p.Interval, shape)
+			}
+			if p.Ahead == 0 {
+				p.Ahead = 3
+			}
+			if p.Ahead < 0 || p.Retention < 0 || p.Ahead+p.Retention+2 > maxPartitions {
+				return fmt.Errorf("the partitions of %s must have an Ahead and a Retention of 0 to %d", shape, maxPartitions-2)
+			}
+			columns = []string{p.Property}
+		case partitionByHash:
+			if p.Count == 0 {
+				p.Count = 8
+			}
+			if p.Count < 1 || p.Count > maxPartitions {
+				return fmt.Errorf("the partitions of %s must have a Count of 1 to %d", shape, maxPartitions)
+			}
+			columns = p.Columns
+		default:
+			return fmt.Errorf("unknown partitioning %q of %s", p.By, shape)
+		}
+
+		for _, index := range s.Indexes[shape] {
+			if !index.Unique {
+				continue
+			}
+			for _, c := range columns {
+				if !containsIndexColumn(index.Columns, c) {
+					return fmt.Errorf("the unique index %s of %s must have the partitioned column %s", index.name(), shape, c)
+				}
+			}
+		}
+
+		s.Partitions[shape] = p
+	}
+
+	return nil
+}
+
+func containsIndexColumn(columns []string, property string) bool {
+	for _, c := range columns {
+		if p, _ := parseIndexColumn(c); p == property {
+			return true
+		}
+	}
+	return false
+}
+
+// start returns the start of the range partition t is in.
+func (p partitionSettings) start(t time.Time) time.Time {
+	t = t.UTC()
+	if p.Interval == partitionIntervalDay {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// add returns the start of the range partition n partitions after the one starting at start.
+func (p partitionSettings) add(start time.Time, n int) time.Time {
+	if p.Interval == partitionIntervalDay {
+		return start.AddDate(0, 0, n)
+	}
+	return start.AddDate(0, n, 0)
+}
+
+func (p partitionSettings) layout() string {
+	if p.Interval == partitionIntervalDay {
+		return "20060102"
+	}
+	return "200601"
+}
+
+// partition returns the model of the range partition starting at start,
+// which is named like p202610 and has the rows before the next partition.
+func (p partitionSettings) partition(start time.Time) sqlPartitionModel {
+	return sqlPartitionModel{
+		Name:  "p" + start.Format(p.layout()),
+		Bound: p.add(start, 1).Format("2006-01-02"),
+	}
+}
+
+// parsePartition returns the start of a range partition from its name,
+// or false if it isn't named like the partitions this subscriber creates.
+func (p partitionSettings) parsePartition(name string) (time.Time, bool) {
+	if len(name) != len(p.layout())+1 || name[0] != 'p' {
+		return time.Time{}, false
+	}
+	start, err := time.Parse(p.layout(), name[1:])
+	return start, err == nil
+}
+
+type sqlPartitioningModel struct {
+	By         string
+	Columns    []string // The escaped names of the partitioned columns
+	Count      int      // The number of hash partitions
+	Partitions []sqlPartitionModel
+}
+
+type sqlPartitionModel struct {
+	Name  string
+	Bound string // The date the rows of the partition are before
+}
+
+// newTablePartitioning returns the model of the partitioning of a new table with the keys,
+// or nil if the shape isn't partitioned. The range partitions start with the one now is in.
+func newTablePartitioning(shapeInfo shapeutils.ShapeDelta, keys []string, options tableOptions) (*sqlPartitioningModel, error) {
+
+	p, ok := options.Partitions[shapeInfo.Name]
+	if !ok {
+		return nil, nil
+	}
+
+	model := &sqlPartitioningModel{By: p.By, Count: p.Count}
+
+	columns := p.Columns
+	if p.By == partitionByRange {
+		columns = []string{p.Property}
+		if t := shapeInfo.NewProperties[p.Property]; t != "date" {
+			return nil, fmt.Errorf("can't partition %s by range of %s, because it isn't a date", shapeInfo.Name, p.Property)
+		}
+		start := p.start(options.Now)
+		for i := 0; i <= p.Ahead; i++ {
+			model.Partitions = append(model.Partitions, p.partition(p.add(start, i)))
+		}
+	} else if len(columns) == 0 {
+		columns = keys
+		if len(columns) == 0 {
+			return nil, fmt.Errorf("can't partition %s by hash of its keys, because it has none", shapeInfo.Name)
+		}
+	}
+
+	for _, c := range columns {
+		isKey := false
+		for _, k := range keys {
+			if k == c {
+				isKey = true
+			}
+		}
+		if !isKey {
+			return nil, fmt.Errorf("can't partition %s by %s, because it isn't a key of the shape", shapeInfo.Name, c)
+		}
+		model.Columns = append(model.Columns, escapeString(c))
+	}
+
+	return model, nil
+}
+
+const addPartitionsTemplateText = `ALTER TABLE {{tick .Name}} {{if .Reorganize}}REORGANIZE PARTITION {{tick .Reorganize}} INTO{{else}}ADD PARTITION{{end}} ({{range $i, $e := .Partitions}}{{if $i}},{{end}}
+	PARTITION {{tick $e.Name}} VALUES LESS THAN ('{{$e.Bound}}'){{end}}{{if .Reorganize}},
+	PARTITION {{tick .Reorganize}} VALUES LESS THAN (MAXVALUE){{end}}
+);`
+
+const dropPartitionsTemplateText = `ALTER TABLE {{tick .Name}} DROP PARTITION {{range $i, $e := .Partitions}}{{if $i}}, {{end}}{{tick $e.Name}}{{end}};`
+
+type sqlPartitionsModel struct {
+	Name       string
+	Partitions []sqlPartitionModel
+	Reorganize string // The partition with the rows after the last partition, which is split
+}
+
+// createMaintainPartitionsSQL renders the statements which add the range partitions of the
+// table of a shape after the last existing one through the upcoming ones, in order, and drop
+// the partitions older than the retention. Partitions which are not named like the ones
+// created with the table are left alone.
+func createMaintainPartitionsSQL(shapeName string, existing []string, options tableOptions) ([]string, error) {
+
+	var (
+		statements []string
+		p          = options.Partitions[shapeName]
+		current    = p.start(options.Now)
+		last       time.Time
+		hasMax     bool
+		expired    []sqlPartitionModel
+	)
+
+	for _, name := range existing {
+		if name == maxValuePartition {
+			hasMax = true
+			continue
+		}
+		start, ok := p.parsePartition(name)
+		if !ok {
+			continue
+		}
+		if start.After(last) {
+			last = start
+		}
+		if p.Retention > 0 && start.Before(p.add(current, -p.Retention)) {
+			expired = append(expired, sqlPartitionModel{Name: name})
+		}
+	}
+
+	model := sqlPartitionsModel{Name: options.table(shapeName)}
+	if hasMax {
+		model.Reorganize = maxValuePartition
+	}
+
+	// The partitions missed since the last one are added too, so that the rows
+	// split from the last partition are in the partitions of their dates, and
+	// the ones older than the retention are dropped right away.
+	first := current
+	if !last.IsZero() {
+		first = p.add(last, 1)
+	}
+	for start := first; !start.After(p.add(current, p.Ahead)); start = p.add(start, 1) {
+		partition := p.partition(start)
+		model.Partitions = append(model.Partitions, partition)
+		if p.Retention > 0 && start.Before(p.add(current, -p.Retention)) {
+			expired = append(expired, sqlPartitionModel{Name: partition.Name})
+		}
+	}
+
+	if len(model.Partitions) > 0 {
+		w := &bytes.Buffer{}
+		err := addPartitionsTemplate.Execute(w, model)
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, w.String())
+	}
+
+	if len(expired) > 0 {
+		w := &bytes.Buffer{}
+		err := dropPartitionsTemplate.Execute(w, sqlPartitionsModel{Name: model.Name, Partitions: expired})
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, w.String())
+	}
+
+	return statements, nil
+}
+
+// readPartitions reads the names of the partitions of the table of a shape, in order.
+func (h *mariaSubscriber) readPartitions(shapeName string) ([]string, error) {
+
+	database, table := splitTableName(h.tableOptions().table(shapeName))
+
+	query := "SELECT PARTITION_NAME FROM information_schema.PARTITIONS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND PARTITION_NAME IS NOT NULL ORDER BY PARTITION_ORDINAL_POSITION"
+	args := []interface{}{table}
+	if database != "" {
+		query = "SELECT PARTITION_NAME FROM information_schema.PARTITIONS WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? AND PARTITION_NAME IS NOT NULL ORDER BY PARTITION_ORDINAL_POSITION"
+		args = []interface{}{database, table}
+	}
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// maintainPartitions adds the upcoming range partitions of the tables of the known shapes,
+// and drops the partitions older than their retention.
+func (h *mariaSubscriber) maintainPartitions() error {
+
+	for shapeName, p := range h.settings.Partitions {
+
+		if p.By != partitionByRange || !h.knownShapes.Knows(shapeName) {
+			continue
+		}
+
+		existing, err := h.readPartitions(shapeName)
+		if err != nil {
+			return err
+		}
+
+		if len(existing) == 0 {
+			logrus.Warnf("The table of %s was created without partitions, so they are not maintained", shapeName)
+			continue
+		}
+
+		statements, err := createMaintainPartitionsSQL(shapeName, existing, h.tableOptions())
+		if err != nil {
+			return err
+		}
+
+		for _, statement := range statements {
+			err = h.execDDL(shapeName, statement)
+			if err != nil {
+				return fmt.Errorf("couldn't maintain the partitions of %s: %s", shapeName, err)
+			}
+		}
+
+		if len(statements) > 0 {
+			logrus.Infof("Maintained the partitions of %s", shapeName)
+		}
+	}
+
+	return nil
+}
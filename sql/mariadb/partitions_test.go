@@ -0,0 +1,241 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/navigator-go/subscribers/protocol"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestPartitions(t *testing.T) {
+
+	now := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+	types, _ := newTypeMapper(&settings{})
+
+	Convey("Given a new shape with range partitions", t, func() {
+
+		shape := shapeutils.ShapeDelta{
+			IsNew:         true,
+			Name:          "test",
+			NewKeys:       []string{"id", "date"},
+			NewProperties: map[string]string{"id": "integer", "date": "date"},
+		}
+		options := tableOptions{
+			Now:        now,
+			Partitions: map[string]partitionSettings{"test": {By: partitionByRange, Property: "date", Interval: partitionIntervalMonth, Ahead: 2}},
+		}
+
+		actual, err := createShapeChangeSQL(shape, types, options)
+
+		Convey("Then the table should have the current and the upcoming partitions", func() {
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`CREATE TABLE IF NOT EXISTS "test" (
+	"date" DATETIME NOT NULL,
+	"id" INT(10) NOT NULL,
+	PRIMARY KEY ("id", "date")
+)
+PARTITION BY RANGE COLUMNS ("date") (
+	PARTITION "p202610" VALUES LESS THAN ('2026-11-01'),
+	PARTITION "p202611" VALUES LESS THAN ('2026-12-01'),
+	PARTITION "p202612" VALUES LESS THAN ('2027-01-01'),
+	PARTITION "pmax" VALUES LESS THAN (MAXVALUE)
+)`))
+		})
+
+		Convey("When the property isn't a key", func() {
+			shape.NewKeys = []string{"id"}
+			_, err = createShapeChangeSQL(shape, types, options)
+
+			Convey("Then the table should not be created", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "isn't a key of the shape")
+			})
+		})
+	})
+
+	Convey("Given a new shape with hash partitions", t, func() {
+
+		shape := shapeutils.ShapeDelta{
+			IsNew:         true,
+			Name:          "test",
+			NewKeys:       []string{"id"},
+			NewProperties: map[string]string{"id": "integer"},
+		}
+		options := tableOptions{
+			Partitions: map[string]partitionSettings{"test": {By: partitionByHash, Count: 4}},
+		}
+
+		actual, err := createShapeChangeSQL(shape, types, options)
+
+		Convey("Then the table should be partitioned by its keys", func() {
+			So(err, ShouldBeNil)
+			So(actual, ShouldEndWith, e(`
+)
+PARTITION BY KEY ("id") PARTITIONS 4`))
+		})
+	})
+
+	Convey("Given the partitions of a table with daily range partitions", t, func() {
+
+		options := tableOptions{
+			Now:        now,
+			Partitions: map[string]partitionSettings{"test": {By: partitionByRange, Property: "date", Interval: partitionIntervalDay, Ahead: 2, Retention: 2}},
+		}
+		existing := []string{"p20261012", "p20261013", "p20261014", "p20261015", "p20261016", "p20261017", "pmax"}
+
+		actual, err := createMaintainPartitionsSQL("test", existing, options)
+
+		Convey("Then the upcoming partitions should be split from the last one, and the old ones dropped", func() {
+			So(err, ShouldBeNil)
+			So(actual, ShouldResemble, []string{
+				e(`ALTER TABLE "test" REORGANIZE PARTITION "pmax" INTO (
+	PARTITION "p20261018" VALUES LESS THAN ('2026-10-19'),
+	PARTITION "pmax" VALUES LESS THAN (MAXVALUE)
+);`),
+				e(`ALTER TABLE "test" DROP PARTITION "p20261012", "p20261013";`),
+			})
+		})
+
+		Convey("When partitions were not added for several days", func() {
+			actual, err = createMaintainPartitionsSQL("test", []string{"p20261012", "pmax"}, options)
+
+			Convey("Then the missed partitions should be split from the last one too, and the old ones dropped", func() {
+				So(err, ShouldBeNil)
+				So(actual, ShouldResemble, []string{
+					e(`ALTER TABLE "test" REORGANIZE PARTITION "pmax" INTO (
+	PARTITION "p20261013" VALUES LESS THAN ('2026-10-14'),
+	PARTITION "p20261014" VALUES LESS THAN ('2026-10-15'),
+	PARTITION "p20261015" VALUES LESS THAN ('2026-10-16'),
+	PARTITION "p20261016" VALUES LESS THAN ('2026-10-17'),
+	PARTITION "p20261017" VALUES LESS THAN ('2026-10-18'),
+	PARTITION "p20261018" VALUES LESS THAN ('2026-10-19'),
+	PARTITION "pmax" VALUES LESS THAN (MAXVALUE)
+);`),
+					e(`ALTER TABLE "test" DROP PARTITION "p20261012", "p20261013";`),
+				})
+			})
+		})
+
+		Convey("When the table has no partition for the rows after the last one", func() {
+			actual, err = createMaintainPartitionsSQL("test", existing[2:6], options)
+
+			Convey("Then the upcoming partitions should be added", func() {
+				So(err, ShouldBeNil)
+				So(actual, ShouldResemble, []string{
+					e(`ALTER TABLE "test" ADD PARTITION (
+	PARTITION "p20261018" VALUES LESS THAN ('2026-10-19')
+);`),
+				})
+			})
+		})
+	})
+
+	Convey("Given a subscriber with a partitioned table", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		sut := &mariaSubscriber{
+			db:          db,
+			knownShapes: shapeutils.NewShapeCache(),
+			settings: &settings{
+				Retries:    3,
+				OnError:    onErrorFail,
+				Partitions: map[string]partitionSettings{"Test.Readings": {By: partitionByRange, Property: "date", Interval: partitionIntervalMonth, Ahead: 1}},
+			},
+		}
+		shape, _ := sut.knownShapes.Analyze(pipeline.DataPoint{
+			Source: "Test",
+			Entity: "Readings",
+			Shape:  pipeline.Shape{KeyNames: []string{"date"}, Properties: []string{"date:date"}},
+		})
+		sut.knownShapes.Remember(shape)
+
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.PARTITIONS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ?")).
+			WithArgs("Test.Readings").
+			WillReturnRows(sqlmock.NewRows([]string{"PARTITION_NAME"}).AddRow("p200001").AddRow("pmax"))
+		mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE `Test.Readings` REORGANIZE PARTITION `pmax` INTO")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		err = sut.maintainPartitions()
+
+		Convey("Then the upcoming partitions should be added at Init", func() {
+			So(err, ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+
+	Convey("Given a database with a partitioned table", t, func() {
+
+		db, mock, err := sqlmock.NewWithDSN("partitions_test")
+		So(err, ShouldBeNil)
+		sqlDriver = "sqlmock"
+
+		Reset(func() {
+			sqlDriver = "mysql"
+			db.Close()
+		})
+
+		mock.ExpectQuery(regexp.QuoteMeta("SELECT VERSION()")).
+			WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow("10.3.8-MariaDB"))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.TABLES")).
+			WillReturnRows(sqlmock.NewRows([]string{"current", "TABLE_SCHEMA", "TABLE_NAME", "TABLE_COMMENT"}).
+				AddRow(1, "pipeline", "Test.Readings", ""))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.COLUMNS")).
+			WillReturnRows(sqlmock.NewRows([]string{"TABLE_SCHEMA", "TABLE_NAME", "COLUMN_NAME", "COLUMN_TYPE", "IS_NULLABLE",
+				"CHARACTER_MAXIMUM_LENGTH", "NUMERIC_PRECISION", "NUMERIC_SCALE", "COLUMN_DEFAULT", "COLUMN_COMMENT"}).
+				AddRow("pipeline", "Test.Readings", "date", "datetime", "NO", nil, nil, nil, nil, ""))
+		mock.ExpectQuery(regexp.QuoteMeta("FROM information_schema.STATISTICS")).
+			WillReturnRows(sqlmock.NewRows([]string{"TABLE_SCHEMA", "TABLE_NAME", "INDEX_NAME", "COLUMN_NAME"}).
+				AddRow("pipeline", "Test.Readings", "PRIMARY", "date"))
+		mock.ExpectClose()
+
+		sut := &mariaSubscriber{}
+
+		Convey("When the connection is tested", func() {
+			response, err := sut.TestConnection(protocol.TestConnectionRequest{
+				Settings: map[string]interface{}{
+					"DataSourceName": "partitions_test",
+					"Partitions": map[string]interface{}{
+						"Test.Readings": map[string]interface{}{"By": "range", "Property": "date", "Retention": 1},
+					},
+				},
+			})
+
+			Convey("Then the partitions should not be maintained, and the connection should be closed", func() {
+				So(err, ShouldBeNil)
+				So(response.Success, ShouldBeTrue)
+				So(response.Message, ShouldEqual, "Connected to: 10.3.8-MariaDB")
+				So(sut.db, ShouldBeNil)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Invalid partitioning settings should be rejected", t, func() {
+		So(validatePartitions(&settings{Partitions: map[string]partitionSettings{"test": {By: "list"}}}), ShouldNotBeNil)
+		So(validatePartitions(&settings{Partitions: map[string]partitionSettings{"test": {By: partitionByRange}}}), ShouldNotBeNil)
+		So(validatePartitions(&settings{Partitions: map[string]partitionSettings{"test": {By: partitionByHash, Count: 10000}}}), ShouldNotBeNil)
+		So(validatePartitions(&settings{
+			Partitions: map[string]partitionSettings{"test": {By: partitionByHash}},
+			Nested:     shapeutils.NestedChildTables,
+		}), ShouldNotBeNil)
+		So(validatePartitions(&settings{
+			Partitions: map[string]partitionSettings{"test": {By: partitionByRange, Property: "date"}},
+			Indexes:    map[string][]indexSettings{"test": {{Columns: []string{"sku"}, Unique: true}}},
+		}), ShouldNotBeNil)
+
+		s := &settings{Partitions: map[string]partitionSettings{"test": {By: partitionByRange, Property: "date"}}}
+		So(validatePartitions(s), ShouldBeNil)
+		So(s.Partitions["test"], ShouldResemble, partitionSettings{By: partitionByRange, Property: "date", Interval: partitionIntervalMonth, Ahead: 3})
+	})
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Policies for changes to the tables.
+const (
+	// schemaApply runs the statements which change the tables as they are needed.
+	schemaApply = "apply"
+	// schemaPlan records the statements instead of running them, and writes no rows.
+	schemaPlan = "plan"
+	// schemaLocked rejects the data points which would need the tables to change.
+	schemaLocked = "locked"
+)
+
+// plannedStatement is a statement which changes the table of a shape,
+// recorded instead of run in plan mode.
+type plannedStatement struct {
+	Shape string
+	SQL   string
+}
+
+// planning reports whether the subscriber only plans the changes to the tables.
+func (h *mariaSubscriber) planning() bool {
+	return h.settings.Schema == schemaPlan
+}
+
+// changeSchema runs a statement which changes the table of a shape, unless the
+// Schema policy records it in the plan or rejects it because the schema is locked.
+func (h *mariaSubscriber) changeSchema(shapeName, query string) (bool, error) {
+
+	switch h.settings.Schema {
+	case schemaPlan:
+		h.planMu.Lock()
+		h.plan = append(h.plan, plannedStatement{Shape: shapeName, SQL: query})
+		h.planMu.Unlock()
+
+		logrus.Infof("Planned change to %s: %s", shapeName, query)
+
+		return false, nil
+
+	case schemaLocked:
+		return false, fmt.Errorf("the schema is locked, but %s would need this change: %s", shapeName, query)
+	}
+
+	return true, nil
+}
+
+// formatPlan renders the planned statements as an SQL script, with the statements
+// of each shape together in the order they were planned.
+func formatPlan(plan []plannedStatement) string {
+
+	var shapes []string
+	statements := map[string][]string{}
+
+	for _, p := range plan {
+		if _, ok := statements[p.Shape]; !ok {
+			shapes = append(shapes, p.Shape)
+		}
+		statement := strings.TrimSpace(p.SQL)
+		if !strings.HasSuffix(statement, ";") {
+			statement += ";"
+		}
+		statements[p.Shape] = append(statements[p.Shape], statement)
+	}
+
+	w := &bytes.Buffer{}
+	for i, shape := range shapes {
+		if i > 0 {
+			w.WriteString("\n")
+		}
+		fmt.Fprintf(w, "-- %s\n", shape)
+		for _, statement := range statements[shape] {
+			fmt.Fprintf(w, "%s\n", statement)
+		}
+	}
+
+	return w.String()
+}
+
+// writePlan writes the planned statements to the SchemaPlanFile, and returns
+// the message Dispose responds with, which has the plan if there is no file.
+func (h *mariaSubscriber) writePlan() (string, error) {
+
+	h.planMu.Lock()
+	plan := h.plan
+	h.planMu.Unlock()
+
+	script := formatPlan(plan)
+
+	if h.settings.SchemaPlanFile == "" {
+		if len(plan) == 0 {
+			return "Planned no changes to the tables.", nil
+		}
+		return fmt.Sprintf("Planned %d changes to the tables:\n%s", len(plan), strings.TrimSpace(script)), nil
+	}
+
+	err := ioutil.WriteFile(h.settings.SchemaPlanFile, []byte(script), 0644)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Planned %d changes to the tables, written to %s.", len(plan), h.settings.SchemaPlanFile), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSchemaPolicies(t *testing.T) {
+
+	Convey("Given a data point of a new shape", t, func() {
+
+		dp := pipeline.DataPoint{
+			Entity: "Products",
+			Source: "Test",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"ID"},
+				Properties: []string{"ID:integer", "Name:string"},
+			},
+			Data: map[string]interface{}{
+				"ID":   1,
+				"Name": "First",
+			},
+		}
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		sut := &mariaSubscriber{
+			db:          db,
+			knownShapes: shapeutils.NewShapeCache(),
+			settings:    &settings{Retries: 3, OnError: onErrorFail},
+		}
+
+		Convey("When the subscriber only plans changes", func() {
+			sut.settings.Schema = schemaPlan
+
+			err = sut.receive(dp)
+
+			Convey("Then the table should be planned and no statement run", func() {
+				So(err, ShouldBeNil)
+				So(sut.plan, ShouldHaveLength, 1)
+				So(sut.plan[0].Shape, ShouldEqual, "Test.Products")
+				So(sut.plan[0].SQL, ShouldStartWith, "CREATE TABLE IF NOT EXISTS `Test.Products`")
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+
+			Convey("Then the plan should be written to the plan file", func() {
+				dir, err := ioutil.TempDir("", "plan")
+				So(err, ShouldBeNil)
+				defer os.RemoveAll(dir)
+
+				sut.settings.SchemaPlanFile = filepath.Join(dir, "plan.sql")
+
+				message, err := sut.writePlan()
+				So(err, ShouldBeNil)
+				So(message, ShouldContainSubstring, "Planned 1 changes")
+
+				script, err := ioutil.ReadFile(sut.settings.SchemaPlanFile)
+				So(err, ShouldBeNil)
+				So(string(script), ShouldStartWith, "-- Test.Products\nCREATE TABLE IF NOT EXISTS `Test.Products`")
+			})
+		})
+
+		Convey("When the schema is locked", func() {
+			sut.settings.Schema = schemaLocked
+
+			err = sut.receive(dp)
+
+			Convey("Then the data point should be rejected without running a statement", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "the schema is locked, but Test.Products would need this change: CREATE TABLE")
+				So(sut.knownShapes.Knows("Test.Products"), ShouldBeFalse)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Planned statements should be grouped by shape in the order they were planned", t, func() {
+		script := formatPlan([]plannedStatement{
+			{Shape: "Test.Orders", SQL: "CREATE TABLE `Test.Orders` (`ID` INT(10) NOT NULL)"},
+			{Shape: "Test.Products", SQL: "ALTER TABLE `Test.Products` ADD COLUMN IF NOT EXISTS `Name` VARCHAR(1000) NULL;"},
+			{Shape: "Test.Orders", SQL: "ALTER TABLE `Test.Orders` ADD COLUMN IF NOT EXISTS `Total` DOUBLE NULL"},
+		})
+
+		So(script, ShouldEqual, "-- Test.Orders\n"+
+			"CREATE TABLE `Test.Orders` (`ID` INT(10) NOT NULL);\n"+
+			"ALTER TABLE `Test.Orders` ADD COLUMN IF NOT EXISTS `Total` DOUBLE NULL;\n"+
+			"\n"+
+			"-- Test.Products\n"+
+			"ALTER TABLE `Test.Products` ADD COLUMN IF NOT EXISTS `Name` VARCHAR(1000) NULL;\n")
+	})
+
+	Convey("Metadata tables should be rejected when the schema can't be changed", t, func() {
+		sut := &mariaSubscriber{}
+
+		err := sut.connect(map[string]interface{}{"DataSourceName": "schema_test", "Schema": schemaLocked, "ShapeStore": "table"})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, `Schema "locked" can't be used with ShapeStore "table"`)
+
+		err = sut.connect(map[string]interface{}{"DataSourceName": "schema_test", "Schema": schemaPlan, "DeadLetter": "table"})
+		So(err, ShouldNotBeNil)
+		So(err.Error(), ShouldEqual, `Schema "plan" can't be used with DeadLetter "table"`)
+
+		So(sut.db, ShouldBeNil)
+	})
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// shapeStoreTable is the table the "table" shape store keeps its metadata in.
+// It is excluded from the shapes discovered in the database.
+const shapeStoreTable = "_naveego_shapes"
+
+const shapeStoreCreateSQL = "CREATE TABLE IF NOT EXISTS `%s` (\n" +
+	"\t`name` VARCHAR(255) NOT NULL,\n" +
+	"\t`definition` LONGTEXT NOT NULL,\n" +
+	"\tPRIMARY KEY (`name`)\n" +
+	")"
+
+const shapeStoreSaveSQL = "INSERT INTO `%s` (`name`, `definition`)\n" +
+	"\tVALUES (?, ?)\n" +
+	"\tON DUPLICATE KEY UPDATE\n" +
+	"\t\t`definition` = VALUES(`definition`);"
+
+// tableShapeStore is a shapeutils.ShapeStore which keeps shapes as
+// JSON documents in a metadata table in the target database.
+type tableShapeStore struct {
+	db    *sql.DB
+	table string
+}
+
+func newTableShapeStore(db *sql.DB, table string) (*tableShapeStore, error) {
+
+	store := &tableShapeStore{
+		db:    db,
+		table: escapeString(table),
+	}
+
+	_, err := db.Exec(fmt.Sprintf(shapeStoreCreateSQL, store.table))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create shape store table: %s", err)
+	}
+
+	return store, nil
+}
+
+func (t *tableShapeStore) Load() ([]*shapeutils.KnownShape, error) {
+
+	var shapes []*shapeutils.KnownShape
+
+	rows, err := t.db.Query(fmt.Sprintf("SELECT `definition` FROM `%s` ORDER BY `name`", t.table))
+	if err != nil {
+		return shapes, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var definition string
+		err = rows.Scan(&definition)
+		if err != nil {
+			return shapes, err
+		}
+
+		shape := &shapeutils.KnownShape{}
+		err = json.Unmarshal([]byte(definition), shape)
+		if err != nil {
+			return shapes, err
+		}
+
+		shapes = append(shapes, shape)
+	}
+
+	return shapes, rows.Err()
+}
+
+func (t *tableShapeStore) Save(shape *shapeutils.KnownShape) error {
+
+	definition, err := json.Marshal(shape)
+	if err != nil {
+		return err
+	}
+
+	_, err = t.db.Exec(fmt.Sprintf(shapeStoreSaveSQL, t.table), shape.Name, string(definition))
+
+	return err
+}
+
+// newShapeStore creates the shape store selected in the settings,
+// or returns nil if shapes should not be persisted.
+func newShapeStore(s *settings, db *sql.DB) (shapeutils.ShapeStore, error) {
+	switch s.ShapeStore {
+	case "":
+		return nil, nil
+	case "file":
+		if s.ShapeStoreFile == "" {
+			return nil, fmt.Errorf("settings didn't contain ShapeStoreFile key, which is required when ShapeStore is %q", s.ShapeStore)
+		}
+		return shapeutils.NewFileShapeStore(s.ShapeStoreFile), nil
+	case "table":
+		store, err := newTableShapeStore(db, shapeStoreTable)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+
+	return nil, fmt.Errorf("unknown ShapeStore %q, expected \"file\" or \"table\"", s.ShapeStore)
+}
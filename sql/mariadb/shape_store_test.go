@@ -0,0 +1,76 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTableShapeStore(t *testing.T) {
+
+	Convey("Given a table shape store", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS `_naveego_shapes`")).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+
+		sut, err := newTableShapeStore(db, shapeStoreTable)
+		So(err, ShouldBeNil)
+
+		shape := shapeutils.NewKnownShape(pipeline.DataPoint{
+			Source: "Test",
+			Entity: "Products",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"ID"},
+				Properties: []string{"ID:integer", "Name:string"},
+			},
+		})
+
+		Convey("When a shape is saved", func() {
+			definition, err := shape.MarshalJSON()
+			So(err, ShouldBeNil)
+
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `_naveego_shapes` (`name`, `definition`)")).
+				WithArgs("Test.Products", string(definition)).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			err = sut.Save(shape)
+
+			Convey("Then the definition should be upserted", func() {
+				So(err, ShouldBeNil)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+
+		Convey("When shapes are loaded", func() {
+			definition, err := shape.MarshalJSON()
+			So(err, ShouldBeNil)
+
+			mock.ExpectQuery(regexp.QuoteMeta("SELECT `definition` FROM `_naveego_shapes`")).
+				WillReturnRows(sqlmock.NewRows([]string{"definition"}).AddRow(string(definition)))
+
+			actual, err := sut.Load()
+
+			Convey("Then the stored shapes should be restored", func() {
+				So(err, ShouldBeNil)
+				So(actual, ShouldHaveLength, 1)
+				So(actual[0].ShapeDefinition, ShouldResemble, shape.ShapeDefinition)
+				So(actual[0].MatchesShape(pipeline.Shape{
+					KeyNames:   []string{"ID"},
+					Properties: []string{"ID:integer", "Name:string"},
+				}), ShouldBeTrue)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+	})
+}
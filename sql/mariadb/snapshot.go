@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// In snapshot mode every row written in a run gets the id of the run in its
+// _run_id column. At Dispose, the rows of the shapes written in the run which
+// have another run id are swept: they are deleted, or flagged as deleted if
+// Deletes is "soft".
+
+// countStaleTemplateText counts the rows of a table, and the rows which were not written in the run.
+const countStaleTemplateText = `SELECT COUNT(*), COALESCE(SUM({{tick "_run_id"}} IS NULL OR {{tick "_run_id"}} <> ?), 0) FROM {{tick .Name}}{{if .Soft}}
+	WHERE ({{tick "_deleted"}} IS NULL OR {{tick "_deleted"}} = 0){{end}};`
+
+// sweepTemplateText deletes or flags the rows which were not written in the run.
+const sweepTemplateText = `{{if .Soft}}UPDATE {{tick .Name}} SET {{tick "_deleted"}} = 1
+	WHERE ({{tick "_deleted"}} IS NULL OR {{tick "_deleted"}} = 0) AND{{else}}DELETE FROM {{tick .Name}}
+	WHERE{{end}} ({{tick "_run_id"}} IS NULL OR {{tick "_run_id"}} <> ?);`
+
+type sqlSweepModel struct {
+	Name string
+	Soft bool // Whether swept rows are flagged rather than deleted
+}
+
+// createSweepSQL renders the query counting the rows of a shape's table
+// and the stale ones, and the statement which sweeps the stale rows.
+// Both take the run id as their only parameter.
+func createSweepSQL(shapeName string, options tableOptions) (count, sweep string, err error) {
+
+	model := sqlSweepModel{
+		Name: options.table(shapeName),
+		Soft: options.Deletes == shapeutils.DeletesSoft,
+	}
+
+	w := &bytes.Buffer{}
+	err = countStaleTemplate.Execute(w, model)
+	if err != nil {
+		return
+	}
+	count = w.String()
+
+	w.Reset()
+	err = sweepTemplate.Execute(w, model)
+	sweep = w.String()
+
+	return
+}
+
+// touch records that rows of a shape were written in the run.
+func (h *mariaSubscriber) touch(name string) {
+
+	h.touchedMu.Lock()
+	defer h.touchedMu.Unlock()
+
+	if h.touched == nil {
+		h.touched = map[string]bool{}
+	}
+	h.touched[name] = true
+}
+
+// sweep removes the rows which were not written in the run from the tables of
+// the shapes which were. Nothing is swept if rows of the run were skipped or
+// rolled back, because their rows would be swept too, or if a table would lose
+// more than SweepMaxFraction of its rows, which usually means the snapshot
+// was incomplete. It returns the number of rows swept.
+func (h *mariaSubscriber) sweep() (int, error) {
+
+	h.txMu.Lock()
+	incomplete := h.rejected > 0 || h.rolledBack
+	h.txMu.Unlock()
+
+	if incomplete {
+		return 0, fmt.Errorf("not sweeping, because rows of the run were skipped or rolled back")
+	}
+
+	h.touchedMu.Lock()
+	names := []string{}
+	for name := range h.touched {
+		names = append(names, name)
+	}
+	h.touchedMu.Unlock()
+	sort.Strings(names)
+
+	options := h.tableOptions()
+	sweeps := []string{}
+
+	for _, name := range names {
+		count, sweep, err := createSweepSQL(name, options)
+		if err != nil {
+			return 0, err
+		}
+
+		var total, stale int
+		err = h.queryRow(count, []interface{}{options.RunID}, &total, &stale)
+		if err != nil {
+			return 0, err
+		}
+
+		if stale == 0 {
+			continue
+		}
+
+		if float64(stale) > h.settings.SweepMaxFraction*float64(total) {
+			return 0, fmt.Errorf("not sweeping, because %d of the %d rows of %s were not written in the run, more than the SweepMaxFraction of %g",
+				stale, total, name, h.settings.SweepMaxFraction)
+		}
+
+		sweeps = append(sweeps, sweep)
+	}
+
+	// Deleting the swept rows also deletes the rows of their child tables.
+	swept := 0
+	for _, sweep := range sweeps {
+		err := h.execCascading(0, func(affected int64) writeCounts {
+			swept += int(affected)
+			return writeCounts{}
+		}, sweep, options.RunID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err := h.commit()
+	if err != nil {
+		return 0, err
+	}
+
+	logrus.Infof("Swept %d rows which were not written in run %s", swept, options.RunID)
+
+	return swept, nil
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestSnapshots(t *testing.T) {
+
+	Convey("When we generate the SQL sweeping a table", t, func() {
+		count, sweep, err := createSweepSQL("Test.Products", tableOptions{})
+
+		Convey("Then the rows of other runs should be counted and deleted", nil)
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, e(`SELECT COUNT(*), COALESCE(SUM("_run_id" IS NULL OR "_run_id" <> ?), 0) FROM "Test.Products";`))
+		So(sweep, ShouldEqual, e(`DELETE FROM "Test.Products"
+	WHERE ("_run_id" IS NULL OR "_run_id" <> ?);`))
+	})
+
+	Convey("When we generate the SQL sweeping a table with soft deletes", t, func() {
+		count, sweep, err := createSweepSQL("Test.Products", tableOptions{Deletes: shapeutils.DeletesSoft})
+
+		Convey("Then only rows which are not deleted should be counted and flagged", nil)
+		So(err, ShouldBeNil)
+		So(count, ShouldEqual, e(`SELECT COUNT(*), COALESCE(SUM("_run_id" IS NULL OR "_run_id" <> ?), 0) FROM "Test.Products"
+	WHERE ("_deleted" IS NULL OR "_deleted" = 0);`))
+		So(sweep, ShouldEqual, e(`UPDATE "Test.Products" SET "_deleted" = 1
+	WHERE ("_deleted" IS NULL OR "_deleted" = 0) AND ("_run_id" IS NULL OR "_run_id" <> ?);`))
+	})
+
+	Convey("Given a subscriber in snapshot mode which wrote rows of two shapes", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		sut := &mariaSubscriber{
+			db:       db,
+			settings: &settings{Retries: 3, OnError: onErrorFail, Snapshot: true, RunID: "run-2", SweepMaxFraction: 0.5},
+		}
+		sut.touch("Test.Orders")
+		sut.touch("Test.Products")
+
+		countRows := func(total, stale int) *sqlmock.Rows {
+			return sqlmock.NewRows([]string{"total", "stale"}).AddRow(total, stale)
+		}
+
+		Convey("When few rows were not written in the run", func() {
+			mock.ExpectQuery(regexp.QuoteMeta("FROM `Test.Orders`")).WithArgs("run-2").WillReturnRows(countRows(10, 0))
+			mock.ExpectQuery(regexp.QuoteMeta("FROM `Test.Products`")).WithArgs("run-2").WillReturnRows(countRows(10, 2))
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM `Test.Products`")).WithArgs("run-2").WillReturnResult(sqlmock.NewResult(0, 2))
+
+			swept, err := sut.sweep()
+
+			Convey("Then they should be swept", func() {
+				So(err, ShouldBeNil)
+				So(swept, ShouldEqual, 2)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+
+		Convey("When too many rows of a table were not written in the run", func() {
+			mock.ExpectQuery(regexp.QuoteMeta("FROM `Test.Orders`")).WithArgs("run-2").WillReturnRows(countRows(10, 2))
+			mock.ExpectQuery(regexp.QuoteMeta("FROM `Test.Products`")).WithArgs("run-2").WillReturnRows(countRows(10, 6))
+
+			_, err := sut.sweep()
+
+			Convey("Then nothing should be swept", func() {
+				So(err, ShouldNotBeNil)
+				So(err.Error(), ShouldContainSubstring, "6 of the 10 rows of Test.Products")
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+
+		Convey("When rows of the run were skipped", func() {
+			sut.rejected = 1
+
+			_, err := sut.sweep()
+
+			Convey("Then nothing should be swept", func() {
+				So(err, ShouldNotBeNil)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("Unchanged rows should still get the run id in snapshot mode", t, func() {
+		model := sqlTableModel{SkipUnchanged: true, Snapshot: true}
+		So(model.UpdateValue(sqlColumnModel{Name: "_run_id"}), ShouldEqual, "VALUES(`_run_id`)")
+		So(model.UpdateValue(sqlColumnModel{Name: "Name"}), ShouldStartWith, "IF(")
+	})
+}
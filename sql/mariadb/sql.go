@@ -6,30 +6,103 @@ import (
 	"sort"
 	"strings"
 	"text/template"
+	"time"
 
 	"github.com/naveego/api/types/pipeline"
 	"github.com/naveego/pipeline-subscribers/shapeutils"
 )
 
-const createTemplateText = `CREATE TABLE IF NOT EXISTS {{tick .Name}} ({{range .Columns}}
-	{{tick .Name}} {{.SqlType}} {{if .IsKey}}NOT {{end}}NULL,{{end}}{{if gt (len .Keys) 0}}
-	PRIMARY KEY ({{jointick .Keys}}){{end}}
-)`
+const createTemplateText = `CREATE TABLE IF NOT EXISTS {{tick .Name}} ({{range $i, $e := .Columns}}{{if $i}},{{end}}
+	{{tick $e.Name}} {{$e.SqlType}} {{if $e.IsKey}}NOT {{end}}NULL{{end}}{{if .History}},
+	{{tick "_valid_from"}} DATETIME(6) NOT NULL,
+	{{tick "_valid_to"}} DATETIME(6) NULL,
+	{{tick "_is_current"}} BIT NOT NULL,
+	{{tick "_row_hash"}} CHAR(40) NOT NULL{{end}}{{if gt (len .Keys) 0}},
+	PRIMARY KEY ({{jointick .Keys}}{{if .History}}, {{tick "_valid_from"}}{{end}}){{if .History}},
+	INDEX {{tick "ix_current"}} ({{jointick .Keys}}, {{tick "_is_current"}}){{end}}{{end}}{{range .Indexes}},
+	{{if .Unique}}UNIQUE {{end}}INDEX {{tick .Name}} ({{.Columns}}){{end}}
+){{if .Comment}} COMMENT = '{{.Comment}}'{{end}}{{with .Partitioning}}
+PARTITION BY {{if eq .By "hash"}}KEY ({{jointick .Columns}}) PARTITIONS {{.Count}}{{else}}RANGE COLUMNS ({{jointick .Columns}}) ({{range .Partitions}}
+	PARTITION {{tick .Name}} VALUES LESS THAN ('{{.Bound}}'),{{end}}
+	PARTITION {{tick "pmax"}} VALUES LESS THAN (MAXVALUE)
+){{end}}{{end}}`
 
 const alterTemplateText = `ALTER TABLE {{tick .Name}}{{range $i, $e := .Columns}}
-	{{if $i}},{{end}}ADD COLUMN IF NOT EXISTS {{tick $e.Name}} {{$e.SqlType}} {{if $e.IsKey}}NOT {{end}}NULL{{end}}{{if gt (len .Keys) 0}}
-	,DROP PRIMARY KEY
-	,ADD PRIMARY KEY ({{jointick .Keys}}){{end}};`
+	{{if $i}},{{end}}ADD COLUMN IF NOT EXISTS {{tick $e.Name}} {{$e.SqlType}} {{if $e.IsKey}}NOT {{end}}NULL{{end}}{{range $i, $e := .ModifiedColumns}}
+	{{if or $i $.Columns}},{{end}}MODIFY COLUMN {{tick $e.Name}} {{$e.SqlType}} {{if $e.IsKey}}NOT {{end}}NULL{{end}}{{if gt (len .Keys) 0}}
+	{{if or .Columns .ModifiedColumns}},{{end}}DROP PRIMARY KEY
+	,ADD PRIMARY KEY ({{jointick .Keys}}{{if .History}}, {{tick "_valid_from"}}{{end}}){{if .History}}
+	,DROP INDEX IF EXISTS {{tick "ix_current"}}
+	,ADD INDEX {{tick "ix_current"}} ({{jointick .Keys}}, {{tick "_is_current"}}){{end}}{{end}};`
 
+const nullableTemplateText = `ALTER TABLE {{tick .Name}}{{range $i, $e := .Columns}}
+	{{if $i}},{{end}}MODIFY COLUMN {{tick $e.Name}} {{$e.SqlType}} NULL{{end}};`
+
+const dropColumnsTemplateText = `ALTER TABLE {{tick .Name}}{{range $i, $e := .Columns}}
+	{{if $i}},{{end}}DROP COLUMN IF EXISTS {{tick $e.Name}}{{end}};`
+
+const foreignKeyTemplateText = `ALTER TABLE {{tick .Name}}
+	ADD CONSTRAINT {{tick .Constraint}} FOREIGN KEY ({{jointick .Keys}})
+	REFERENCES {{tick .ParentName}} ({{jointick .Keys}}) ON DELETE CASCADE;`
+
+const deleteChildrenTemplateText = `DELETE FROM {{tick .Name}}
+	WHERE {{range $i, $e := .Keys}}{{if $i}} AND {{end}}{{tick $e}} = ?{{end}};`
+
+// A row of a shape with only keys has nothing to update, so the first key is set to
+// itself, which leaves the row unchanged without ignoring the errors INSERT IGNORE would.
 const upsertTemplateText = `INSERT INTO {{tick .Name}} ({{range $i, $e := .Columns}}{{if $i}}, {{end}}{{tick $e.Name}}{{end}})
-	VALUES ({{range $i, $e := .Columns}}{{if $i}}, {{end}}?{{end}})
-	ON DUPLICATE KEY UPDATE{{range $i, $e := .Columns}}{{if not $e.IsKey}}
-		{{if $i}},{{end}}{{tick $e.Name}} = VALUES({{tick $e.Name}}){{end}}{{end}};`
+	VALUES {{range $r, $_ := .Rows}}{{if $r}},
+		{{end}}({{range $i, $e := $.Columns}}{{if $i}}, {{end}}?{{end}}){{end}}{{if .UpdateColumns}}
+	ON DUPLICATE KEY UPDATE{{range $i, $e := .UpdateColumns}}
+		{{if $i}},{{end}}{{tick $e.Name}} = {{$.UpdateValue $e}}{{end}}{{else}}{{with .KeyColumns}}
+	ON DUPLICATE KEY UPDATE {{tick (index . 0).Name}} = {{tick (index . 0).Name}}{{end}}{{end}};`
+
+const stagingTemplateText = `CREATE TABLE {{tick .Staging}} LIKE {{tick .Name}};`
+
+const dropTableSQL = "DROP TABLE IF EXISTS `%s`;"
+
+// BIT columns are loaded through variables, because LOAD DATA
+// would store the characters of the value rather than the number.
+const loadDataTemplateText = `LOAD DATA LOCAL INFILE 'Reader::{{.Reader}}'
+	REPLACE INTO TABLE {{tick .Staging}}
+	CHARACTER SET utf8mb4
+	FIELDS TERMINATED BY '\t' ESCAPED BY '\\'
+	LINES TERMINATED BY '\n'
+	({{range $i, $e := .Columns}}{{if $i}}, {{end}}{{if $e.IsBit}}@{{end}}{{tick $e.Name}}{{end}}){{range $i, $e := .BitColumns}}
+	{{if $i}},{{else}}SET {{end}}{{tick $e.Name}} = CAST(@{{tick $e.Name}} AS UNSIGNED){{end}};`
+
+const mergeTemplateText = `INSERT INTO {{tick .Name}} ({{range $i, $e := .Columns}}{{if $i}}, {{end}}{{tick $e.Name}}{{end}})
+	SELECT {{range $i, $e := .Columns}}{{if $i}}, {{end}}{{tick $e.Name}}{{end}} FROM {{tick .Staging}}{{if .UpdateColumns}}
+	ON DUPLICATE KEY UPDATE{{range $i, $e := .UpdateColumns}}
+		{{if $i}},{{end}}{{tick $.Name}}.{{tick $e.Name}} = {{$.UpdateValue $e}}{{end}}{{else}}{{with .KeyColumns}}
+	ON DUPLICATE KEY UPDATE {{tick $.Name}}.{{tick (index . 0).Name}} = {{tick $.Name}}.{{tick (index . 0).Name}}{{end}}{{end}};`
 
 var (
-	alterTemplate  *template.Template
-	createTemplate *template.Template
-	upsertTemplate *template.Template
+	alterTemplate           *template.Template
+	createTemplate          *template.Template
+	foreignKeyTemplate      *template.Template
+	deleteChildrenTemplate  *template.Template
+	nullableTemplate        *template.Template
+	dropColumnsTemplate     *template.Template
+	upsertTemplate          *template.Template
+	stagingTemplate         *template.Template
+	loadDataTemplate        *template.Template
+	mergeTemplate           *template.Template
+	closeVersionTemplate    *template.Template
+	insertVersionTemplate   *template.Template
+	countExistingTemplate   *template.Template
+	countStagedTemplate     *template.Template
+	deleteTemplate          *template.Template
+	softDeleteTemplate      *template.Template
+	closeCurrentTemplate    *template.Template
+	countStaleTemplate      *template.Template
+	sweepTemplate           *template.Template
+	addIndexesTemplate      *template.Template
+	countCollisionsTemplate *template.Template
+	countDuplicatesTemplate *template.Template
+	shadowKeysTemplate      *template.Template
+	addPartitionsTemplate   *template.Template
+	dropPartitionsTemplate  *template.Template
 )
 
 func init() {
@@ -46,13 +119,130 @@ func init() {
 		Funcs(funcs).
 		Parse(createTemplateText))
 
+	foreignKeyTemplate = template.Must(template.New("foreignKey").
+		Funcs(funcs).
+		Parse(foreignKeyTemplateText))
+
+	deleteChildrenTemplate = template.Must(template.New("deleteChildren").
+		Funcs(funcs).
+		Parse(deleteChildrenTemplateText))
+
+	nullableTemplate = template.Must(template.New("nullable").
+		Funcs(funcs).
+		Parse(nullableTemplateText))
+
+	dropColumnsTemplate = template.Must(template.New("dropColumns").
+		Funcs(funcs).
+		Parse(dropColumnsTemplateText))
+
 	upsertTemplate = template.Must(template.New("upsert").
 		Funcs(funcs).
 		Parse(upsertTemplateText))
 
+	stagingTemplate = template.Must(template.New("staging").
+		Funcs(funcs).
+		Parse(stagingTemplateText))
+
+	loadDataTemplate = template.Must(template.New("loadData").
+		Funcs(funcs).
+		Parse(loadDataTemplateText))
+
+	mergeTemplate = template.Must(template.New("merge").
+		Funcs(funcs).
+		Parse(mergeTemplateText))
+
+	closeVersionTemplate = template.Must(template.New("closeVersion").
+		Funcs(funcs).
+		Parse(closeVersionTemplateText))
+
+	insertVersionTemplate = template.Must(template.New("insertVersion").
+		Funcs(funcs).
+		Parse(insertVersionTemplateText))
+
+	countExistingTemplate = template.Must(template.New("countExisting").
+		Funcs(funcs).
+		Parse(countExistingTemplateText))
+
+	countStagedTemplate = template.Must(template.New("countStaged").
+		Funcs(funcs).
+		Parse(countStagedTemplateText))
+
+	deleteTemplate = template.Must(template.New("delete").
+		Funcs(funcs).
+		Parse(deleteTemplateText))
+
+	softDeleteTemplate = template.Must(template.New("softDelete").
+		Funcs(funcs).
+		Parse(softDeleteTemplateText))
+
+	closeCurrentTemplate = template.Must(template.New("closeCurrent").
+		Funcs(funcs).
+		Parse(closeCurrentTemplateText))
+
+	countStaleTemplate = template.Must(template.New("countStale").
+		Funcs(funcs).
+		Parse(countStaleTemplateText))
+
+	sweepTemplate = template.Must(template.New("sweep").
+		Funcs(funcs).
+		Parse(sweepTemplateText))
+
+	addIndexesTemplate = template.Must(template.New("addIndexes").
+		Funcs(funcs).
+		Parse(addIndexesTemplateText))
+
+	countCollisionsTemplate = template.Must(template.New("countCollisions").
+		Funcs(funcs).
+		Parse(countCollisionsTemplateText))
+
+	countDuplicatesTemplate = template.Must(template.New("countDuplicates").
+		Funcs(funcs).
+		Parse(countDuplicatesTemplateText))
+
+	shadowKeysTemplate = template.Must(template.New("shadowKeys").
+		Funcs(funcs).
+		Parse(shadowKeysTemplateText))
+
+	addPartitionsTemplate = template.Must(template.New("addPartitions").
+		Funcs(funcs).
+		Parse(addPartitionsTemplateText))
+
+	dropPartitionsTemplate = template.Must(template.New("dropPartitions").
+		Funcs(funcs).
+		Parse(dropPartitionsTemplateText))
+
+}
+
+// tableOptions are the settings which change the tables of all shapes.
+type tableOptions struct {
+	// History keeps a version of every row instead of updating it (see history.go).
+	History bool
+	// Audit adds the audit columns to the tables (see audit.go).
+	Audit bool
+	// RunID is the id of the run written to the _run_id audit column.
+	RunID string
+	// SkipUnchanged only updates rows whose _row_hash has changed (see counts.go).
+	SkipUnchanged bool
+	// Deletes is the policy for tombstones (see deletes.go).
+	Deletes string
+	// Snapshot sweeps the rows which were not written in the run (see snapshot.go).
+	Snapshot bool
+	// Indexes are the secondary indexes of the tables by shape name (see indexes.go).
+	Indexes map[string][]indexSettings
+	// Naming maps the names of the shapes to the names of their tables (see naming.go).
+	Naming tableNamer
+	// Partitions are the partitioning of the tables by shape name (see partitions.go).
+	Partitions map[string]partitionSettings
+	// Now is the time the range partitions of new tables start at.
+	Now time.Time
+}
+
+// table returns the escaped name of the table of a shape.
+func (o tableOptions) table(shapeName string) string {
+	return o.Naming.table(shapeName)
 }
 
-func createShapeChangeSQL(shapeInfo shapeutils.ShapeDelta) (string, error) {
+func createShapeChangeSQL(shapeInfo shapeutils.ShapeDelta, types *typeMapper, options tableOptions) (string, error) {
 
 	var (
 		err error
@@ -60,13 +250,14 @@ func createShapeChangeSQL(shapeInfo shapeutils.ShapeDelta) (string, error) {
 	)
 
 	model := sqlTableModel{
-		Name: escapeString(shapeInfo.Name),
-		Keys: append(shapeInfo.NewKeys, shapeInfo.ExistingKeys...),
+		Name:    options.table(shapeInfo.Name),
+		Keys:    append(shapeInfo.NewKeys, shapeInfo.ExistingKeys...),
+		History: options.History,
 	}
 	for n, t := range shapeInfo.NewProperties {
 		columnModel := sqlColumnModel{
 			Name:    escapeString(n),
-			SqlType: convertToSQLType(t),
+			SqlType: types.toSQL(shapeInfo.Name, n, t),
 		}
 		for _, k := range model.Keys {
 			if k == n {
@@ -77,9 +268,34 @@ func createShapeChangeSQL(shapeInfo shapeutils.ShapeDelta) (string, error) {
 		model.Columns = append(model.Columns, columnModel)
 	}
 
+	for n, c := range shapeInfo.ChangedProperties {
+		columnModel := sqlColumnModel{
+			Name:    escapeString(n),
+			SqlType: types.toSQL(shapeInfo.Name, n, c.NewType),
+		}
+		for _, k := range model.Keys {
+			if k == n {
+				columnModel.IsKey = true
+			}
+		}
+
+		model.ModifiedColumns = append(model.ModifiedColumns, columnModel)
+	}
+
 	sort.Sort(model.Columns)
+	sort.Sort(model.ModifiedColumns)
+
+	// The audit columns are added when the table is altered as well,
+	// in case it was created before Audit was set.
+	model.Columns = append(model.Columns, auditColumns(options)...)
 
 	if shapeInfo.IsNew {
+		model.Indexes = newTableIndexes(shapeInfo.Name, shapeInfo.NewProperties, options)
+		model.Comment = options.Naming.comment(shapeInfo.Name)
+		model.Partitioning, err = newTablePartitioning(shapeInfo, model.Keys, options)
+		if err != nil {
+			return "", err
+		}
 		err = createTemplate.Execute(w, model)
 	} else {
 		if !shapeInfo.HasKeyChanges {
@@ -93,18 +309,166 @@ func createShapeChangeSQL(shapeInfo shapeutils.ShapeDelta) (string, error) {
 	return command, err
 }
 
+// Policies for properties which are known but missing from a data point's shape.
+const (
+	missingPropertiesIgnore   = "ignore"
+	missingPropertiesLog      = "log"
+	missingPropertiesNullable = "nullable"
+	missingPropertiesDrop     = "drop"
+)
+
+// missingPropertyNames returns the sorted names of the missing properties
+// which are not keys of the known shape. Key columns are never altered
+// because of a missing property.
+func missingPropertyNames(shapeInfo shapeutils.ShapeDelta) []string {
+	names := []string{}
+	for n := range shapeInfo.MissingProperties {
+		isKey := false
+		for _, k := range shapeInfo.ExistingKeys {
+			if k == n {
+				isKey = true
+			}
+		}
+		if !isKey {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// createMissingPropertiesSQL renders the statement which applies the policy
+// to the missing properties in shapeInfo. It returns an empty string
+// if the policy doesn't require a change to the table.
+func createMissingPropertiesSQL(shapeInfo shapeutils.ShapeDelta, policy string, types *typeMapper, options tableOptions) (string, error) {
+
+	var (
+		err error
+		w   = &bytes.Buffer{}
+		t   *template.Template
+	)
+
+	switch policy {
+	case missingPropertiesNullable:
+		t = nullableTemplate
+	case missingPropertiesDrop:
+		t = dropColumnsTemplate
+	default:
+		return "", nil
+	}
+
+	model := sqlTableModel{
+		Name: options.table(shapeInfo.Name),
+	}
+	for _, n := range missingPropertyNames(shapeInfo) {
+		model.Columns = append(model.Columns, sqlColumnModel{
+			Name:    escapeString(n),
+			SqlType: types.toSQL(shapeInfo.Name, n, shapeInfo.MissingProperties[n]),
+		})
+	}
+
+	if len(model.Columns) == 0 {
+		return "", nil
+	}
+
+	err = t.Execute(w, model)
+
+	return w.String(), err
+}
+
+type sqlChildModel struct {
+	Name       string
+	ParentName string
+	Constraint string
+	Keys       []string
+}
+
+func newSQLChildModel(children shapeutils.ChildDataPoints, options tableOptions) sqlChildModel {
+	model := sqlChildModel{
+		Name:       options.table(children.Name),
+		ParentName: options.table(children.ParentName),
+	}
+	// Constraints are named in the database of the table.
+	_, table := splitTableName(model.Name)
+	model.Constraint = options.Naming.shorten("fk_" + table)
+	for _, k := range children.ParentKeys {
+		model.Keys = append(model.Keys, escapeString(k))
+	}
+	return model
+}
+
+// createForeignKeySQL renders the statement which makes the parent keys
+// of a child table refer to the parent table.
+func createForeignKeySQL(children shapeutils.ChildDataPoints, options tableOptions) (string, error) {
+	w := &bytes.Buffer{}
+	err := foreignKeyTemplate.Execute(w, newSQLChildModel(children, options))
+	return w.String(), err
+}
+
+// createDeleteChildrenSQL renders the statement which deletes
+// the rows of a child table which belong to a parent.
+func createDeleteChildrenSQL(children shapeutils.ChildDataPoints, options tableOptions) (string, error) {
+	w := &bytes.Buffer{}
+	err := deleteChildrenTemplate.Execute(w, newSQLChildModel(children, options))
+	return w.String(), err
+}
+
 type sqlTableModel struct {
-	Name    string
-	Columns sqlColumns
-	Keys    []string
+	Name            string
+	Columns         sqlColumns
+	ModifiedColumns sqlColumns
+	Keys            []string
+	Rows            []struct{} // One entry per row of values in an upsert
+	Staging         string     // The staging table of a bulk load
+	Reader          string     // The name of the reader handler a bulk load reads from
+	History         bool       // Whether the table keeps a version of every row
+	Now             time.Time  // The time written to the audit columns
+	RunID           string     // The run id written to the audit columns
+	SkipUnchanged   bool       // Whether rows are only updated if their hash has changed
+	Snapshot        bool       // Whether the run id is written even if the row hasn't changed
+	Indexes         []sqlIndexModel
+	Comment         string // The comment of a new table
+	Partitioning    *sqlPartitioningModel
+}
+
+// UpdateColumns returns the columns which are updated when a row exists,
+// which are the columns that are not keys, except _loaded_at.
+func (m sqlTableModel) UpdateColumns() sqlColumns {
+	var columns sqlColumns
+	for _, c := range m.Columns {
+		if !c.IsKey && !(c.Audit && c.Name == auditLoadedAt) {
+			columns = append(columns, c)
+		}
+	}
+	return columns
+}
+
+// BitColumns returns the columns of type BIT.
+func (m sqlTableModel) BitColumns() sqlColumns {
+	var columns sqlColumns
+	for _, c := range m.Columns {
+		if c.IsBit() {
+			columns = append(columns, c)
+		}
+	}
+	return columns
 }
 
 type sqlColumns []sqlColumnModel
 
 type sqlColumnModel struct {
-	Name    string
-	SqlType string
-	IsKey   bool
+	Name     string
+	SqlType  string
+	IsKey    bool
+	Property string // The name of the property the column stores, before escaping
+	Audit    bool   // Whether the column is an audit column rather than storing a property
+}
+
+// IsBit reports whether the column is of type BIT, however the type is written,
+// e.g. bit(1) in a TypeMapping.
+func (c sqlColumnModel) IsBit() bool {
+	base, _ := parseSQLType(c.SqlType)
+	return base == "bit"
 }
 
 func (s sqlColumns) Len() int {
@@ -122,7 +486,7 @@ const (
 	keyParameterOrderer = "ParameterOrder"
 )
 
-func createUpsertSQL(datapoint pipeline.DataPoint, knownShape *shapeutils.KnownShape) (sql string, params []interface{}, err error) {
+func createUpsertSQL(datapoint pipeline.DataPoint, knownShape *shapeutils.KnownShape, options tableOptions) (sql string, params []interface{}, err error) {
 
 	var (
 		// 	gotOrderer bool
@@ -133,25 +497,8 @@ func createUpsertSQL(datapoint pipeline.DataPoint, knownShape *shapeutils.KnownS
 	// if gotSQL {
 	// 	sql = item.(string)
 	// } else {
-	model := sqlTableModel{
-		Name: escapeString(knownShape.Name),
-	}
-	for _, p := range knownShape.Properties {
-		columnModel := sqlColumnModel{
-			Name:    escapeString(p.Name),
-			SqlType: convertToSQLType(p.Type),
-		}
-		for _, k := range knownShape.Keys {
-			if k == p.Name {
-				columnModel.IsKey = true
-			}
-		}
-
-		model.Columns = append(model.Columns, columnModel)
-	}
-
-	// Make sure we have the columns in a known order, for consistency
-	sort.Sort(model.Columns)
+	// The SQL types of the columns are not used in an upsert.
+	model := newUpsertModel(knownShape, 1, nil, options)
 
 	// Render the SQL
 	w := &bytes.Buffer{}
@@ -171,12 +518,7 @@ func createUpsertSQL(datapoint pipeline.DataPoint, knownShape *shapeutils.KnownS
 	orderer = func(dp pipeline.DataPoint) (p []interface{}) {
 		// Populate the parameter list with values from the datapoint,
 		// in the column order.
-		for _, c := range knownShape.Properties {
-			value := dp.Data[c.Name]
-			p = append(p, value)
-		}
-
-		return p
+		return upsertParameters(dp, model)
 	}
 
 	knownShape.Set(keyParameterOrderer, orderer)
@@ -187,6 +529,107 @@ func createUpsertSQL(datapoint pipeline.DataPoint, knownShape *shapeutils.KnownS
 	return
 }
 
+// createBatchUpsertSQL renders a single upsert which writes all the data points,
+// using the columns of knownShape, and returns the parameters for all the rows.
+func createBatchUpsertSQL(dataPoints []pipeline.DataPoint, knownShape *shapeutils.KnownShape, options tableOptions) (sql string, params []interface{}, err error) {
+
+	model := newUpsertModel(knownShape, len(dataPoints), nil, options)
+
+	w := &bytes.Buffer{}
+	err = upsertTemplate.Execute(w, model)
+	if err != nil {
+		return
+	}
+
+	sql = w.String()
+
+	for _, dp := range dataPoints {
+		params = append(params, upsertParameters(dp, model)...)
+	}
+
+	return
+}
+
+// createBulkLoadSQL renders the statements of a bulk load into the table of knownShape:
+// the statement creating the staging table, the statement loading the rows from the reader handler
+// into it, the query counting the loaded rows which are already in the table, and the statement
+// merging them into the table. The count is empty if the shape has no keys.
+func createBulkLoadSQL(knownShape *shapeutils.KnownShape, reader string, types *typeMapper, options tableOptions) (staging, load, count, merge string, err error) {
+
+	model := newUpsertModel(knownShape, 0, types, options)
+	model.Staging = stagingTableName(model.Name, options.Naming)
+	model.Reader = reader
+
+	w := &bytes.Buffer{}
+	for _, s := range []struct {
+		t   *template.Template
+		out *string
+	}{
+		{stagingTemplate, &staging},
+		{loadDataTemplate, &load},
+		{countStagedTemplate, &count},
+		{mergeTemplate, &merge},
+	} {
+		if s.out == &count && len(model.KeyColumns()) == 0 {
+			continue
+		}
+		w.Reset()
+		if err = s.t.Execute(w, model); err != nil {
+			return
+		}
+		*s.out = w.String()
+	}
+
+	return
+}
+
+// newUpsertModel creates the model for an upsert of rowCount rows into the table of knownShape.
+// The audit columns in options follow the columns of the properties.
+func newUpsertModel(knownShape *shapeutils.KnownShape, rowCount int, types *typeMapper, options tableOptions) sqlTableModel {
+
+	model := sqlTableModel{
+		Name:          options.table(knownShape.Name),
+		Rows:          make([]struct{}, rowCount),
+		Now:           time.Now().UTC(),
+		RunID:         options.RunID,
+		SkipUnchanged: options.SkipUnchanged,
+		Snapshot:      options.Snapshot,
+	}
+	for _, p := range knownShape.Properties {
+		columnModel := sqlColumnModel{
+			Name:     escapeString(p.Name),
+			SqlType:  types.toSQL(knownShape.Name, p.Name, p.Type),
+			Property: p.Name,
+		}
+		for _, k := range knownShape.Keys {
+			if k == p.Name {
+				columnModel.IsKey = true
+			}
+		}
+
+		model.Columns = append(model.Columns, columnModel)
+	}
+
+	// Make sure we have the columns in a known order, for consistency
+	sort.Sort(model.Columns)
+
+	model.Columns = append(model.Columns, auditColumns(options)...)
+
+	return model
+}
+
+// upsertParameters returns the values of the datapoint in the column order of model.
+func upsertParameters(dp pipeline.DataPoint, model sqlTableModel) (p []interface{}) {
+	for _, c := range model.Columns {
+		if c.Audit {
+			p = append(p, auditValue(c, dp, model))
+			continue
+		}
+		p = append(p, dp.Data[c.Property])
+	}
+	return p
+}
+
 func convertToSQLType(t string) string {
 	switch t {
 	case "date":
@@ -197,6 +640,8 @@ func convertToSQLType(t string) string {
 		return "FLOAT"
 	case "bool":
 		return "BIT"
+	case "object":
+		return "LONGTEXT"
 	}
 
 	return "VARCHAR(1000)"
@@ -207,11 +652,11 @@ func convertFromSQLType(t string) string {
 	text := strings.ToLower(strings.Split(t, "(")[0])
 
 	switch text {
-	case "datetime", "date", "time", "smalldatetime":
+	case "datetime", "date", "time", "smalldatetime", "timestamp":
 		return "date"
-	case "bigint", "int", "smallint", "tinyint":
+	case "bigint", "int", "mediumint", "smallint", "tinyint":
 		return "integer"
-	case "decimal", "float", "money", "smallmoney":
+	case "decimal", "float", "double", "real", "money", "smallmoney":
 		return "float"
 	case "bit":
 		return "bool"
@@ -44,7 +44,7 @@ func TestCreateShapeChangeSQL(t *testing.T) {
 
 			Convey("Then the SQL should be a CREATE statement", nil)
 
-			actual, err := createShapeChangeSQL(shape)
+			actual, err := createShapeChangeSQL(shape, nil, tableOptions{})
 			So(err, ShouldBeNil)
 			So(actual, ShouldEqual, e(`CREATE TABLE IF NOT EXISTS "test" (
 	"date" DATETIME NULL,
@@ -61,7 +61,7 @@ func TestCreateShapeChangeSQL(t *testing.T) {
 			Convey("When there are new keys", func() {
 				shape.HasKeyChanges = true
 				Convey("The the SQL should be an ALTER statement", nil)
-				actual, err := createShapeChangeSQL(shape)
+				actual, err := createShapeChangeSQL(shape, nil, tableOptions{})
 				So(err, ShouldBeNil)
 				So(actual, ShouldEqual, e(`ALTER TABLE "test"
 	ADD COLUMN IF NOT EXISTS "date" DATETIME NULL
@@ -74,7 +74,7 @@ func TestCreateShapeChangeSQL(t *testing.T) {
 
 			Convey("When there are not new keys", func() {
 				Convey("The the SQL should be an ALTER statement", nil)
-				actual, err := createShapeChangeSQL(shape)
+				actual, err := createShapeChangeSQL(shape, nil, tableOptions{})
 				So(err, ShouldBeNil)
 				So(actual, ShouldEqual, e(`ALTER TABLE "test"
 	ADD COLUMN IF NOT EXISTS "date" DATETIME NULL
@@ -83,9 +83,161 @@ func TestCreateShapeChangeSQL(t *testing.T) {
 
 			})
 
+			Convey("When there are changed properties", func() {
+				shape.NewProperties = nil
+				shape.ChangedProperties = shapeutils.PropertyTypeChanges{
+					"id":  {OldType: "integer", NewType: "float"},
+					"str": {OldType: "date", NewType: "string"},
+				}
+				Convey("The the SQL should be an ALTER statement which modifies the columns", nil)
+				actual, err := createShapeChangeSQL(shape, nil, tableOptions{})
+				So(err, ShouldBeNil)
+				So(actual, ShouldEqual, e(`ALTER TABLE "test"
+	MODIFY COLUMN "id" FLOAT NOT NULL
+	,MODIFY COLUMN "str" VARCHAR(1000) NULL;`))
+
+			})
+
+		})
+	})
+
+}
+
+func TestCreateShapeChangeSQLWithHistory(t *testing.T) {
+
+	Convey("Given a shape in history mode", t, func() {
+
+		shape := shapeutils.ShapeDelta{
+			IsNew:   true,
+			Name:    "test",
+			NewKeys: []string{"id"},
+			NewProperties: map[string]string{
+				"id":  "integer",
+				"str": "string",
+			},
+		}
+		options := tableOptions{History: true}
+
+		Convey("When the shape is new", func() {
+
+			actual, err := createShapeChangeSQL(shape, nil, options)
+
+			Convey("Then the table should have the version columns and the keys should include the start of the version", func() {
+				So(err, ShouldBeNil)
+				So(actual, ShouldEqual, e(`CREATE TABLE IF NOT EXISTS "test" (
+	"id" INT(10) NOT NULL,
+	"str" VARCHAR(1000) NULL,
+	"_valid_from" DATETIME(6) NOT NULL,
+	"_valid_to" DATETIME(6) NULL,
+	"_is_current" BIT NOT NULL,
+	"_row_hash" CHAR(40) NOT NULL,
+	PRIMARY KEY ("id", "_valid_from"),
+	INDEX "ix_current" ("id", "_is_current")
+)`))
+			})
+		})
+
+		Convey("When the keys have changed", func() {
+			shape.IsNew = false
+			shape.HasKeyChanges = true
+			shape.NewKeys = []string{"str"}
+			shape.ExistingKeys = []string{"id"}
+			shape.NewProperties = nil
+
+			actual, err := createShapeChangeSQL(shape, nil, options)
+
+			Convey("Then the keys and the index of the current versions should be replaced", func() {
+				So(err, ShouldBeNil)
+				So(actual, ShouldEqual, e(`ALTER TABLE "test"
+	DROP PRIMARY KEY
+	,ADD PRIMARY KEY ("str", "id", "_valid_from")
+	,DROP INDEX IF EXISTS "ix_current"
+	,ADD INDEX "ix_current" ("str", "id", "_is_current");`))
+			})
 		})
 	})
 
+	Convey("Given a new shape without keys", t, func() {
+
+		shape := shapeutils.ShapeDelta{
+			IsNew:         true,
+			Name:          "test",
+			NewProperties: map[string]string{"str": "string"},
+		}
+
+		Convey("Then the table should have no primary key", func() {
+			actual, err := createShapeChangeSQL(shape, nil, tableOptions{})
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`CREATE TABLE IF NOT EXISTS "test" (
+	"str" VARCHAR(1000) NULL
+)`))
+		})
+	})
+}
+
+func TestCreateMissingPropertiesSQL(t *testing.T) {
+
+	Convey("Given a shape with missing properties", t, func() {
+
+		shape := shapeutils.ShapeDelta{
+			Name:         "test",
+			ExistingKeys: []string{"id"},
+			MissingProperties: map[string]string{
+				"id":   "integer",
+				"str":  "string",
+				"date": "date",
+			},
+		}
+
+		Convey("When the policy is to make the columns nullable", func() {
+			actual, err := createMissingPropertiesSQL(shape, missingPropertiesNullable, nil, tableOptions{})
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`ALTER TABLE "test"
+	MODIFY COLUMN "date" DATETIME NULL
+	,MODIFY COLUMN "str" VARCHAR(1000) NULL;`))
+		})
+
+		Convey("When the policy is to drop the columns", func() {
+			actual, err := createMissingPropertiesSQL(shape, missingPropertiesDrop, nil, tableOptions{})
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`ALTER TABLE "test"
+	DROP COLUMN IF EXISTS "date"
+	,DROP COLUMN IF EXISTS "str";`))
+		})
+
+		Convey("When the policy is to log the missing columns", func() {
+			actual, err := createMissingPropertiesSQL(shape, missingPropertiesLog, nil, tableOptions{})
+			So(err, ShouldBeNil)
+			So(actual, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestCreateChildSQL(t *testing.T) {
+
+	Convey("Given child data points", t, func() {
+
+		children := shapeutils.ChildDataPoints{
+			Name:       "Test.Customers.orders",
+			ParentName: "Test.Customers",
+			ParentKeys: []string{"region", "id"},
+		}
+
+		Convey("Then the foreign key SQL should refer to the parent keys", func() {
+			actual, err := createForeignKeySQL(children, tableOptions{})
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`ALTER TABLE "Test.Customers.orders"
+	ADD CONSTRAINT "fk_Test.Customers.orders" FOREIGN KEY ("region", "id")
+	REFERENCES "Test.Customers" ("region", "id") ON DELETE CASCADE;`))
+		})
+
+		Convey("Then the delete SQL should filter by the parent keys", func() {
+			actual, err := createDeleteChildrenSQL(children, tableOptions{})
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`DELETE FROM "Test.Customers.orders"
+	WHERE "region" = ? AND "id" = ?;`))
+		})
+	})
 }
 
 func TestCreateUpsertSQL(t *testing.T) {
@@ -112,7 +264,7 @@ func TestCreateUpsertSQL(t *testing.T) {
 
 		Convey("When we generate upsert SQL for the first time", func() {
 
-			actual, params, err := createUpsertSQL(dp, shape)
+			actual, params, err := createUpsertSQL(dp, shape, tableOptions{})
 			Convey("Then there should be no error", nil)
 			So(err, ShouldBeNil)
 			Convey("Then the SQL should be correct", nil)
@@ -153,6 +305,142 @@ func TestCreateUpsertSQL(t *testing.T) {
 	})
 }
 
+func TestCreateBatchUpsertSQL(t *testing.T) {
+
+	Convey("Given datapoints with the same known shape", t, func() {
+
+		dp := func(id int, name string) pipeline.DataPoint {
+			return pipeline.DataPoint{
+				Entity: "Products",
+				Source: "Test",
+				Shape: pipeline.Shape{
+					KeyNames:   []string{"ID"},
+					Properties: []string{"ID:integer", "Name:string"},
+				},
+				Data: map[string]interface{}{
+					"ID":   id,
+					"Name": name,
+				},
+			}
+		}
+
+		dps := []pipeline.DataPoint{dp(1, "First"), dp(2, "Second"), dp(3, "Third")}
+		shape := shapeutils.NewKnownShape(dps[0])
+
+		Convey("When we generate batch upsert SQL", func() {
+
+			actual, params, err := createBatchUpsertSQL(dps, shape, tableOptions{})
+			Convey("Then there should be no error", nil)
+			So(err, ShouldBeNil)
+			Convey("Then the SQL should have a row of values per datapoint", nil)
+			So(actual, ShouldEqual, e(`INSERT INTO "Test.Products" ("ID", "Name")
+	VALUES (?, ?),
+		(?, ?),
+		(?, ?)
+	ON DUPLICATE KEY UPDATE
+		"Name" = VALUES("Name");`))
+			Convey("Then the parameters should be in row and column order", nil)
+			So(params, ShouldResemble, []interface{}{1, "First", 2, "Second", 3, "Third"})
+		})
+	})
+
+	Convey("Given datapoints of a shape with only keys", t, func() {
+
+		dps := []pipeline.DataPoint{{
+			Entity: "Tags",
+			Source: "Test",
+			Shape:  pipeline.Shape{KeyNames: []string{"ID"}, Properties: []string{"ID:integer"}},
+			Data:   map[string]interface{}{"ID": 1},
+		}}
+		shape := shapeutils.NewKnownShape(dps[0])
+
+		Convey("When we generate batch upsert SQL", func() {
+
+			actual, _, err := createBatchUpsertSQL(dps, shape, tableOptions{})
+			Convey("Then existing rows should be left unchanged without ignoring errors", nil)
+			So(err, ShouldBeNil)
+			So(actual, ShouldEqual, e(`INSERT INTO "Test.Tags" ("ID")
+	VALUES (?)
+	ON DUPLICATE KEY UPDATE "ID" = "ID";`))
+		})
+
+		Convey("When we generate bulk load SQL", func() {
+
+			_, _, _, merge, err := createBulkLoadSQL(shape, "naveego_1", nil, tableOptions{})
+			So(err, ShouldBeNil)
+			So(merge, ShouldEqual, e(`INSERT INTO "Test.Tags" ("ID")
+	SELECT "ID" FROM "_naveego_stage_Test.Tags"
+	ON DUPLICATE KEY UPDATE "Test.Tags"."ID" = "Test.Tags"."ID";`))
+		})
+	})
+}
+
+func TestCreateBulkLoadSQL(t *testing.T) {
+
+	Convey("Given a known shape with a bool property", t, func() {
+
+		shape := shapeutils.NewKnownShape(pipeline.DataPoint{
+			Entity: "Products",
+			Source: "Test",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"ID"},
+				Properties: []string{"ID:integer", "InStock:bool", "Name:string"},
+			},
+		})
+
+		Convey("When we generate bulk load SQL", func() {
+
+			staging, load, count, merge, err := createBulkLoadSQL(shape, "naveego_1", nil, tableOptions{})
+			Convey("Then there should be no error", nil)
+			So(err, ShouldBeNil)
+			Convey("Then the staging table should be like the table", nil)
+			So(staging, ShouldEqual, e(`CREATE TABLE "_naveego_stage_Test.Products" LIKE "Test.Products";`))
+			Convey("Then the rows should be loaded from the reader, with bits through variables", nil)
+			So(load, ShouldEqual, e(`LOAD DATA LOCAL INFILE 'Reader::naveego_1'
+	REPLACE INTO TABLE "_naveego_stage_Test.Products"
+	CHARACTER SET utf8mb4
+	FIELDS TERMINATED BY '\t' ESCAPED BY '\\'
+	LINES TERMINATED BY '\n'
+	("ID", @"InStock", "Name")
+	SET "InStock" = CAST(@"InStock" AS UNSIGNED);`))
+			Convey("Then the loaded rows which are in the table should be counted", nil)
+			So(count, ShouldEqual, e(`SELECT COUNT(*), COUNT(t."ID") FROM "_naveego_stage_Test.Products" AS s
+	LEFT JOIN "Test.Products" AS t ON s."ID" = t."ID";`))
+			Convey("Then the rows should be merged like an upsert", nil)
+			So(merge, ShouldEqual, e(`INSERT INTO "Test.Products" ("ID", "InStock", "Name")
+	SELECT "ID", "InStock", "Name" FROM "_naveego_stage_Test.Products"
+	ON DUPLICATE KEY UPDATE
+		"Test.Products"."InStock" = VALUES("InStock")
+		,"Test.Products"."Name" = VALUES("Name");`))
+		})
+
+		Convey("When bool properties are mapped to BIT types written another way", func() {
+			s := &settings{TypeMapping: map[string]string{"bool": "bit(1)"}}
+			types, err := newTypeMapper(s)
+			So(err, ShouldBeNil)
+
+			_, load, _, _, err := createBulkLoadSQL(shape, "naveego_1", types, tableOptions{})
+			Convey("Then the bits should still be loaded through variables", nil)
+			So(err, ShouldBeNil)
+			So(load, ShouldContainSubstring, e(`("ID", @"InStock", "Name")
+	SET "InStock" = CAST(@"InStock" AS UNSIGNED);`))
+		})
+
+		Convey("When we generate bulk load SQL which skips unchanged rows", func() {
+
+			_, _, _, merge, err := createBulkLoadSQL(shape, "naveego_1", nil, tableOptions{SkipUnchanged: true})
+			Convey("Then the columns of the table should be told apart from the columns of the staging table", nil)
+			So(err, ShouldBeNil)
+			So(merge, ShouldEqual, e(`INSERT INTO "Test.Products" ("ID", "InStock", "Name", "_row_hash")
+	SELECT "ID", "InStock", "Name", "_row_hash" FROM "_naveego_stage_Test.Products"
+	ON DUPLICATE KEY UPDATE
+		"Test.Products"."InStock" = IF("Test.Products"."_row_hash" <=> VALUES("_row_hash"), "Test.Products"."InStock", VALUES("InStock"))
+		,"Test.Products"."Name" = IF("Test.Products"."_row_hash" <=> VALUES("_row_hash"), "Test.Products"."Name", VALUES("Name"))
+		,"Test.Products"."_row_hash" = VALUES("_row_hash");`))
+		})
+	})
+}
+
 func Test_ConvertFromSqlType(t *testing.T) {
 
 	Convey("Should convert correctly", t, func() {
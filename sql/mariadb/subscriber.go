@@ -5,26 +5,245 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/mitchellh/mapstructure"
 	"github.com/naveego/api/pipeline/subscriber"
 	"github.com/naveego/api/types/pipeline"
 	"github.com/naveego/navigator-go/subscribers/protocol"
+	"github.com/naveego/pipeline-subscribers/deadletter"
 	"github.com/naveego/pipeline-subscribers/shapeutils"
 
 	_ "github.com/go-sql-driver/mysql"
 )
 
+// sqlDriver is the name of the driver the connections are opened with.
+var sqlDriver = "mysql"
+
 type mariaSubscriber struct {
 	db             *sql.DB // The connection to the database
-	tx             *sql.Tx
 	connectionInfo string
-	knownShapes    shapeutils.ShapeCache
+	knownShapes    *shapeutils.ShapeCache
+	settings       *settings
+	types          *typeMapper
+	unaudited      []string // Shapes whose tables were discovered without the audit columns
+	unversioned    []string // Shapes whose tables were discovered with history columns when History isn't set, or without them when it is
+
+	indexMu sync.Mutex
+	indexes map[string]map[string]bool // The names of the indexes of the tables, by shape name
+
+	txMu          sync.Mutex
+	tx            *sql.Tx     // The transaction the rows are written in
+	transactional bool        // Whether rows are written in transactions
+	uncommitted   int         // Rows written since the last commit
+	committed     int         // Rows committed since Init
+	rejected      int         // Rows skipped because of the OnError policy
+	pending       writeCounts // Counts of the rows written since the last commit
+	counts        writeCounts // Counts of the rows committed since Init
+	rolledBack    bool        // Whether rows were rolled back since Init
+	statements    int         // Statements run in the transaction since the last commit
+	journal       []statement // The statements run since the last commit, if they are replayed (see replayLocked)
+	readers       []string    // The reader handlers of the bulk loads in the journal, kept registered for replaying
+	deadLetters   deadletter.Store
+
+	touchedMu sync.Mutex
+	touched   map[string]bool // The shapes rows were written for, which are swept in snapshot mode
+
+	planMu sync.Mutex
+	plan   []plannedStatement // The changes to the tables recorded in plan mode
+
+	inferrer *shapeutils.TypeInferrer
+	heldMu   sync.Mutex
+	held     map[string][]pipeline.DataPoint // Data points of new shapes, held until their types are inferred
+
+	batchMu      sync.Mutex
+	batches      map[string]*batch // Rows waiting to be upserted, by shape name
+	batchErr     error             // The error from the last periodic flush, if any
+	staging      map[string]bool   // The shapes whose staging tables have been created
+	stopFlushing chan struct{}
+	flushingDone chan struct{}
 }
 
 type settings struct {
 	DataSourceName string
+	// ShapeStore selects where known shapes are persisted between runs:
+	// "file", "table" or empty to only discover shapes from the database.
+	ShapeStore string
+	// ShapeStoreFile is the path of the JSON file used when ShapeStore is "file".
+	ShapeStoreFile string
+	// MissingProperties is the policy for columns which a data point's shape
+	// no longer has: "ignore" (default), "log", "nullable" or "drop".
+	MissingProperties string
+	// InferTypes enables inferring the types of untyped and string properties
+	// from their values. Data points of a shape which doesn't have a table yet
+	// are held until the types are committed. They are kept in the table
+	// _naveego_held until they are written, and are committed along with the
+	// rows, so that the ones a run didn't write are held again at Init. Once a
+	// shape has a table its values are not sampled any more, and its data points
+	// get the types of its columns. It can't be used with Schema "locked".
+	InferTypes bool
+	// InferTypesMinSamples is the number of values which must agree
+	// before an inferred type is used (default 100).
+	InferTypesMinSamples int
+	// InferTypesMaxSamples is the number of data points after which a shape's
+	// table is created even if some types are not committed (default 1000).
+	InferTypesMaxSamples int
+	// Nested is the strategy for nested objects and arrays in data points:
+	// "json" (default) stores them as JSON, "flatten" stores objects in
+	// columns with dotted names and "child" also stores arrays in child tables.
+	Nested string
+	// BatchSize is the number of rows of a shape which are buffered and written
+	// in a single multi-row upsert. 0 or 1 writes every row as it is received.
+	BatchSize int
+	// TypeMapping overrides the SQL types of the columns created for pipeline
+	// types, e.g. {"string": "LONGTEXT", "float": "DECIMAL(18,4)"}. Every type
+	// must be mapped to a different SQL type, so that the pipeline type of a
+	// column can be discovered from its SQL type.
+	TypeMapping map[string]string
+	// ShapeTypeMapping overrides TypeMapping for the shapes it has.
+	ShapeTypeMapping map[string]map[string]string
+	// PropertyTypeMapping overrides the SQL types of single properties of shapes
+	// by pipeline type, e.g. {"Test.Products": {"Description": {"string": "LONGTEXT"},
+	// "InStock": {"bool": "CHAR(1)"}}}, so that the columns are discovered with the type.
+	PropertyTypeMapping map[string]map[string]map[string]string
+	// History keeps a version of every row instead of updating it. When the
+	// values of a row change, the current version is closed (_valid_to is set
+	// and _is_current cleared) and a new version is inserted. It only applies
+	// to tables created while it is set, and can't be used with BulkLoad.
+	// Init fails if tables were created with history columns and it isn't set,
+	// or without them and it is, because their rows are written differently.
+	History bool
+	// Audit adds the columns _loaded_at, _updated_at, _source, _entity, _run_id
+	// and _row_hash to the tables, which record when, from where and in which
+	// run a row was written. Tables created before it was set get the columns
+	// at Init. The columns are not discovered as properties of the shapes.
+	Audit bool
+	// RunID is the id written to the _run_id column. A new id is
+	// created at Init if the settings don't have one.
+	RunID string
+	// SkipUnchanged keeps a hash of the values of every row in a _row_hash
+	// column, and only updates a row when the hash of the values it is written
+	// with is different, so that unchanged rows don't reach the binlog. Tables
+	// created before it was set get the column at Init.
+	SkipUnchanged bool
+	// Deletes is the policy for tombstones, which are data points with the
+	// reserved property _deleted set to true: "hard" deletes the row with the
+	// keys of the data point, "soft" sets the _deleted column of the row instead,
+	// and writing the row again clears it. In history mode "soft" closes the
+	// current version of the row. When it is empty, _deleted is written like
+	// any other property.
+	Deletes string
+	// Snapshot is for publishers which send all the records in every run. The
+	// rows written in a run get its RunID in their _run_id column, and at Dispose
+	// the rows of the shapes written in the run which have another run id are
+	// deleted, or flagged if Deletes is "soft". Rows are not swept if any rows
+	// of the run were skipped or rolled back. With SkipUnchanged, unchanged
+	// rows are still updated with the run id. It can't be used with History.
+	Snapshot bool
+	// SweepMaxFraction is the largest fraction of the rows of a table which
+	// may be swept (default 0.5). If more rows of any table were not written
+	// in the run, nothing is swept and Dispose fails.
+	SweepMaxFraction float64
+	// Indexes declares secondary indexes of the tables by shape name, e.g.
+	// {"Test.Products": [{"Columns": ["Category", "Name(100)"], "Unique": true}]}.
+	// They are created with the tables, and added to existing tables at Init
+	// and as soon as a table has all the columns of an index. A row whose values
+	// in a unique index are the values of a row with other keys is rejected like
+	// a row violating a constraint, instead of being upserted into the other row.
+	Indexes map[string][]indexSettings
+	// Partitions declares the partitioning of the tables by shape name, e.g.
+	// {"Test.Readings": {"By": "range", "Property": "Date", "Interval": "day",
+	// "Ahead": 7, "Retention": 90}} or {"Test.Events": {"By": "hash", "Count": 16}}.
+	// The tables are partitioned when they are created, and at Init the
+	// range partitions missed since the last one and the upcoming ones are
+	// added, and the ones older than the retention dropped. The partitioned
+	// properties must be keys of the shapes.
+	Partitions map[string]partitionSettings
+	// TablePrefix and TableSuffix are added to the names of the tables.
+	TablePrefix string
+	TableSuffix string
+	// TableNameCase converts the names of the shapes to the names of their
+	// tables: "snake" to snake_case (Test.OrderItems to test_order_items),
+	// "lower" to lower case. When it is empty the names are kept.
+	TableNameCase string
+	// TableNameMaxLength is the longest name of a table, from 32 to 64 (default
+	// 64, the longest MariaDB allows). Longer names are shortened and end with
+	// a hash of the whole name.
+	TableNameMaxLength int
+	// SourceAsDatabase creates the tables of the shapes of a source in the
+	// database named like the source instead of the database of the
+	// DataSourceName, which must exist unless CreateDatabases is set. The
+	// shapes are discovered there too. Tables whose names are not the names of
+	// their shapes have the name of the shape in their comment, so that they
+	// are discovered as it.
+	SourceAsDatabase bool
+	// DatabaseSeparator routes the shapes whose names have a prefix ending in
+	// it to the database named like the prefix, e.g. with "__" the table of
+	// sales__Orders is Orders in the database sales, like the schema__table
+	// names of the MSSQL subscriber. It takes precedence over SourceAsDatabase.
+	DatabaseSeparator string
+	// Databases routes shapes to databases by the names of the shapes or of
+	// their sources, e.g. {"Test.Products": "catalog", "Test": "staging"}. The
+	// tables are named like the whole names of the shapes, and shapes which
+	// are not mapped are routed by DatabaseSeparator and SourceAsDatabase.
+	Databases map[string]string
+	// CreateDatabases creates the databases shapes are routed to with
+	// CREATE DATABASE IF NOT EXISTS before their tables are created.
+	CreateDatabases bool
+	// KeyChanges is the strategy for changing the primary key of a table when
+	// a shape gets new keys: "alter" (default) replaces it in place, "rebuild"
+	// copies the rows into a shadow table with the new primary key and swaps
+	// the tables with an atomic RENAME TABLE, which doesn't lock the table
+	// while the key is built. Rows written to the table by other clients
+	// during a rebuild are lost. Either way the key isn't changed if rows of
+	// the table would have the same values of the new keys. "rebuild" can't be
+	// used with Nested "child", because the foreign keys aren't copied.
+	KeyChanges string
+	// Schema is the policy for changes to the tables: "apply" (default) runs
+	// the statements creating and altering the tables as the data points need
+	// them, "plan" records the statements instead and writes no rows, and
+	// "locked" rejects the data points which would need a change, like rows
+	// which can't be written, and fails Init if a discovered table needs audit
+	// columns or indexes. Neither "plan" nor "locked" can be used with
+	// BulkLoad, which creates staging tables, or with a DeadLetter "table",
+	// and "locked" can't be used with a ShapeStore "table" either.
+	Schema string
+	// SchemaPlanFile is the path of the SQL script the planned statements are
+	// written to at Dispose, grouped by shape. Without it they are in the
+	// message of the Dispose response.
+	SchemaPlanFile string
+	// BulkLoad writes the batches with LOAD DATA LOCAL INFILE into a staging
+	// table and merges them into the table from there, which is much faster
+	// than inserting them. It requires local_infile to be enabled on the
+	// server, and uses a BatchSize of 10000 unless another one is set.
+	BulkLoad bool
+	// BatchFlushSeconds is how often buffered rows are written
+	// even if the batch isn't full (default 5).
+	BatchFlushSeconds int
+	// CommitEvery is the number of rows written in a transaction before it is
+	// committed. 0 commits all the rows at Dispose. Changes to the tables also
+	// commit the rows written before them.
+	CommitEvery int
+	// OnError is the policy for rows which can't be written: "fail" (default)
+	// rolls back the transaction and fails the data point, "continue" skips the
+	// row and continues with the run.
+	OnError string
+	// Retries is how often a statement failing with a deadlock or a lost
+	// connection is retried (default 3, negative never retries). The failure
+	// rolls back the transaction, so the statements run in it since the last
+	// commit are run again first. They are only kept with a CommitEvery, so
+	// without one a statement is only retried if it is the first of the run.
+	Retries int
+	// DeadLetter selects where rows skipped by the "continue" OnError policy
+	// are kept for replaying: "file", "table" or empty to only log them.
+	DeadLetter string
+	// DeadLetterFile is the path of the JSONL file used when DeadLetter is "file".
+	DeadLetterFile string
+	// DeadLetterTable is the table used when DeadLetter is "table"
+	// (default _naveego_dead_letters).
+	DeadLetterTable string
 }
 
 func (h *mariaSubscriber) Init(request protocol.InitRequest) (protocol.InitResponse, error) {
@@ -40,14 +259,41 @@ func (h *mariaSubscriber) Init(request protocol.InitRequest) (protocol.InitRespo
 		return response, err
 	}
 
-	// Improves performance of inserts
-	_, err = h.db.Exec("SET @@session.unique_checks = 0;")
-	_, err = h.db.Exec("SET @@session.foreign_key_checks = 0;")
+	err = h.checkHistory()
+
+	if err != nil {
+		return response, err
+	}
+
+	err = h.addAuditColumns()
+
 	if err != nil {
 		return response, err
 	}
 
-	h.tx, err = h.db.Begin()
+	err = h.addIndexes()
+
+	if err != nil {
+		return response, err
+	}
+
+	err = h.maintainPartitions()
+
+	if err != nil {
+		return response, err
+	}
+
+	err = h.loadHeld()
+
+	if err != nil {
+		return response, err
+	}
+
+	if h.settings.BatchSize > 1 {
+		h.startBatching()
+	}
+
+	err = h.beginTx()
 
 	if err != nil {
 		return response, err
@@ -68,14 +314,80 @@ func (h *mariaSubscriber) Dispose(request protocol.DisposeRequest) (protocol.Dis
 		}, nil
 	}
 
+	// The staging tables are dropped even if the rows couldn't be written.
+	// After a successful Dispose they have been dropped already.
+	defer func() {
+		if h.db == nil {
+			return
+		}
+		if err := h.dropStagingTables(); err != nil {
+			logrus.Warn("Error dropping staging tables: ", err)
+		}
+	}()
+
 	var err error
 
-	if h.tx != nil {
-		err = h.tx.Commit()
+	err = h.releaseHeld()
+	if err != nil {
+		return protocol.DisposeResponse{
+			Success: false,
+			Message: "Error while writing data points held for type inference.",
+		}, h.rollback(err)
+	}
+
+	err = h.stopBatching()
+	if err != nil {
+		return protocol.DisposeResponse{
+			Success: false,
+			Message: "Error while writing batched data points.",
+		}, h.rollback(err)
+	}
+
+	err = h.commit()
+	if err != nil {
+		return protocol.DisposeResponse{
+			Success: false,
+			Message: "Error while committing transaction.",
+		}, h.rollback(err)
+	}
+
+	var plan string
+	if h.planning() {
+		plan, err = h.writePlan()
 		if err != nil {
 			return protocol.DisposeResponse{
-				Success: true,
-				Message: "Error while committing transaction.",
+				Success: false,
+				Message: "Error while writing the planned changes to the tables.",
+			}, err
+		}
+	}
+
+	swept := 0
+	if h.settings.Snapshot && !h.planning() {
+		swept, err = h.sweep()
+		if err != nil {
+			return protocol.DisposeResponse{
+				Success: false,
+				Message: "Error while sweeping rows which were not written in the run.",
+			}, h.rollback(err)
+		}
+	}
+
+	err = h.dropStagingTables()
+	if err != nil {
+		return protocol.DisposeResponse{
+			Success: false,
+			Message: "Error while dropping staging tables.",
+		}, err
+	}
+
+	if h.deadLetters != nil {
+		err = h.deadLetters.Close()
+		h.deadLetters = nil
+		if err != nil {
+			return protocol.DisposeResponse{
+				Success: false,
+				Message: "Error while closing dead letter store.",
 			}, err
 		}
 	}
@@ -90,20 +402,37 @@ func (h *mariaSubscriber) Dispose(request protocol.DisposeRequest) (protocol.Dis
 		}, err
 	}
 
+	if plan != "" {
+		return protocol.DisposeResponse{
+			Success: true,
+			Message: plan + "\nNo rows were written. Closed connection.",
+		}, nil
+	}
+
 	return protocol.DisposeResponse{
 		Success: true,
-		Message: "Closed connection.",
+		Message: fmt.Sprintf("Committed %d rows (%s), skipped %d rows, swept %d rows. Closed connection.", h.committed, h.counts, h.rejected, swept),
 	}, nil
 }
 
+// TestConnection only connects, without the changes to the tables Init makes,
+// like dropping partitions which are older than their retention.
 func (h *mariaSubscriber) TestConnection(request protocol.TestConnectionRequest) (protocol.TestConnectionResponse, error) {
 
-	resp, err := h.Init(protocol.InitRequest{Settings: request.Settings})
+	// The connection is kept if the subscriber was initialized.
+	if h.db == nil {
+		defer h.disconnect()
+	}
+
+	err := h.connect(request.Settings)
+	if err != nil {
+		return protocol.TestConnectionResponse{}, err
+	}
 
 	return protocol.TestConnectionResponse{
-		Message: resp.Message,
-		Success: resp.Success,
-	}, err
+		Message: h.connectionInfo,
+		Success: true,
+	}, nil
 }
 
 func (h *mariaSubscriber) DiscoverShapes(request protocol.DiscoverShapesRequest) (protocol.DiscoverShapesResponse, error) {
@@ -113,13 +442,20 @@ func (h *mariaSubscriber) DiscoverShapes(request protocol.DiscoverShapesRequest)
 		err      error
 	)
 
+	// The connection is kept if the subscriber was initialized.
+	if h.db == nil {
+		defer h.disconnect()
+	}
+
 	err = h.connect(request.SubscriberInstance.Settings)
 
 	if err != nil {
 		return response, err
 	}
 
-	response.Shapes = h.knownShapes.GetAllShapeDefinitions()
+	// The properties of the shape definitions only have pipeline types,
+	// so the columns they are stored in are in their descriptions.
+	response.Shapes, err = h.knownShapes.GetAllShapeDefinitionsWithColumns()
 
 	return response, err
 }
@@ -128,47 +464,269 @@ func (h *mariaSubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest)
 
 	var (
 		response   = protocol.ReceiveShapeResponse{}
-		knownShape *shapeutils.KnownShape
-		shapeDelta shapeutils.ShapeDelta
-		ok         bool
+		dataPoints = []pipeline.DataPoint{request.DataPoint}
+		err        error
 	)
 
 	if h.db == nil {
 		return response, errors.New("you must call Init before sending data points")
 	}
 
-	knownShape, ok = h.knownShapes.Recognize(request.DataPoint)
+	logrus.Debugf("Data Point: %v", request.DataPoint)
+
+	if h.inferrer != nil {
+		dataPoints, err = h.inferTypes(request.DataPoint)
+		if err != nil {
+			err = h.rollback(err)
+			return protocol.ReceiveShapeResponse{Message: err.Error()}, err
+		}
+		if len(dataPoints) == 0 {
+			return protocol.ReceiveShapeResponse{
+				Success: true,
+				Message: "Held for type inference.",
+			}, nil
+		}
+	}
+
+	response.Success = true
+
+	for _, dataPoint := range dataPoints {
+		err = h.receive(dataPoint)
+		if err == nil {
+			continue
+		}
+
+		response.Success = false
+		response.Message = err.Error()
+
+		if h.reject(dataPoint, err) == nil {
+			continue
+		}
+
+		// Nothing written since the last commit is kept,
+		// so the rows can be sent again after the failure.
+		err = h.rollback(err)
+		response.Message = err.Error()
+
+		return response, err
+	}
+
+	// The data points held for type inference have been written, or kept as dead letters.
+	if len(dataPoints) > 1 {
+		err = h.forgetHeld(shapeutils.CanonicalName(request.DataPoint))
+		if err != nil {
+			err = h.rollback(err)
+			return protocol.ReceiveShapeResponse{Message: err.Error()}, err
+		}
+	}
+
+	return response, nil
+}
+
+// receive writes a single data point, storing its nested values
+// using the strategy in the settings, or deletes the row of a tombstone.
+func (h *mariaSubscriber) receive(dataPoint pipeline.DataPoint) error {
+
+	if h.settings.Deletes != "" {
+		var deleted bool
+		dataPoint, deleted = shapeutils.SplitDeleted(dataPoint)
+		if deleted {
+			return h.deleteRow(dataPoint)
+		}
+	}
+
+	switch h.settings.Nested {
+	case shapeutils.NestedFlatten:
+		dataPoint = shapeutils.FlattenDataPoint(dataPoint)
+	case shapeutils.NestedChildTables:
+		return h.receiveWithChildren(dataPoint)
+	default:
+		dataPoint = shapeutils.EncodeNestedValues(dataPoint)
+	}
+
+	return h.write(dataPoint, h.applyShapeChange)
+}
+
+// write upserts a single data point, using apply to alter the table first if necessary.
+func (h *mariaSubscriber) write(dataPoint pipeline.DataPoint, apply shapeutils.ShapeChangeFunc) error {
+
+	knownShape, err := h.knownShapes.Ensure(dataPoint, apply)
+	if err != nil {
+		return err
+	}
+
+	// In plan mode the tables may not have the columns of the rows.
+	if h.planning() {
+		return nil
+	}
+
+	h.touch(knownShape.Name)
+
+	if h.settings.BatchSize > 1 {
+		return h.addToBatch(knownShape, dataPoint)
+	}
+
+	err = h.widenColumns(knownShape, []pipeline.DataPoint{dataPoint})
+	if err != nil {
+		return err
+	}
+
+	return h.retryWidened(knownShape, func() error {
+		return h.writeRow(knownShape, dataPoint)
+	})
+}
+
+// writeRow upserts a single data point, or writes a version of it in history mode.
+func (h *mariaSubscriber) writeRow(knownShape *shapeutils.KnownShape, dataPoint pipeline.DataPoint) error {
+
+	if h.settings.History {
+		return h.writeVersion(knownShape, dataPoint)
+	}
+
+	err := h.checkUniqueIndexes(knownShape, []pipeline.DataPoint{dataPoint})
+	if err != nil {
+		return err
+	}
+
+	upsertCommand, upsertParameters, err := createUpsertSQL(dataPoint, knownShape, h.tableOptions())
+	if err != nil {
+		return err
+	}
+
+	return h.execCounted(1, countUpsert, upsertCommand, upsertParameters...)
+}
+
+// tableOptions returns the options the tables are created with.
+func (h *mariaSubscriber) tableOptions() tableOptions {
+	return tableOptions{
+		History:       h.settings.History,
+		Audit:         h.settings.Audit,
+		RunID:         h.settings.RunID,
+		SkipUnchanged: h.settings.SkipUnchanged,
+		Deletes:       h.settings.Deletes,
+		Snapshot:      h.settings.Snapshot,
+		Indexes:       h.settings.Indexes,
+		Naming:        newTableNamer(h.settings),
+		Partitions:    h.settings.Partitions,
+		Now:           time.Now().UTC(),
+	}
+}
+
+// applyShapeChange alters the storage for a shape which was not recognized.
+// It is called at most once per change, even when data points are received concurrently.
+func (h *mariaSubscriber) applyShapeChange(knownShape *shapeutils.KnownShape, shapeDelta shapeutils.ShapeDelta) error {
+
+	// Buffered rows must be written to the table they were received for.
+	err := h.flushBatch(shapeDelta.Name)
+	if err != nil {
+		return err
+	}
+
+	if h.settings.BulkLoad {
+		err = h.dropStagingTable(shapeDelta.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The rows are checked before the table is changed at all,
+	// so that it isn't left half changed if the new keys are not unique.
+	rebuild := false
+	if shapeDelta.HasKeyChanges && !shapeDelta.IsNew {
+		if !h.planning() {
+			err = h.checkKeys(shapeDelta)
+			if err != nil {
+				return err
+			}
+		}
+		rebuild = h.settings.KeyChanges == keyChangesRebuild
+	}
 
-	fmt.Println(request)
+	alterDelta := shapeDelta
+	if rebuild {
+		// The keys are changed when the table is rebuilt, after the columns are added.
+		alterDelta.HasKeyChanges = false
+	}
 
-	if !ok {
+	if shapeDelta.IsNew && h.settings.CreateDatabases {
+		err = h.createDatabase(shapeDelta.Name)
+		if err != nil {
+			return err
+		}
+	}
 
-		knownShape, shapeDelta = h.knownShapes.Analyze(request.DataPoint)
+	if alterDelta.HasChanges() {
+		var sqlCommand string
+		sqlCommand, err = createShapeChangeSQL(alterDelta, h.types, h.tableOptions())
+		if err != nil {
+			return err
+		}
+
+		err = h.execDDL(shapeDelta.Name, sqlCommand)
 
-		sqlCommand, err := createShapeChangeSQL(shapeDelta)
 		if err != nil {
-			return response, err
+			return err
 		}
 
-		_, err = h.db.Exec(sqlCommand)
+		if shapeDelta.IsNew {
+			h.recordIndexes(shapeDelta.Name, newTableIndexes(shapeDelta.Name, shapeDelta.NewProperties, h.tableOptions()))
+		}
+	}
 
+	if rebuild {
+		err = h.rebuildKeys(shapeDelta)
 		if err != nil {
-			return response, err
+			return err
 		}
+	}
+
+	// New columns may complete the columns of an index.
+	err = h.ensureIndexes(knownShape.Name, knownShape.Properties)
+	if err != nil {
+		return err
+	}
 
-		knownShape = h.knownShapes.Remember(knownShape)
+	if shapeDelta.HasRemovals() {
+		return h.handleMissingProperties(shapeDelta)
 	}
 
-	upsertCommand, upsertParameters, err := createUpsertSQL(request.DataPoint, knownShape)
+	return nil
+}
+
+// handleMissingProperties applies the MissingProperties policy to a shape
+// which no longer has some of the known properties or keys.
+func (h *mariaSubscriber) handleMissingProperties(shapeDelta shapeutils.ShapeDelta) error {
+
+	policy := h.settings.MissingProperties
+
+	if policy == "" || policy == missingPropertiesIgnore {
+		return nil
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"shape":              shapeDelta.Name,
+		"missing_properties": missingPropertyNames(shapeDelta),
+		"removed_keys":       shapeDelta.RemovedKeys,
+		"policy":             policy,
+	}).Warn("Data point shape is missing known properties")
+
+	sqlCommand, err := createMissingPropertiesSQL(shapeDelta, policy, h.types, h.tableOptions())
+	if err != nil || sqlCommand == "" {
+		return err
+	}
+
+	err = h.execDDL(shapeDelta.Name, sqlCommand)
 	if err != nil {
-		return response, err
+		return err
 	}
 
-	_, err = h.db.Exec(upsertCommand, upsertParameters...)
+	if policy == missingPropertiesDrop {
+		// The shape being applied doesn't have the dropped properties,
+		// so once they are forgotten they won't be merged back in.
+		_, err = h.knownShapes.Forget(shapeDelta.Name, missingPropertyNames(shapeDelta))
+	}
 
-	return protocol.ReceiveShapeResponse{
-		Success: true,
-	}, nil
+	return err
 }
 
 func (h *mariaSubscriber) connect(settingsMap map[string]interface{}) error {
@@ -194,7 +752,141 @@ func (h *mariaSubscriber) connect(settingsMap map[string]interface{}) error {
 		return errors.New("settings didn't contain DataSourceName key")
 	}
 
-	db, err = sql.Open("mysql", settings.DataSourceName)
+	if settings.InferTypesMinSamples == 0 {
+		settings.InferTypesMinSamples = 100
+	}
+	if settings.InferTypesMaxSamples == 0 {
+		settings.InferTypesMaxSamples = 1000
+	}
+
+	if settings.History && settings.BulkLoad {
+		return errors.New("History can't be used with BulkLoad")
+	}
+
+	if settings.Snapshot && settings.History {
+		return errors.New("Snapshot can't be used with History")
+	}
+
+	if settings.SweepMaxFraction == 0 {
+		settings.SweepMaxFraction = 0.5
+	}
+	if settings.SweepMaxFraction < 0 || settings.SweepMaxFraction > 1 {
+		return fmt.Errorf("SweepMaxFraction must be between 0 and 1, got %g", settings.SweepMaxFraction)
+	}
+
+	if (settings.Audit || settings.Snapshot) && settings.RunID == "" {
+		settings.RunID = shapeutils.NewRunID()
+	}
+
+	if settings.BulkLoad && settings.BatchSize <= 1 {
+		settings.BatchSize = 10000
+	}
+
+	if settings.BatchFlushSeconds <= 0 {
+		settings.BatchFlushSeconds = 5
+	}
+
+	if settings.CommitEvery < 0 {
+		return fmt.Errorf("CommitEvery must not be negative, got %d", settings.CommitEvery)
+	}
+
+	if settings.Retries > 0 && settings.CommitEvery == 0 {
+		logrus.Warn("Retries only apply to the first statement of the run without a CommitEvery")
+	}
+
+	if settings.Retries == 0 {
+		settings.Retries = 3
+	}
+
+	switch settings.OnError {
+	case "":
+		settings.OnError = onErrorFail
+	case onErrorFail, onErrorContinue:
+	default:
+		return fmt.Errorf("unknown OnError policy %q", settings.OnError)
+	}
+
+	switch settings.KeyChanges {
+	case "":
+		settings.KeyChanges = keyChangesAlter
+	case keyChangesAlter:
+	case keyChangesRebuild:
+		if settings.Nested == shapeutils.NestedChildTables {
+			return fmt.Errorf("KeyChanges %q can't be used with Nested %q", settings.KeyChanges, settings.Nested)
+		}
+	default:
+		return fmt.Errorf("unknown KeyChanges strategy %q", settings.KeyChanges)
+	}
+
+	switch settings.Schema {
+	case "":
+		settings.Schema = schemaApply
+	case schemaApply:
+	case schemaPlan, schemaLocked:
+		if settings.BulkLoad {
+			return fmt.Errorf("Schema %q can't be used with BulkLoad", settings.Schema)
+		}
+	default:
+		return fmt.Errorf("unknown Schema policy %q", settings.Schema)
+	}
+
+	// The data points of new shapes would be held for tables which can't be created.
+	if settings.Schema == schemaLocked && settings.InferTypes {
+		return fmt.Errorf("Schema %q can't be used with InferTypes", settings.Schema)
+	}
+
+	// The store would remember the planned changes as if they were applied.
+	if settings.Schema == schemaPlan && settings.ShapeStore != "" {
+		return fmt.Errorf("Schema %q can't be used with ShapeStore", settings.Schema)
+	}
+
+	// The metadata tables are created at connect, outside of the Schema policy.
+	if settings.Schema == schemaLocked && settings.ShapeStore == "table" {
+		return fmt.Errorf("Schema %q can't be used with ShapeStore %q", settings.Schema, settings.ShapeStore)
+	}
+	if settings.Schema != schemaApply && settings.DeadLetter == "table" {
+		return fmt.Errorf("Schema %q can't be used with DeadLetter %q", settings.Schema, settings.DeadLetter)
+	}
+
+	switch settings.Deletes {
+	case "", shapeutils.DeletesHard, shapeutils.DeletesSoft:
+	default:
+		return fmt.Errorf("unknown Deletes policy %q", settings.Deletes)
+	}
+
+	switch settings.Nested {
+	case "", shapeutils.NestedJSON, shapeutils.NestedFlatten, shapeutils.NestedChildTables:
+	default:
+		return fmt.Errorf("unknown Nested strategy %q", settings.Nested)
+	}
+
+	switch settings.MissingProperties {
+	case "", missingPropertiesIgnore, missingPropertiesLog, missingPropertiesNullable, missingPropertiesDrop:
+	default:
+		return fmt.Errorf("unknown MissingProperties policy %q", settings.MissingProperties)
+	}
+
+	types, err := newTypeMapper(settings)
+	if err != nil {
+		return err
+	}
+
+	err = validateIndexes(settings)
+	if err != nil {
+		return err
+	}
+
+	err = validateTableNaming(settings)
+	if err != nil {
+		return err
+	}
+
+	err = validatePartitions(settings)
+	if err != nil {
+		return err
+	}
+
+	db, err = sql.Open(sqlDriver, settings.DataSourceName)
 
 	if err != nil {
 		return fmt.Errorf("couldn't open SQL connection: %s", err)
@@ -208,20 +900,73 @@ func (h *mariaSubscriber) connect(settingsMap map[string]interface{}) error {
 
 	h.connectionInfo = fmt.Sprintf("Connected to: %s", version)
 	h.db = db
+	h.settings = settings
+	h.types = types
+
+	if settings.InferTypes {
+		h.inferrer = shapeutils.NewTypeInferrer(settings.InferTypesMinSamples, settings.InferTypesMaxSamples)
+		h.held = map[string][]pipeline.DataPoint{}
+	}
 	shapes, err := h.getKnownShapes()
 	if err != nil {
 		return err
 	}
 
-	h.knownShapes = shapeutils.NewShapeCache()
+	h.deadLetters, err = newDeadLetterStore(settings, db)
+	if err != nil {
+		return err
+	}
+
+	store, err := newShapeStore(settings, db)
+	if err != nil {
+		return err
+	}
 
+	if store == nil {
+		h.knownShapes = shapeutils.NewShapeCache()
+	} else {
+		h.knownShapes, err = shapeutils.NewShapeCacheWithStore(store)
+		if err != nil {
+			return fmt.Errorf("couldn't load shapes from store: %s", err)
+		}
+	}
+
+	// Stored shapes know more than we can discover from the tables,
+	// so the database only fills in the shapes the store doesn't know,
+	// and the columns of the shapes, which are always the ones in the tables.
 	for _, shape := range shapes {
-		h.knownShapes.Remember(shape)
+		if h.knownShapes.Knows(shape.Name) {
+			_, err = h.knownShapes.SetColumns(shape.Name, shape.Columns)
+		} else {
+			_, err = h.knownShapes.Remember(shape)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// disconnect closes the connection and the dead letter store opened by connect,
+// which is all there is to close for the requests which don't call Init.
+func (h *mariaSubscriber) disconnect() {
+
+	if h.deadLetters != nil {
+		if err := h.deadLetters.Close(); err != nil {
+			logrus.Warn("Error closing dead letter store: ", err)
+		}
+		h.deadLetters = nil
+	}
+
+	if h.db != nil {
+		if err := h.db.Close(); err != nil {
+			logrus.Warn("Error closing connection: ", err)
+		}
+		h.db = nil
+	}
+}
+
 func (s *mariaSubscriber) receiveShapeToTable(ctx subscriber.Context, shape pipeline.ShapeDefinition, dataPoint pipeline.DataPoint) error {
 	schemaName := "dbo"
 	tableName := shape.Name
@@ -264,63 +1009,3 @@ func (s *mariaSubscriber) receiveShapeToTable(ctx subscriber.Context, shape pipe
 
 	return nil
 }
-
-func (h *mariaSubscriber) getKnownShapes() ([]*shapeutils.KnownShape, error) {
-
-	var (
-		err        error
-		rows       *sql.Rows
-		tableNames []string
-		shapes     []*shapeutils.KnownShape
-	)
-
-	rows, err = h.db.Query("SHOW TABLES")
-	if err != nil {
-		return shapes, err
-	}
-	for rows.Next() {
-		var tableName string
-		err = rows.Scan(&tableName)
-		if err != nil {
-			return shapes, err
-		}
-		tableNames = append(tableNames, tableName)
-	}
-
-	for _, table := range tableNames {
-
-		rows, err = h.db.Query(fmt.Sprintf("DESCRIBE `%s`", table))
-		if err != nil {
-			return shapes, err
-		}
-		dp := pipeline.DataPoint{
-			Shape: pipeline.Shape{},
-		}
-
-		for rows.Next() {
-			var (
-				field   string
-				coltype string
-				null    string
-				key     string
-				def     interface{}
-				extra   string
-			)
-			err = rows.Scan(&field, &coltype, &null, &key, &def, &extra)
-			if err != nil {
-				return shapes, err
-			}
-			dp.Source = table
-			if key == "PRI" {
-				dp.Shape.KeyNames = append(dp.Shape.KeyNames, field)
-			}
-			dp.Shape.Properties = append(dp.Shape.Properties, field+":"+convertFromSQLType(coltype))
-		}
-
-		shape := shapeutils.NewKnownShape(dp)
-
-		shapes = append(shapes, shape)
-	}
-
-	return shapes, nil
-}
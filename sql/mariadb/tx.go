@@ -0,0 +1,366 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-sql-driver/mysql"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// beginTx starts the transaction the upserts run in.
+func (h *mariaSubscriber) beginTx() error {
+
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+
+	h.transactional = true
+
+	return h.beginTxLocked()
+}
+
+func (h *mariaSubscriber) beginTxLocked() error {
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	// Improves performance of inserts. Session variables have to be set on the
+	// transaction, because it may not get the connection they were set on.
+	// Without unique checks, duplicates in the unique indexes would go unnoticed.
+	if !h.settings.hasUniqueIndexes() {
+		_, err = tx.Exec("SET @@session.unique_checks = 0;")
+	}
+	if err == nil {
+		_, err = tx.Exec("SET @@session.foreign_key_checks = 0;")
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	h.tx = tx
+
+	return nil
+}
+
+// retryDelay is how long exec waits before the first retry of a statement.
+// The delay grows with every retry.
+var retryDelay = 100 * time.Millisecond
+
+// exec runs a statement which writes rows in the current transaction, and commits
+// the transaction once CommitEvery rows have been written since the last commit.
+// Errors are returned as a *writeError. A statement failing with a deadlock or a
+// lost connection is retried in a new transaction, after the statements before it
+// in the lost transaction have been replayed. It fails if they were not kept.
+func (h *mariaSubscriber) exec(rows int, query string, args ...interface{}) error {
+	return h.execCounted(rows, nil, query, args...)
+}
+
+// execCounted is exec for a statement which upserts rows. count classifies the rows
+// by the number of rows the statement affected, and the counts are added to the
+// counts reported at Dispose when the transaction is committed.
+func (h *mariaSubscriber) execCounted(rows int, count func(affected int64) writeCounts, query string, args ...interface{}) error {
+	return h.execCountedWith(h.execLocked, rows, count, query, args...)
+}
+
+// execCascading is execCounted for a statement which deletes rows of tables which may
+// have child tables. The transactions run without foreign key checks, so the checks are
+// turned on for the statement, which makes the foreign keys delete the child rows too.
+func (h *mariaSubscriber) execCascading(rows int, count func(affected int64) writeCounts, query string, args ...interface{}) error {
+
+	// Only the child tables of Nested "child" have foreign keys.
+	if h.settings.Nested != shapeutils.NestedChildTables {
+		return h.execCounted(rows, count, query, args...)
+	}
+
+	return h.execCountedWith(h.execCascadingLocked, rows, count, query, args...)
+}
+
+func (h *mariaSubscriber) execCountedWith(execLocked func(query string, args ...interface{}) (sql.Result, error),
+	rows int, count func(affected int64) writeCounts, query string, args ...interface{}) error {
+
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+
+	var result sql.Result
+
+	for attempt := 0; ; attempt++ {
+
+		// A retry runs the statements of the lost transaction again first.
+		var err error
+		if attempt > 0 {
+			err = h.replayLocked()
+		}
+		if err == nil {
+			result, err = execLocked(query, args...)
+		}
+		if err == nil {
+			break
+		}
+
+		we := classifyError(err)
+		if !we.transient() || attempt >= h.settings.Retries || !h.replayable() {
+			return we
+		}
+
+		logrus.Warnf("Retrying statement after %s (attempt %d of %d)", we, attempt+1, h.settings.Retries)
+		time.Sleep(time.Duration(attempt+1) * retryDelay)
+
+		// The server has already rolled back the transaction.
+		if h.tx != nil {
+			h.tx.Rollback()
+			h.tx = nil
+		}
+	}
+
+	h.uncommitted += rows
+	h.statements++
+	if h.journaling() {
+		h.journal = append(h.journal, statement{exec: execLocked, query: query, args: args})
+	}
+
+	if count != nil {
+		affected, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		h.pending.add(count(affected))
+	}
+
+	if h.transactional && h.settings.CommitEvery > 0 && h.uncommitted >= h.settings.CommitEvery {
+		return h.commitLocked(true)
+	}
+
+	return nil
+}
+
+func (h *mariaSubscriber) execLocked(query string, args ...interface{}) (sql.Result, error) {
+
+	if !h.transactional {
+		return h.db.Exec(query, args...)
+	}
+
+	// The transaction is gone if a new one couldn't be begun after a failure.
+	if h.tx == nil {
+		if err := h.beginTxLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	return h.tx.Exec(query, args...)
+}
+
+// statement is a statement run in the transaction, which is replayed if the transaction is lost.
+type statement struct {
+	exec  func(query string, args ...interface{}) (sql.Result, error)
+	query string
+	args  []interface{}
+}
+
+// journaling reports whether the statements run in the transaction are kept
+// for replaying. Without CommitEvery they would be all the statements of the run.
+func (h *mariaSubscriber) journaling() bool {
+	return h.transactional && h.settings.CommitEvery > 0
+}
+
+// replayable reports whether a statement can be retried in a new transaction,
+// because there were no statements before it in the lost one, or they can be replayed.
+func (h *mariaSubscriber) replayable() bool {
+	return !h.transactional || h.statements == 0 || h.journaling()
+}
+
+// replayLocked runs the statements of a lost transaction again in a new one.
+func (h *mariaSubscriber) replayLocked() error {
+
+	if len(h.journal) > 0 {
+		logrus.Warnf("Replaying %d statements of the lost transaction", len(h.journal))
+	}
+
+	for _, s := range h.journal {
+		_, err := s.exec(s.query, s.args...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// releaseReader deregisters the reader handler of a bulk load, or keeps it until
+// the transaction is committed or rolled back if the load may be replayed.
+func (h *mariaSubscriber) releaseReader(name string) {
+
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+
+	if h.journaling() {
+		h.readers = append(h.readers, name)
+		return
+	}
+
+	mysql.DeregisterReaderHandler(name)
+}
+
+// forgetLocked forgets the statements of the transaction once it is committed or rolled back.
+func (h *mariaSubscriber) forgetLocked() {
+
+	for _, name := range h.readers {
+		mysql.DeregisterReaderHandler(name)
+	}
+	h.readers = nil
+	h.journal = nil
+	h.statements = 0
+}
+
+// execCascadingLocked runs a statement with foreign key checks turned on. Outside
+// a transaction the connections have them on already.
+func (h *mariaSubscriber) execCascadingLocked(query string, args ...interface{}) (sql.Result, error) {
+
+	if !h.transactional {
+		return h.db.Exec(query, args...)
+	}
+
+	_, err := h.execLocked("SET @@session.foreign_key_checks = 1;")
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := h.tx.Exec(query, args...)
+
+	// The rows which follow are written without the checks again,
+	// even if the statement failed but the transaction goes on.
+	_, resetErr := h.tx.Exec("SET @@session.foreign_key_checks = 0;")
+	if err == nil {
+		err = resetErr
+	}
+
+	return result, err
+}
+
+// queryRow runs a query in the current transaction, so that it sees the rows
+// written since the last commit, and scans the row it returns into dest.
+func (h *mariaSubscriber) queryRow(query string, args []interface{}, dest ...interface{}) error {
+
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+
+	if !h.transactional {
+		return h.db.QueryRow(query, args...).Scan(dest...)
+	}
+
+	if h.tx == nil {
+		if err := h.beginTxLocked(); err != nil {
+			return err
+		}
+	}
+
+	return h.tx.QueryRow(query, args...).Scan(dest...)
+}
+
+// execDDL runs a statement which changes the table of a shape, or plans or rejects
+// it by the Schema policy. MariaDB commits the current transaction before any DDL
+// statement, and on another connection the statement would wait for the locks our
+// transaction holds, so the transaction is committed first and a new one is started
+// for the rows which follow.
+func (h *mariaSubscriber) execDDL(shapeName, query string) error {
+
+	run, err := h.changeSchema(shapeName, query)
+	if !run {
+		return err
+	}
+
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+
+	err = h.commitLocked(h.transactional)
+	if err != nil {
+		return err
+	}
+
+	_, err = h.db.Exec(query)
+
+	return err
+}
+
+// commit commits the current transaction without starting a new one.
+func (h *mariaSubscriber) commit() error {
+
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+
+	return h.commitLocked(false)
+}
+
+func (h *mariaSubscriber) commitLocked(begin bool) error {
+
+	if h.tx != nil {
+		tx := h.tx
+		h.tx = nil
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	h.committed += h.uncommitted
+	h.uncommitted = 0
+	h.forgetLocked()
+	h.counts.add(h.pending)
+	h.pending = writeCounts{}
+
+	if begin {
+		return h.beginTxLocked()
+	}
+
+	return nil
+}
+
+// rollback discards the rows written since the last commit, including the
+// rows waiting in batches, and starts a new transaction. The returned error
+// describes cause and how many rows were committed before it.
+func (h *mariaSubscriber) rollback(cause error) error {
+
+	discarded := 0
+
+	h.batchMu.Lock()
+	for name, b := range h.batches {
+		discarded += len(b.dataPoints)
+		delete(h.batches, name)
+	}
+	h.batchMu.Unlock()
+
+	h.txMu.Lock()
+	defer h.txMu.Unlock()
+
+	if !h.transactional {
+		return fmt.Errorf("%s (%d rows committed)", cause, h.committed+h.uncommitted)
+	}
+
+	var err error
+	if h.tx != nil {
+		err = h.tx.Rollback()
+		h.tx = nil
+	}
+
+	discarded += h.uncommitted
+	h.uncommitted = 0
+	h.forgetLocked()
+	h.pending = writeCounts{}
+	h.rolledBack = true
+
+	result := fmt.Sprintf("rolled back %d rows, %d rows committed", discarded, h.committed)
+
+	// A lost connection has rolled back the transaction on the server anyway.
+	if err != nil && err != sql.ErrTxDone {
+		result += fmt.Sprintf("; rollback failed: %s", err)
+	}
+
+	if err = h.beginTxLocked(); err != nil {
+		result += fmt.Sprintf("; couldn't begin a new transaction: %s", err)
+	}
+
+	return fmt.Errorf("%s (%s)", cause, result)
+}
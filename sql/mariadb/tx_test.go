@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/naveego/api/types/pipeline"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTransactions(t *testing.T) {
+
+	Convey("Given a subscriber with a transaction", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		expectBegin := func() {
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta("SET @@session.unique_checks = 0;")).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec(regexp.QuoteMeta("SET @@session.foreign_key_checks = 0;")).WillReturnResult(sqlmock.NewResult(0, 0))
+		}
+
+		expectBegin()
+
+		sut := &mariaSubscriber{db: db, settings: &settings{CommitEvery: 2, Retries: 3, OnError: onErrorFail}}
+		So(sut.beginTx(), ShouldBeNil)
+
+		Convey("When CommitEvery rows are written", func() {
+			mock.ExpectExec("INSERT").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("INSERT").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			expectBegin()
+
+			So(sut.exec(1, "INSERT 1"), ShouldBeNil)
+			So(sut.exec(1, "INSERT 2"), ShouldBeNil)
+
+			Convey("Then the transaction should be committed and a new one begun", func() {
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+				So(sut.committed, ShouldEqual, 2)
+				So(sut.uncommitted, ShouldEqual, 0)
+			})
+		})
+
+		Convey("When the schema is changed", func() {
+			mock.ExpectExec("INSERT").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			expectBegin()
+			mock.ExpectExec("ALTER TABLE").WillReturnResult(sqlmock.NewResult(0, 0))
+
+			So(sut.exec(1, "INSERT 1"), ShouldBeNil)
+			So(sut.execDDL("t", "ALTER TABLE `t` ADD COLUMN `c` INT"), ShouldBeNil)
+
+			Convey("Then the rows written before it should be committed", func() {
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+				So(sut.committed, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When a statement deadlocks before any row was written", func() {
+			retryDelay = 0
+			deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}
+
+			mock.ExpectExec("INSERT").WillReturnError(deadlock)
+			mock.ExpectRollback()
+			expectBegin()
+			mock.ExpectExec("INSERT").WillReturnResult(sqlmock.NewResult(1, 1))
+
+			err = sut.exec(1, "INSERT 1")
+
+			Convey("Then it should be retried in a new transaction", func() {
+				So(err, ShouldBeNil)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+				So(sut.uncommitted, ShouldEqual, 1)
+			})
+		})
+
+		Convey("When a statement deadlocks after rows were written", func() {
+			retryDelay = 0
+			deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}
+
+			mock.ExpectExec("INSERT 1").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("INSERT 2").WillReturnError(deadlock)
+			mock.ExpectRollback()
+			expectBegin()
+			mock.ExpectExec("INSERT 1").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("INSERT 2").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			expectBegin()
+
+			So(sut.exec(1, "INSERT 1"), ShouldBeNil)
+			err = sut.exec(1, "INSERT 2")
+
+			Convey("Then the rows of the lost transaction should be written again before it is retried", func() {
+				So(err, ShouldBeNil)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+				So(sut.committed, ShouldEqual, 2)
+				So(sut.journal, ShouldBeEmpty)
+			})
+		})
+
+		Convey("When a statement deadlocks after rows were written, and they are only committed at Dispose", func() {
+			sut.settings.CommitEvery = 0
+			deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found"}
+
+			mock.ExpectExec("INSERT").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("INSERT").WillReturnError(deadlock)
+
+			So(sut.exec(1, "INSERT 1"), ShouldBeNil)
+			err = sut.exec(1, "INSERT 2")
+
+			Convey("Then it should fail, because the rows were lost with the transaction", func() {
+				So(err, ShouldHaveSameTypeAs, &writeError{})
+				So(err.(*writeError).Class, ShouldEqual, errorDeadlock)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+
+		Convey("When a row violates a constraint and the policy is to continue", func() {
+			sut.settings.OnError = onErrorContinue
+
+			mock.ExpectExec("INSERT").WillReturnError(&mysql.MySQLError{Number: 1062, Message: "Duplicate entry"})
+
+			err = sut.exec(1, "INSERT 1")
+
+			Convey("Then the row should be skipped", func() {
+				So(err, ShouldNotBeNil)
+				So(sut.reject(pipeline.DataPoint{Entity: "Products"}, err), ShouldBeNil)
+				So(sut.rejected, ShouldEqual, 1)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+
+		Convey("When writing fails", func() {
+			mock.ExpectExec("INSERT").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectExec("INSERT").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectCommit()
+			expectBegin()
+			mock.ExpectExec("INSERT").WillReturnResult(sqlmock.NewResult(1, 1))
+			mock.ExpectRollback()
+			expectBegin()
+
+			So(sut.exec(1, "INSERT 1"), ShouldBeNil)
+			So(sut.exec(1, "INSERT 2"), ShouldBeNil)
+			So(sut.exec(1, "INSERT 3"), ShouldBeNil)
+
+			err = sut.rollback(errors.New("boom"))
+
+			Convey("Then the uncommitted rows should be rolled back and the committed rows reported", func() {
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+				So(err.Error(), ShouldEqual, "boom (rolled back 1 rows, 2 rows committed)")
+				So(sut.uncommitted, ShouldEqual, 0)
+			})
+		})
+	})
+	Convey("Given a subscriber with a unique index", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		sut := &mariaSubscriber{db: db, settings: &settings{
+			Retries: 3,
+			OnError: onErrorFail,
+			Indexes: map[string][]indexSettings{"Test.Products": {{Columns: []string{"sku"}, Unique: true}}},
+		}}
+
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta("SET @@session.foreign_key_checks = 0;")).WillReturnResult(sqlmock.NewResult(0, 0))
+
+		err = sut.beginTx()
+
+		Convey("Then the transaction should keep the unique checks", func() {
+			So(err, ShouldBeNil)
+			So(mock.ExpectationsWereMet(), ShouldBeNil)
+		})
+	})
+}
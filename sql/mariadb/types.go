@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// typeMapper chooses the SQL types of columns, using the columns which have been
+// widened and the mappings in the settings before the default types of
+// convertToSQLType. A nil typeMapper uses the default types.
+type typeMapper struct {
+	types      map[string]string                       // SQL types by pipeline type
+	shapes     map[string]map[string]string            // SQL types by shape and pipeline type
+	properties map[string]map[string]map[string]string // SQL types by shape, property and pipeline type
+
+	reverse         map[string]string                       // Pipeline types by normalized SQL type
+	shapeReverse    map[string]map[string]string            // Pipeline types by shape and normalized SQL type
+	propertyReverse map[string]map[string]map[string]string // Pipeline types by shape, property and normalized SQL type
+
+	mu      sync.RWMutex
+	widened map[string]map[string]widenedType // Widened columns by shape and property
+}
+
+// widenedType is the SQL type a column was widened to, because the values
+// of a property of the pipeline type didn't fit in it.
+type widenedType struct {
+	Type    string
+	SQLType string
+}
+
+var pipelineTypes = []string{"string", "integer", "float", "bool", "date", "object"}
+
+// newTypeMapper validates the mappings in the settings
+// and returns the typeMapper which uses them.
+func newTypeMapper(s *settings) (*typeMapper, error) {
+
+	m := &typeMapper{
+		types:           s.TypeMapping,
+		shapes:          s.ShapeTypeMapping,
+		properties:      s.PropertyTypeMapping,
+		reverse:         map[string]string{},
+		shapeReverse:    map[string]map[string]string{},
+		propertyReverse: map[string]map[string]map[string]string{},
+		widened:         map[string]map[string]widenedType{},
+	}
+
+	err := addReverse(m.reverse, m.types)
+	if err != nil {
+		return nil, fmt.Errorf("invalid TypeMapping: %s", err)
+	}
+
+	for shape, types := range m.shapes {
+		m.shapeReverse[shape] = map[string]string{}
+		err = addReverse(m.shapeReverse[shape], types)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ShapeTypeMapping for %s: %s", shape, err)
+		}
+	}
+
+	for shape, properties := range m.properties {
+		m.propertyReverse[shape] = map[string]map[string]string{}
+		for property, types := range properties {
+			m.propertyReverse[shape][property] = map[string]string{}
+			err = addReverse(m.propertyReverse[shape][property], types)
+			if err != nil {
+				return nil, fmt.Errorf("invalid PropertyTypeMapping for %s of %s: %s", property, shape, err)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// addReverse adds the pipeline type for each SQL type in types to reverse.
+func addReverse(reverse map[string]string, types map[string]string) error {
+
+	// Iterate in a known order, so that the error for an
+	// ambiguous mapping is always the same.
+	names := []string{}
+	for t := range types {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+
+	for _, t := range names {
+		if !isPipelineType(t) {
+			return fmt.Errorf("unknown type %q, expected one of %s", t, strings.Join(pipelineTypes, ", "))
+		}
+
+		sqlType := normalizeSQLType(types[t])
+		if other, ok := reverse[sqlType]; ok {
+			return fmt.Errorf("%s and %s are both mapped to %s, so the type of the column can't be known", other, t, types[t])
+		}
+		reverse[sqlType] = t
+	}
+
+	return nil
+}
+
+// toSQL returns the SQL type of a property of a shape.
+func (m *typeMapper) toSQL(shape, property, t string) string {
+
+	if m != nil {
+		m.mu.RLock()
+		w, ok := m.widened[shape][property]
+		m.mu.RUnlock()
+		if ok && w.Type == t {
+			return w.SQLType
+		}
+
+		if sqlType, ok := m.properties[shape][property][t]; ok {
+			return sqlType
+		}
+		if sqlType, ok := m.shapes[shape][t]; ok {
+			return sqlType
+		}
+		if sqlType, ok := m.types[t]; ok {
+			return sqlType
+		}
+	}
+
+	return convertToSQLType(t)
+}
+
+// fromSQL returns the pipeline type of the column of a property of a shape's
+// table, which is the type the column would be created for by toSQL.
+func (m *typeMapper) fromSQL(shape, property, sqlType string) string {
+
+	if m != nil {
+		normalized := normalizeSQLType(sqlType)
+		base := strings.Split(normalized, "(")[0]
+		reverses := []map[string]string{m.propertyReverse[shape][property], m.shapeReverse[shape], m.reverse}
+
+		// A mapping with the length or precision of the column takes
+		// precedence over one with only the name of the type.
+		for _, reverse := range reverses {
+			if t, ok := reverse[normalized]; ok {
+				return t
+			}
+		}
+		for _, reverse := range reverses {
+			if t, ok := reverse[base]; ok {
+				return t
+			}
+		}
+	}
+
+	return convertFromSQLType(sqlType)
+}
+
+// widen records that the column of a property has been widened to sqlType.
+// The type is used for the property as long as it has the pipeline type t.
+func (m *typeMapper) widen(shape, property, t, sqlType string) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.widened[shape] == nil {
+		m.widened[shape] = map[string]widenedType{}
+	}
+	m.widened[shape][property] = widenedType{Type: t, SQLType: sqlType}
+}
+
+// observe records the SQL type of an existing column of a property
+// with the pipeline type t, if the column has been widened.
+func (m *typeMapper) observe(shape, property, t, sqlType string) {
+
+	base, _ := parseSQLType(sqlType)
+	if !isWidenedType(base) {
+		return
+	}
+
+	current, _ := parseSQLType(m.toSQL(shape, property, t))
+	if current != base {
+		m.widen(shape, property, t, strings.ToUpper(sqlType))
+	}
+}
+
+// normalizeSQLType returns the SQL type in the form DESCRIBE reports it.
+func normalizeSQLType(t string) string {
+	return strings.ToLower(strings.Replace(t, " ", "", -1))
+}
+
+func isPipelineType(t string) bool {
+	for _, p := range pipelineTypes {
+		if p == t {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestTypeMapper(t *testing.T) {
+
+	Convey("Given type mappings in the settings", t, func() {
+
+		sut, err := newTypeMapper(&settings{
+			TypeMapping: map[string]string{
+				"string":  "VARCHAR(4000)",
+				"integer": "BIGINT",
+			},
+			ShapeTypeMapping: map[string]map[string]string{
+				"Test.Orders": {"float": "DECIMAL(18, 4)"},
+			},
+			PropertyTypeMapping: map[string]map[string]map[string]string{
+				"Test.Products": {"Description": {"string": "LONGTEXT"}, "InStock": {"bool": "CHAR(1)"}},
+			},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("Then a property mapping should take precedence", func() {
+			So(sut.toSQL("Test.Products", "Description", "string"), ShouldEqual, "LONGTEXT")
+			So(sut.toSQL("Test.Products", "Name", "string"), ShouldEqual, "VARCHAR(4000)")
+			So(sut.toSQL("Test.Products", "Description", "integer"), ShouldEqual, "BIGINT")
+		})
+
+		Convey("Then a shape mapping should take precedence over the type mapping", func() {
+			So(sut.toSQL("Test.Orders", "Total", "float"), ShouldEqual, "DECIMAL(18, 4)")
+			So(sut.toSQL("Test.Products", "Price", "float"), ShouldEqual, "FLOAT")
+		})
+
+		Convey("Then unmapped types should use the default", func() {
+			So(sut.toSQL("Test.Products", "Created", "date"), ShouldEqual, "DATETIME")
+		})
+
+		Convey("Then the columns should be discovered with the types they were created for", func() {
+			So(sut.fromSQL("Test.Products", "Name", "varchar(4000)"), ShouldEqual, "string")
+			So(sut.fromSQL("Test.Products", "Name", "bigint(20)"), ShouldEqual, "integer")
+			So(sut.fromSQL("Test.Orders", "Name", "decimal(18,4)"), ShouldEqual, "float")
+			So(sut.fromSQL("Test.Products", "Name", "longtext"), ShouldEqual, "string")
+			So(sut.fromSQL("Test.Products", "Name", "datetime"), ShouldEqual, "date")
+		})
+
+		Convey("Then the columns of properties with mappings should be discovered with their types", func() {
+			So(sut.fromSQL("Test.Products", "InStock", "char(1)"), ShouldEqual, "bool")
+			So(sut.fromSQL("Test.Products", "Name", "char(1)"), ShouldEqual, "string")
+		})
+	})
+
+	Convey("Given no type mappings", t, func() {
+
+		sut, err := newTypeMapper(&settings{})
+		So(err, ShouldBeNil)
+
+		Convey("Then the default types should be used", func() {
+			So(sut.toSQL("Test.Products", "ID", "integer"), ShouldEqual, "INT(10)")
+			So(sut.fromSQL("Test.Products", "Name", "int(10)"), ShouldEqual, "integer")
+		})
+	})
+
+	Convey("Given two types mapped to the same SQL type", t, func() {
+
+		_, err := newTypeMapper(&settings{
+			TypeMapping: map[string]string{"string": "LONGTEXT", "object": "longtext"},
+		})
+
+		Convey("Then the mapping should be rejected", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a mapping of an unknown type", t, func() {
+
+		_, err := newTypeMapper(&settings{
+			TypeMapping: map[string]string{"money": "DECIMAL(18,4)"},
+		})
+
+		Convey("Then the mapping should be rejected", func() {
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/go-sql-driver/mysql"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// widenings are the SQL types a column is widened to when a value doesn't fit.
+var widenings = map[string]string{
+	"char":       "TEXT",
+	"varchar":    "TEXT",
+	"tinytext":   "TEXT",
+	"text":       "MEDIUMTEXT",
+	"mediumtext": "LONGTEXT",
+	"tinyint":    "BIGINT",
+	"smallint":   "BIGINT",
+	"mediumint":  "BIGINT",
+	"int":        "BIGINT",
+	"float":      "DOUBLE",
+}
+
+// textLengths are the maximum lengths in bytes of the text types.
+var textLengths = map[string]int{
+	"tinytext":   1<<8 - 1,
+	"text":       1<<16 - 1,
+	"mediumtext": 1<<24 - 1,
+	"longtext":   1<<32 - 1,
+}
+
+// integerRanges are the maximum values of the signed integer types.
+var integerRanges = map[string]float64{
+	"tinyint":   math.MaxInt8,
+	"smallint":  math.MaxInt16,
+	"mediumint": 1<<23 - 1,
+	"int":       math.MaxInt32,
+}
+
+// isWidenedType reports whether a column with the type could have been widened.
+func isWidenedType(base string) bool {
+	for _, t := range widenings {
+		if strings.ToLower(t) == base {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSQLType returns the lowercase name and the length of an SQL type,
+// e.g. "varchar" and 1000 for VARCHAR(1000).
+func parseSQLType(sqlType string) (string, int) {
+
+	t := normalizeSQLType(sqlType)
+	base := strings.Split(t, "(")[0]
+
+	length := 0
+	if i := strings.Index(t, "("); i >= 0 {
+		length, _ = strconv.Atoi(strings.Split(strings.TrimSuffix(t[i+1:], ")"), ",")[0])
+	}
+
+	return base, length
+}
+
+// widerTypeFor returns the SQL type a column of type sqlType has to be
+// widened to for the value to fit, or "" if it fits or can't be widened.
+func widerTypeFor(sqlType string, v interface{}) string {
+
+	base, length := parseSQLType(sqlType)
+
+	switch base {
+	case "char", "varchar", "tinytext", "text", "mediumtext":
+		s, ok := v.(string)
+		if !ok || fitsText(base, length, s) {
+			return ""
+		}
+		for t := widenings[base]; t != ""; t = widenings[strings.ToLower(t)] {
+			if fitsText(strings.ToLower(t), 0, s) {
+				return t
+			}
+		}
+	case "tinyint", "smallint", "mediumint", "int":
+		n, ok := numberValue(v)
+		if ok && (n > integerRanges[base] || n < -integerRanges[base]-1) {
+			return widenings[base]
+		}
+	case "float":
+		n, ok := numberValue(v)
+		if ok && math.Abs(n) > math.MaxFloat32 {
+			return widenings[base]
+		}
+	}
+
+	return ""
+}
+
+func fitsText(base string, length int, s string) bool {
+	if max, ok := textLengths[base]; ok {
+		return len(s) <= max
+	}
+	return utf8.RuneCountInString(s) <= length
+}
+
+func numberValue(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case uint32:
+		return float64(n), true
+	case uint64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// overflowColumn finds the column in the message of a "Data too long" or
+// "Out of range value" error.
+var overflowColumn = regexp.MustCompile(`for column '(.+)' at row`)
+
+// widenColumns widens the columns of knownShape which the values
+// of the data points don't fit in.
+func (h *mariaSubscriber) widenColumns(knownShape *shapeutils.KnownShape, dataPoints []pipeline.DataPoint) error {
+
+	for _, p := range knownShape.Properties {
+
+		current := h.types.toSQL(knownShape.Name, p.Name, p.Type)
+		wider := ""
+
+		for _, dp := range dataPoints {
+			if t := widerTypeFor(current, dp.Data[p.Name]); t != "" {
+				current, wider = t, t
+			}
+		}
+
+		if wider != "" {
+			err := h.widenColumn(knownShape, p, wider)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// widenColumnFor widens the column a statement failed to write a value to,
+// and reports whether it did, so that the statement can be retried.
+func (h *mariaSubscriber) widenColumnFor(knownShape *shapeutils.KnownShape, err error) (bool, error) {
+
+	mysqlErr, ok := classifyError(err).Err.(*mysql.MySQLError)
+	if !ok || (mysqlErr.Number != 1264 && mysqlErr.Number != 1406) {
+		return false, nil
+	}
+
+	match := overflowColumn.FindStringSubmatch(mysqlErr.Message)
+	if match == nil {
+		return false, nil
+	}
+
+	for _, p := range knownShape.Properties {
+		if escapeString(p.Name) != match[1] {
+			continue
+		}
+
+		base, _ := parseSQLType(h.types.toSQL(knownShape.Name, p.Name, p.Type))
+		wider, ok := widenings[base]
+		if !ok {
+			return false, nil
+		}
+
+		return true, h.widenColumn(knownShape, p, wider)
+	}
+
+	return false, nil
+}
+
+// widenColumn alters the column of a property to sqlType, and records the
+// new type so that the statements for the shape are generated with it.
+func (h *mariaSubscriber) widenColumn(knownShape *shapeutils.KnownShape, p pipeline.PropertyDefinition, sqlType string) error {
+
+	column := sqlColumnModel{
+		Name:     escapeString(p.Name),
+		SqlType:  sqlType,
+		Property: p.Name,
+	}
+	for _, k := range knownShape.Keys {
+		if k == p.Name {
+			column.IsKey = true
+		}
+	}
+
+	// Text columns can't be keys without a prefix length.
+	if column.IsKey && strings.HasSuffix(sqlType, "TEXT") {
+		return fmt.Errorf("a value of key %s of shape %s is too long for its column", p.Name, knownShape.Name)
+	}
+
+	model := sqlTableModel{
+		Name:            h.tableOptions().table(knownShape.Name),
+		ModifiedColumns: sqlColumns{column},
+	}
+
+	w := &bytes.Buffer{}
+	err := alterTemplate.Execute(w, model)
+	if err != nil {
+		return err
+	}
+
+	err = h.execDDL(knownShape.Name, w.String())
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("Widened column %s of %s to %s", p.Name, knownShape.Name, sqlType)
+
+	h.types.widen(knownShape.Name, p.Name, p.Type, sqlType)
+
+	// The staging table has to be recreated with the wider column. Bulk loads
+	// only happen while batchMu is held, which is also held while they widen.
+	delete(h.staging, knownShape.Name)
+
+	return nil
+}
+
+// retryWidened calls write, and calls it again each time it fails
+// because a value was too large for its column and the column was widened.
+func (h *mariaSubscriber) retryWidened(knownShape *shapeutils.KnownShape, write func() error) error {
+
+	// Every retry widens a column, so there can't be more retries than columns.
+	for i := 0; ; i++ {
+		err := write()
+		if err == nil || i >= len(knownShape.Properties) {
+			return err
+		}
+
+		widened, werr := h.widenColumnFor(knownShape, err)
+		if werr != nil {
+			return werr
+		}
+		if !widened {
+			return err
+		}
+	}
+}
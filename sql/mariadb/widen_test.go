@@ -0,0 +1,112 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWiderTypeFor(t *testing.T) {
+
+	Convey("Values which fit their columns should not widen them", t, func() {
+		So(widerTypeFor("VARCHAR(1000)", strings.Repeat("a", 1000)), ShouldEqual, "")
+		So(widerTypeFor("INT(10)", 2147483647), ShouldEqual, "")
+		So(widerTypeFor("INT(10)", -2147483648.0), ShouldEqual, "")
+		So(widerTypeFor("FLOAT", 1.5e38), ShouldEqual, "")
+		So(widerTypeFor("DATETIME", "2017-06-01"), ShouldEqual, "")
+		So(widerTypeFor("INT(10)", nil), ShouldEqual, "")
+	})
+
+	Convey("Values which don't fit their columns should widen them", t, func() {
+		So(widerTypeFor("VARCHAR(1000)", strings.Repeat("a", 1001)), ShouldEqual, "TEXT")
+		So(widerTypeFor("VARCHAR(1000)", strings.Repeat("a", 70000)), ShouldEqual, "MEDIUMTEXT")
+		So(widerTypeFor("text", strings.Repeat("a", 70000)), ShouldEqual, "MEDIUMTEXT")
+		So(widerTypeFor("INT(10)", 2147483648.0), ShouldEqual, "BIGINT")
+		So(widerTypeFor("int(11)", int64(-2147483649)), ShouldEqual, "BIGINT")
+		So(widerTypeFor("FLOAT", 1e39), ShouldEqual, "DOUBLE")
+	})
+
+	Convey("The length of a VARCHAR should be counted in characters", t, func() {
+		So(widerTypeFor("VARCHAR(3)", "äöü"), ShouldEqual, "")
+	})
+}
+
+func TestWidenColumns(t *testing.T) {
+
+	Convey("Given a subscriber writing a known shape", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		types, err := newTypeMapper(&settings{})
+		So(err, ShouldBeNil)
+
+		sut := &mariaSubscriber{db: db, settings: &settings{}, types: types}
+
+		shape := shapeutils.NewKnownShape(pipeline.DataPoint{
+			Entity: "Products",
+			Source: "Test",
+			Shape: pipeline.Shape{
+				KeyNames:   []string{"ID"},
+				Properties: []string{"ID:integer", "Name:string"},
+			},
+		})
+
+		Convey("When a value is too long for its column", func() {
+			mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE `Test.Products`\n\tMODIFY COLUMN `Name` TEXT NULL;")).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+
+			err = sut.widenColumns(shape, []pipeline.DataPoint{
+				{Data: map[string]interface{}{"ID": 1, "Name": strings.Repeat("a", 2000)}},
+			})
+
+			Convey("Then the column should be widened", func() {
+				So(err, ShouldBeNil)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+				So(types.toSQL("Test.Products", "Name", "string"), ShouldEqual, "TEXT")
+			})
+		})
+
+		Convey("When the database reports a value out of range", func() {
+			outOfRange := &mysql.MySQLError{Number: 1264, Message: "Out of range value for column 'ID' at row 1"}
+
+			mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE `Test.Products`\n\tMODIFY COLUMN `ID` BIGINT NOT NULL;")).
+				WillReturnResult(sqlmock.NewResult(0, 0))
+
+			attempts := 0
+			err = sut.retryWidened(shape, func() error {
+				attempts++
+				if attempts == 1 {
+					return classifyError(outOfRange)
+				}
+				return nil
+			})
+
+			Convey("Then the column should be widened and the row written again", func() {
+				So(err, ShouldBeNil)
+				So(attempts, ShouldEqual, 2)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+				So(types.toSQL("Test.Products", "ID", "integer"), ShouldEqual, "BIGINT")
+			})
+		})
+
+		Convey("When an existing column has been widened", func() {
+			types.observe("Test.Products", "Name", "string", "mediumtext")
+
+			Convey("Then the wider type should be used for the property", func() {
+				So(types.toSQL("Test.Products", "Name", "string"), ShouldEqual, "MEDIUMTEXT")
+				So(types.toSQL("Test.Products", "Name", "integer"), ShouldEqual, "INT(10)")
+			})
+		})
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+)
+
+// auditColumns are written with every row when the audit_columns setting is
+// true, and record when, from where and in which run the row was written.
+// The tables must have them; they are not discovered as properties.
+var auditColumns = []string{"_loaded_at", "_updated_at", "_source", "_entity", "_run_id", "_row_hash"}
+
+// isHiddenColumn reports whether a column is written by the subscriber
+// rather than mapped from a property.
+func isHiddenColumn(name string) bool {
+	if name == shapeutils.DeletedProperty {
+		return true
+	}
+	for _, c := range auditColumns {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// auditValues returns the values of the audit columns for a data point
+// whose mapped values are vals. Rows are only inserted, so _loaded_at
+// and _updated_at are the same.
+func auditValues(dataPoint pipeline.DataPoint, vals []interface{}, runID string) []interface{} {
+	now := time.Now().UTC()
+	return []interface{}{now, now, dataPoint.Source, dataPoint.Entity, runID, rowHash(vals)}
+}
+
+// rowHash returns the hash of the values written to a row.
+func rowHash(vals []interface{}) string {
+	// Values which can't be encoded are hashed as null.
+	data, _ := json.Marshal(vals)
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
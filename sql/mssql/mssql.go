@@ -6,11 +6,14 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"time"
 
 	_ "github.com/denisenkom/go-mssqldb"
 	"github.com/naveego/api/types/pipeline"
 	"github.com/naveego/api/utils"
 	"github.com/naveego/navigator-go/subscribers/protocol"
+	"github.com/naveego/pipeline-subscribers/deadletter"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
 	"github.com/sirupsen/logrus"
 )
 
@@ -23,6 +26,10 @@ type mssqlSubscriber struct {
 	mappings       []pipeline.ShapeMapping
 	shapes         pipeline.ShapeDefinitions
 	ensuredSchemas []string // An array of schema names that have already been ensured by this subscriber
+	deadLetters    deadletter.Store
+	audit          bool   // Whether the audit columns are written
+	runID          string // The id of the run written to the _run_id column
+	deletes        string // The policy for tombstones, see deleteFromTable
 }
 
 func (s *mssqlSubscriber) Init(request protocol.InitRequest) (protocol.InitResponse, error) {
@@ -55,7 +62,27 @@ func (s *mssqlSubscriber) Init(request protocol.InitRequest) (protocol.InitRespo
 	mr := utils.NewMapReader(request.Settings)
 	cmdType, _ := mr.ReadString("command_type")
 	postCmd, _ := mr.ReadString("post_command")
+	audit, _ := mr.ReadBool("audit_columns")
+	deletes, _ := mr.ReadString("deletes")
+	switch deletes {
+	case "", shapeutils.DeletesHard, shapeutils.DeletesSoft:
+	default:
+		return resp, fmt.Errorf("unknown deletes policy %q, expected hard or soft", deletes)
+	}
+	runID, ok := mr.ReadString("run_id")
+	if !ok {
+		runID = shapeutils.NewRunID()
+	}
 
+	deadLetters, err := newDeadLetterStore(request.Settings, db)
+	if err != nil {
+		return resp, err
+	}
+
+	s.deadLetters = deadLetters
+	s.audit = audit
+	s.runID = runID
+	s.deletes = deletes
 	s.postCmd = postCmd
 	s.shapes = sResp.Shapes
 	s.cmdType = cmdType
@@ -129,17 +156,34 @@ func (s *mssqlSubscriber) ReceiveDataPoint(request protocol.ReceiveShapeRequest)
 
 	logrus.Debugf("Data Point: %v", request.DataPoint)
 
+	dataPoint, deleted := request.DataPoint, false
+	if s.deletes != "" {
+		dataPoint, deleted = shapeutils.SplitDeleted(dataPoint)
+	}
+
 	var err error
-	if s.cmdType == "stored procedure" {
-		err = s.receiveShapeToSP(shape, request.DataPoint)
+	if deleted {
+		err = s.deleteFromTable(shape, dataPoint)
+	} else if s.cmdType == "stored procedure" {
+		err = s.receiveShapeToSP(shape, dataPoint)
 	} else {
-		err = s.receiveShapeToTable(shape, request.DataPoint)
+		err = s.receiveShapeToTable(shape, dataPoint)
 	}
 
 	if err != nil {
 		logrus.Error("Error receiving shape: ", err)
 		resp.Success = false
 		resp.Message = err.Error()
+
+		// Data points kept for replaying don't fail the run.
+		if s.deadLetters != nil {
+			dlErr := s.deadLetters.Write(deadletter.NewEntry(request.ShapeName, request.DataPoint, err))
+			if dlErr != nil {
+				logrus.Error("Could not write dead letter: ", dlErr)
+			} else {
+				err = nil
+			}
+		}
 	} else {
 		s.count++
 		resp.Success = true
@@ -158,6 +202,14 @@ func (s *mssqlSubscriber) Dispose(request protocol.DisposeRequest) (protocol.Dis
 		}
 	}
 
+	if s.deadLetters != nil {
+		err := s.deadLetters.Close()
+		s.deadLetters = nil
+		if err != nil {
+			return protocol.DisposeResponse{}, err
+		}
+	}
+
 	if s.db != nil {
 		err := s.db.Close()
 		s.db = nil
@@ -200,6 +252,15 @@ func (s *mssqlSubscriber) receiveShapeToTable(shape pipeline.ShapeDefinition, da
 		index++
 	}
 
+	if s.audit {
+		for i, v := range auditValues(dataPoint, vals, s.runID) {
+			params = append(params, fmt.Sprintf("?%d", index))
+			colNames = append(colNames, auditColumns[i])
+			vals = append(vals, v)
+			index++
+		}
+	}
+
 	colNameStr := "[" + strings.Join(colNames, "],[") + "]"
 	paramsStr := strings.Join(params, ",")
 	cmd := fmt.Sprintf("INSERT INTO [%s].[%s] (%s) VALUES (%s)", schemaName, tableName, colNameStr, paramsStr)
@@ -214,6 +275,68 @@ func (s *mssqlSubscriber) receiveShapeToTable(shape pipeline.ShapeDefinition, da
 	return nil
 }
 
+// deleteFromTable applies the deletes policy to the row of a tombstone: "hard"
+// deletes the row with the keys of the data point, "soft" sets its _deleted
+// column, which should default to 0 for the inserted rows.
+func (s *mssqlSubscriber) deleteFromTable(shape pipeline.ShapeDefinition, dataPoint pipeline.DataPoint) error {
+	if s.cmdType == "stored procedure" {
+		return errors.New("deletes are not supported for stored procedures")
+	}
+	if len(dataPoint.Shape.KeyNames) == 0 {
+		return fmt.Errorf("can't delete a row of %s, because the data point has no keys", shape.Name)
+	}
+
+	schemaName := "dbo"
+	tableName := shape.Name
+
+	if strings.Contains(shape.Name, "__") {
+		idx := strings.Index(shape.Name, "__")
+		schemaName = tableName[:idx]
+		tableName = tableName[idx+2:]
+	}
+
+	sets := []string{"[" + shapeutils.DeletedProperty + "] = 1"}
+	vals := []interface{}{}
+	if s.deletes == shapeutils.DeletesSoft && s.audit {
+		sets = append(sets, "[_updated_at] = ?1", "[_run_id] = ?2")
+		vals = append(vals, time.Now().UTC(), s.runID)
+	}
+
+	conditions := []string{}
+	for _, k := range dataPoint.Shape.KeyNames {
+		v, ok := dataPoint.Data[k]
+		if !ok {
+			return fmt.Errorf("can't delete a row of %s, because the data point has no value for key %s", shape.Name, k)
+		}
+
+		// Keys are stored in the columns they are mapped to.
+		column := k
+		for _, m := range s.mappings {
+			if m.From == k {
+				column = m.To
+			}
+		}
+
+		vals = append(vals, v)
+		conditions = append(conditions, fmt.Sprintf("[%s] = ?%d", column, len(vals)))
+	}
+
+	where := strings.Join(conditions, " AND ")
+	cmd := fmt.Sprintf("DELETE FROM [%s].[%s] WHERE %s", schemaName, tableName, where)
+	if s.deletes == shapeutils.DeletesSoft {
+		cmd = fmt.Sprintf("UPDATE [%s].[%s] SET %s WHERE %s", schemaName, tableName, strings.Join(sets, ", "), where)
+	}
+
+	logrus.Debugf("QUERY: %s", cmd)
+	_, e := s.db.Exec(cmd, vals...)
+	if e != nil {
+		logrus.Errorf("Error executing query: %s %s", cmd, e)
+		return e
+	}
+
+	return nil
+}
+
 func (s *mssqlSubscriber) receiveShapeToSP(shape pipeline.ShapeDefinition, dataPoint pipeline.DataPoint) error {
 	schemaName := "dbo"
 	spName := shape.Name
@@ -310,6 +433,11 @@ func getShapes(settings map[string]interface{}, query string) (pipeline.ShapeDef
 			continue
 		}
 
+		// The audit and soft delete columns are written by the subscriber, not mapped from properties.
+		if isHiddenColumn(columnName) {
+			continue
+		}
+
 		shapeName := tableName
 		if schemaName != "dbo" {
 			shapeName = fmt.Sprintf("%s__%s", schemaName, tableName)
@@ -339,6 +467,29 @@ func getShapes(settings map[string]interface{}, query string) (pipeline.ShapeDef
 	return defs, nil
 }
 
+// newDeadLetterStore creates the dead letter store selected by the dead_letter
+// setting ("file" or "table"), or returns nil if failed data points should fail the run.
+func newDeadLetterStore(settings map[string]interface{}, db *sql.DB) (deadletter.Store, error) {
+	mr := utils.NewMapReader(settings)
+	kind, _ := mr.ReadString("dead_letter")
+
+	switch kind {
+	case "":
+		return nil, nil
+	case "file":
+		path, ok := mr.ReadString("dead_letter_file")
+		if !ok {
+			return nil, errors.New("dead_letter_file cannot be null or empty when dead_letter is file")
+		}
+		return deadletter.NewFileStore(path)
+	case "table":
+		table, _ := mr.ReadString("dead_letter_table")
+		return deadletter.NewTableStore(db, deadletter.MSSQL, table)
+	}
+
+	return nil, fmt.Errorf("unknown dead_letter %q, expected file or table", kind)
+}
+
 func buildConnectionString(settings map[string]interface{}, timeout int) (string, error) {
 	mr := utils.NewMapReader(settings)
 	server, ok := mr.ReadString("server")
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/naveego/api/types/pipeline"
+	"github.com/naveego/pipeline-subscribers/shapeutils"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestWriteTable(t *testing.T) {
+
+	shape := pipeline.ShapeDefinition{Name: "sales__Orders"}
+	dp := pipeline.DataPoint{
+		Source: "Test",
+		Entity: "Orders",
+		Shape:  pipeline.Shape{KeyNames: []string{"id"}, Properties: []string{"id:integer", "total:float"}},
+		Data:   map[string]interface{}{"id": 1, "total": 9.5},
+	}
+
+	Convey("Given a subscriber writing audit columns", t, func() {
+
+		db, mock, err := sqlmock.New()
+		So(err, ShouldBeNil)
+
+		Reset(func() {
+			db.Close()
+		})
+
+		sut := &mssqlSubscriber{
+			db:    db,
+			audit: true,
+			runID: "run-1",
+			mappings: []pipeline.ShapeMapping{
+				{From: "id", To: "OrderID"},
+				{From: "total", To: "Total"},
+			},
+		}
+
+		Convey("When a data point is received", func() {
+			mock.ExpectExec(regexp.QuoteMeta("INSERT INTO [sales].[Orders] ([OrderID],[Total],[_loaded_at],[_updated_at],[_source],[_entity],[_run_id],[_row_hash]) VALUES (?1,?2,?3,?4,?5,?6,?7,?8)")).
+				WithArgs(1, 9.5, sqlmock.AnyArg(), sqlmock.AnyArg(), "Test", "Orders", "run-1", rowHash([]interface{}{1, 9.5})).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+
+			err = sut.receiveShapeToTable(shape, dp)
+
+			Convey("Then the row should be inserted with the audit columns", func() {
+				So(err, ShouldBeNil)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+
+		Convey("When a tombstone is received with soft deletes", func() {
+			sut.deletes = shapeutils.DeletesSoft
+
+			mock.ExpectExec(regexp.QuoteMeta("UPDATE [sales].[Orders] SET [_deleted] = 1, [_updated_at] = ?1, [_run_id] = ?2 WHERE [OrderID] = ?3")).
+				WithArgs(sqlmock.AnyArg(), "run-1", 1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			err = sut.deleteFromTable(shape, dp)
+
+			Convey("Then the row should be flagged and get the audit columns", func() {
+				So(err, ShouldBeNil)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+
+		Convey("When a tombstone is received with hard deletes", func() {
+			sut.deletes = shapeutils.DeletesHard
+
+			mock.ExpectExec(regexp.QuoteMeta("DELETE FROM [sales].[Orders] WHERE [OrderID] = ?1")).
+				WithArgs(1).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+
+			err = sut.deleteFromTable(shape, dp)
+
+			Convey("Then the row should be deleted", func() {
+				So(err, ShouldBeNil)
+				So(mock.ExpectationsWereMet(), ShouldBeNil)
+			})
+		})
+	})
+
+	Convey("The audit and soft delete columns should not be discovered as properties", t, func() {
+		So(isHiddenColumn("_run_id"), ShouldBeTrue)
+		So(isHiddenColumn(shapeutils.DeletedProperty), ShouldBeTrue)
+		So(isHiddenColumn("Total"), ShouldBeFalse)
+	})
+}